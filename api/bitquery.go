@@ -0,0 +1,236 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// bitqueryOperators are the query operators a Bitquery find may use. They
+// are the ones every store supports, see store.Filter.
+var bitqueryOperators = []string{"$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin", "$exists", "$and", "$or"}
+
+// bitquery is the Bitquery/BMAP-API query shape: {"v": 3, "q": {...}}
+type bitquery struct {
+	V int `json:"v"`
+	Q struct {
+		Find    map[string]interface{} `json:"find"`
+		Sort    json.RawMessage        `json:"sort"`
+		Limit   int64                  `json:"limit"`
+		Skip    int64                  `json:"skip"`
+		Project map[string]interface{} `json:"project"`
+	} `json:"q"`
+}
+
+// bitqueryHandler serves GET /q/{collection}/{query}, where query is a
+// base64 encoded Bitquery. The documents are returned under the collection
+// name, as BMAP-API does.
+func bitqueryHandler(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := r.PathValue("collection")
+		if !slices.Contains(cfg.Collections(), collection) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown collection %q", collection))
+			return
+		}
+
+		bq, err := decodeBitquery(r.PathValue("query"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		q, err := bq.query(cfg.QueryMaxLimit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		docs, err := s.Query(ctx, collection, q)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		for i, doc := range docs {
+			docs[i] = project(doc, bq.Q.Project)
+		}
+		if docs == nil {
+			docs = []store.Doc{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{collection: docs})
+	}
+}
+
+// decodeBitquery accepts standard or url safe base64, padded or not
+func decodeBitquery(encoded string) (bq bitquery, err error) {
+	encoded = strings.TrimRight(encoded, "=")
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			return bq, errors.New("query is not valid base64")
+		}
+	}
+	if err = json.Unmarshal(data, &bq); err != nil {
+		return bq, fmt.Errorf("invalid query: %w", err)
+	}
+	return bq, nil
+}
+
+// query converts the Bitquery to a store query, rejecting operators outside
+// the whitelist and capping the limit at maxLimit
+func (bq bitquery) query(maxLimit int64) (q store.Query, err error) {
+	if err = checkOperators(bq.Q.Find); err != nil {
+		return q, err
+	}
+	q.Filter = bq.Q.Find
+	q.Skip = max(bq.Q.Skip, 0)
+	q.Limit = maxLimit
+	if bq.Q.Limit > 0 && bq.Q.Limit < maxLimit {
+		q.Limit = bq.Q.Limit
+	}
+	q.SortBy, q.SortDesc, err = parseSort(bq.Q.Sort)
+	return q, err
+}
+
+func checkOperators(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if strings.HasPrefix(key, "$") && !slices.Contains(bitqueryOperators, key) {
+				return fmt.Errorf("operator %s is not allowed", key)
+			}
+			if err := checkOperators(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := checkOperators(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseSort reads a sort document like {"blk.i": -1}. Stores sort on a
+// single field, so only one is accepted.
+func parseSort(raw json.RawMessage) (field string, desc bool, err error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", false, nil
+	}
+	var sort map[string]int
+	if err = json.Unmarshal(raw, &sort); err != nil {
+		return "", false, errors.New("sort must map a field to 1 or -1")
+	}
+	if len(sort) > 1 {
+		return "", false, errors.New("sort supports a single field")
+	}
+	for field, dir := range sort {
+		if dir != 1 && dir != -1 {
+			return "", false, fmt.Errorf("invalid sort direction %d for %s", dir, field)
+		}
+		return field, dir == -1, nil
+	}
+	return "", false, nil
+}
+
+// project applies a Bitquery projection. Fields set to 1 are kept (with _id
+// unless it is set to 0), otherwise fields set to 0 are dropped. Dotted
+// paths select nested fields.
+func project(doc store.Doc, projection map[string]interface{}) store.Doc {
+	if len(projection) == 0 {
+		return doc
+	}
+
+	include := false
+	for field, v := range projection {
+		if field != "_id" && truthy(v) {
+			include = true
+		}
+	}
+
+	if !include {
+		for field, v := range projection {
+			if !truthy(v) {
+				removePath(doc, field)
+			}
+		}
+		return doc
+	}
+
+	out := store.Doc{}
+	if v, ok := projection["_id"]; !ok || truthy(v) {
+		out["_id"] = doc["_id"]
+	}
+	for field, v := range projection {
+		if field != "_id" && truthy(v) {
+			copyPath(out, doc, field)
+		}
+	}
+	return out
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	}
+	return false
+}
+
+func removePath(doc map[string]interface{}, path string) {
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(doc, head)
+		return
+	}
+	if sub, ok := asMap(doc[head]); ok {
+		removePath(sub, rest)
+	}
+}
+
+func copyPath(dst map[string]interface{}, src map[string]interface{}, path string) {
+	head, rest, nested := strings.Cut(path, ".")
+	v, ok := src[head]
+	if !ok {
+		return
+	}
+	if !nested {
+		dst[head] = v
+		return
+	}
+	sub, ok := asMap(v)
+	if !ok {
+		return
+	}
+	dstSub, ok := dst[head].(map[string]interface{})
+	if !ok {
+		dstSub = map[string]interface{}{}
+		dst[head] = dstSub
+	}
+	copyPath(dstSub, sub, rest)
+}
+
+// asMap returns a nested document, which is a bson.M when read from mongo
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	}
+	return nil, false
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+func TestBitquery(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	cfg.QueryMaxLimit = 4
+	handler := NewHandler(cfg, s, nil, nil)
+	posts(t, s, 5)
+
+	encode := func(query string) string {
+		return "/q/post/" + base64.RawURLEncoding.EncodeToString([]byte(query))
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{encode(`{"v":3,"q":{"find":{}}}`), "[p1 p2 p3 p4]"},
+		{encode(`{"v":3,"q":{"find":{"MAP.app":"app0"},"sort":{"blk.i":-1},"limit":2}}`), "[p5 p3]"},
+		{encode(`{"v":3,"q":{"find":{"blk.i":{"$gt":1,"$lte":3}},"sort":{"timestamp":1}}}`), "[p2 p3]"},
+		{encode(`{"v":3,"q":{"find":{"$or":[{"_id":"p1"},{"_id":"p5"}]},"sort":{"timestamp":1},"skip":1}}`), "[p5]"},
+		// standard padded base64 is accepted too
+		{"/q/post/" + base64.StdEncoding.EncodeToString([]byte(`{"v":3,"q":{"find":{"_id":"p2"}}}`)), "[p2]"},
+	}
+	for _, tt := range tests {
+		var res map[string][]store.Doc
+		if code := serve(t, handler, tt.path, &res); code != http.StatusOK {
+			t.Errorf("GET %s = %d", tt.path, code)
+			continue
+		}
+		if got := ids(res["post"]); got != tt.want {
+			t.Errorf("GET %s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/q/unknown/e30":   http.StatusNotFound,
+		"/q/post/%21%21":   http.StatusBadRequest,
+		encode(`not json`): http.StatusBadRequest,
+		encode(`{"v":3,"q":{"find":{"$where":"1"}}}`):               http.StatusBadRequest,
+		encode(`{"v":3,"q":{"find":{"a":[{"b":{"$regex":"x"}}]}}}`): http.StatusBadRequest,
+		encode(`{"v":3,"q":{"find":{},"sort":{"a":1,"b":-1}}}`):     http.StatusBadRequest,
+		encode(`{"v":3,"q":{"find":{},"sort":{"a":2}}}`):            http.StatusBadRequest,
+	} {
+		if got := serve(t, handler, path, nil); got != code {
+			t.Errorf("GET %s = %d, want %d", path, got, code)
+		}
+	}
+}
+
+func TestProject(t *testing.T) {
+	doc := func() store.Doc {
+		return store.Doc{"_id": "tx", "a": 1.0, "b": map[string]interface{}{"c": 2.0, "d": 3.0}}
+	}
+	tests := []struct {
+		name       string
+		projection map[string]interface{}
+		want       store.Doc
+	}{
+		{"none", nil, doc()},
+		{"include", map[string]interface{}{"a": 1.0}, store.Doc{"_id": "tx", "a": 1.0}},
+		{"include nested", map[string]interface{}{"b.c": true, "_id": 0.0}, store.Doc{"b": map[string]interface{}{"c": 2.0}}},
+		{"exclude", map[string]interface{}{"a": 0.0, "b.d": false}, store.Doc{"_id": "tx", "b": map[string]interface{}{"c": 2.0}}},
+		{"missing path", map[string]interface{}{"x.y": 1.0}, store.Doc{"_id": "tx"}},
+	}
+	for _, tt := range tests {
+		if got := project(doc(), tt.projection); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: project = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/rohenaz/go-bmap-indexer/chat"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// roomPage is a page of channels or conversations
+type roomPage struct {
+	Rooms  []store.Doc `json:"rooms"`
+	Cursor string      `json:"cursor,omitempty"` // pass as ?cursor= for the next page
+}
+
+// messagePage is a page of the messages of a channel or conversation
+type messagePage struct {
+	Id       string      `json:"id"`
+	Messages []store.Doc `json:"messages"`
+	Cursor   string      `json:"cursor,omitempty"` // pass as ?cursor= for older messages, or ?since= for newer ones
+	Latest   string      `json:"latest,omitempty"` // pass as ?since= to poll for new messages
+}
+
+// listChannels serves GET /v1/channels, the channels with the most recent
+// message first, paged with limit=<n> and cursor=<cursor>
+func listChannels(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return listRooms(cfg, s, chat.ChannelsCollection)
+}
+
+// listConversations serves GET /v1/conversations, the direct message
+// conversations with the most recent message first. participant=<id> keeps
+// the conversations of one BAP identity or address.
+func listConversations(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return listRooms(cfg, s, chat.ConversationsCollection)
+}
+
+func listRooms(cfg *config.Config, s store.Store, collection string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		limit, err := pageLimit(cfg, params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		filter := store.Filter{}
+		if v := params.Get("participant"); v != "" && collection == chat.ConversationsCollection {
+			filter["participants"] = v
+		}
+		if v := params.Get("cursor"); v != "" {
+			after, err := decodeCursor(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			filter = store.Filter{"$and": []interface{}{filter, after.filterOn("last_message_at", true)}}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		docs, err := s.Query(ctx, collection, store.Query{
+			Filter:   filter,
+			SortBy:   "last_message_at",
+			SortDesc: true,
+			Limit:    limit,
+		})
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		res := roomPage{Rooms: []store.Doc{}}
+		for _, doc := range docs {
+			delete(doc, "collections")
+			res.Rooms = append(res.Rooms, doc)
+		}
+		if int64(len(docs)) == limit {
+			last := docs[len(docs)-1]
+			res.Cursor = encodeCursor(cursor{Timestamp: last["last_message_at"], Id: last["_id"]})
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// listChannelMessages serves GET /v1/channels/{id}/messages
+func listChannelMessages(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return listMessages(cfg, s, chat.ChannelsCollection)
+}
+
+// listConversationMessages serves GET /v1/conversations/{id}/messages
+func listConversationMessages(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return listMessages(cfg, s, chat.ConversationsCollection)
+}
+
+// listMessages serves the messages of a channel or conversation. By default
+// it returns the latest limit=<n> messages, newest first, and cursor=<cursor>
+// pages back from there. since=<cursor> instead returns the messages after
+// the cursor, oldest first, for a client catching up.
+func listMessages(cfg *config.Config, s store.Store, collection string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		params := r.URL.Query()
+		limit, err := pageLimit(cfg, params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		filter := chat.MessageFilter(collection, id)
+		desc := true
+		switch {
+		case params.Has("cursor") && params.Has("since"):
+			writeError(w, http.StatusBadRequest, errors.New("cursor and since are exclusive"))
+			return
+		case params.Has("cursor"), params.Has("since"):
+			v := params.Get("cursor")
+			if params.Has("since") {
+				v, desc = params.Get("since"), false
+			}
+			after, err := decodeCursor(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			filter = store.Filter{"$and": []interface{}{filter, after.filter(desc)}}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		room, err := chat.Get(ctx, s, collection, id)
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no messages in %s", id))
+			return
+		} else if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		// a message written to several collections is listed once
+		seen := map[interface{}]bool{}
+		var docs []store.Doc
+		for _, c := range room.Collections {
+			found, err := s.Query(ctx, c, store.Query{
+				Filter:   filter,
+				SortBy:   "timestamp",
+				SortDesc: desc,
+				Limit:    limit,
+			})
+			if err != nil {
+				writeQueryError(w, err)
+				return
+			}
+			for _, doc := range found {
+				if !seen[doc["_id"]] {
+					seen[doc["_id"]] = true
+					docs = append(docs, doc)
+				}
+			}
+		}
+		slices.SortFunc(docs, func(a, b store.Doc) int {
+			c := cmp.Or(
+				cmp.Compare(timestamp(a), timestamp(b)),
+				cmp.Compare(fmt.Sprint(a["_id"]), fmt.Sprint(b["_id"])),
+			)
+			if desc {
+				return -c
+			}
+			return c
+		})
+		if int64(len(docs)) > limit {
+			docs = docs[:limit]
+		}
+
+		res := messagePage{Id: id, Messages: []store.Doc{}}
+		res.Messages = append(res.Messages, docs...)
+		if len(docs) > 0 {
+			first, last := docs[0], docs[len(docs)-1]
+			if desc {
+				res.Latest = encodeCursor(cursor{Timestamp: first["timestamp"], Id: first["_id"]})
+			} else {
+				res.Latest = encodeCursor(cursor{Timestamp: last["timestamp"], Id: last["_id"]})
+			}
+			if int64(len(docs)) == limit {
+				res.Cursor = encodeCursor(cursor{Timestamp: last["timestamp"], Id: last["_id"]})
+			}
+		} else if params.Has("since") {
+			// nothing new, so poll from the same place
+			res.Latest = params.Get("since")
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// pageLimit reads limit=<n>, capped at the configured maximum
+func pageLimit(cfg *config.Config, params url.Values) (int64, error) {
+	limit := int64(defaultLimit)
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid limit %q", v)
+		}
+		limit = n
+	}
+	return min(limit, cfg.QueryMaxLimit), nil
+}
+
+func timestamp(doc store.Doc) float64 {
+	t, _ := store.ToFloat(doc["timestamp"])
+	return t
+}
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/crawler"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+const defaultLimit = 20
+
+// page is a page of documents from a collection
+type page struct {
+	Collection string      `json:"collection"`
+	Docs       []store.Doc `json:"docs"`
+	Total      int64       `json:"total"`
+	Cursor     string      `json:"cursor,omitempty"` // pass as ?cursor= for the next page
+}
+
+// cursor is the position after the last document of a page. Pages are sorted
+// by timestamp then _id, so the pair is unique.
+type cursor struct {
+	Timestamp interface{} `json:"t"`
+	Id        interface{} `json:"id"`
+}
+
+// listCollection serves GET /v1/{collection}. It filters on:
+//
+//	app=<MAP app>
+//	map.<key>=<value>  any MAP field, like map.context=channel
+//	address=<address>  the AIP or SIGMA signing address
+//	verified=true|false  whether every signature of the tx is valid
+//	bap_id=<identity key>  the BAP identity of the signer
+//	parent=<txid>, root=<txid>  replies to a post, or the posts of a thread
+//	from=<height>, to=<height>  block range
+//	status=<lifecycle status>
+//
+// and pages with limit=<n>, order=asc|desc (by timestamp, newest first by
+// default) and the cursor returned with the previous page.
+func listCollection(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := r.PathValue("collection")
+		if !slices.Contains(cfg.Collections(), collection) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown collection %q", collection))
+			return
+		}
+
+		params := r.URL.Query()
+		filter, err := collectionFilter(params)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		limit := int64(defaultLimit)
+		if v := params.Get("limit"); v != "" {
+			if limit, err = strconv.ParseInt(v, 10, 64); err != nil || limit < 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+				return
+			}
+		}
+		limit = min(limit, cfg.QueryMaxLimit)
+
+		desc := true
+		switch params.Get("order") {
+		case "", "desc":
+		case "asc":
+			desc = false
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid order %q", params.Get("order")))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		total, err := s.Count(ctx, collection, filter)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		if v := params.Get("cursor"); v != "" {
+			after, err := decodeCursor(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			filter = store.Filter{"$and": []interface{}{filter, after.filter(desc)}}
+		}
+
+		docs, err := s.Query(ctx, collection, store.Query{
+			Filter:   filter,
+			SortBy:   "timestamp",
+			SortDesc: desc,
+			Limit:    limit,
+		})
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		res := page{Collection: collection, Docs: docs, Total: total}
+		if res.Docs == nil {
+			res.Docs = []store.Doc{}
+		}
+		if int64(len(docs)) == limit {
+			last := docs[len(docs)-1]
+			res.Cursor = encodeCursor(cursor{Timestamp: last["timestamp"], Id: last["_id"]})
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// collectionFilter builds the store filter for the query parameters of
+// listCollection
+func collectionFilter(params url.Values) (store.Filter, error) {
+	filter := store.Filter{}
+	for key, values := range params {
+		value := values[0]
+		switch {
+		case key == "app":
+			filter["MAP.app"] = value
+		case strings.HasPrefix(key, "map."):
+			field := strings.TrimPrefix(key, "map.")
+			if field == "" || strings.ContainsAny(field, ".$") {
+				return nil, fmt.Errorf("invalid MAP field %q", field)
+			}
+			filter["MAP."+field] = value
+		case key == "address":
+			filter["$or"] = []interface{}{
+				store.Filter{"AIP.algorithm_signing_component": value},
+				store.Filter{"SIGMA.Address": value},
+			}
+		case key == "bap_id", key == "parent", key == "root":
+			filter[key] = value
+		case key == "verified":
+			verified, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid verified %q", value)
+			}
+			filter["verified"] = verified
+		case key == "status":
+			if !slices.Contains(crawler.Statuses, value) {
+				return nil, fmt.Errorf("unknown status %q", value)
+			}
+			filter["status"] = value
+		}
+	}
+
+	blk := store.Filter{}
+	for key, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if v := params.Get(key); v != "" {
+			height, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s height %q", key, v)
+			}
+			blk[op] = height
+		}
+	}
+	if len(blk) > 0 {
+		filter["blk.i"] = blk
+	}
+	return filter, nil
+}
+
+// filter selects the documents after the cursor in the given sort order
+func (c cursor) filter(desc bool) store.Filter {
+	return c.filterOn("timestamp", desc)
+}
+
+// filterOn is filter for pages sorted by field then _id
+func (c cursor) filterOn(field string, desc bool) store.Filter {
+	op := "$gt"
+	if desc {
+		op = "$lt"
+	}
+	return store.Filter{"$or": []interface{}{
+		store.Filter{field: store.Filter{op: c.Timestamp}},
+		store.Filter{field: c.Timestamp, "_id": store.Filter{op: c.Id}},
+	}}
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (c cursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// getTx serves GET /v1/tx/{txid}, looking the tx up in every collection
+func getTx(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txid := r.PathValue("txid")
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		for _, collection := range cfg.Collections() {
+			doc, err := s.GetTx(ctx, collection, txid)
+			if err == store.ErrNotFound {
+				continue
+			} else if err != nil {
+				writeQueryError(w, err)
+				return
+			}
+			doc["collection"] = collection
+			writeJSON(w, http.StatusOK, doc)
+			return
+		}
+		writeError(w, http.StatusNotFound, fmt.Errorf("tx %s not found", txid))
+	}
+}
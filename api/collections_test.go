@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// serve requests the path from handler and decodes the JSON response into v
+func serve(t *testing.T, handler http.Handler, path string, v interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v: %s", path, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+// posts stores n confirmed posts, one a block, with timestamps 1 to n
+func posts(t *testing.T, s store.Store, n int) {
+	t.Helper()
+	writes := make([]store.Write, n)
+	for i := range writes {
+		writes[i] = store.Write{Doc: store.Doc{
+			"_id":       fmt.Sprintf("p%d", i+1),
+			"timestamp": int64(i + 1),
+			"status":    "confirmed",
+			"blk":       map[string]interface{}{"i": i + 1},
+			"MAP":       []interface{}{map[string]interface{}{"type": "post", "app": fmt.Sprintf("app%d", i%2)}},
+		}}
+	}
+	if err := s.UpsertTxs(context.Background(), "post", writes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ids(docs []store.Doc) string {
+	var list []interface{}
+	for _, doc := range docs {
+		list = append(list, doc["_id"])
+	}
+	return fmt.Sprint(list)
+}
+
+func TestListCollection(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	cfg.QueryMaxLimit = 3
+	handler := NewHandler(cfg, s, nil, nil)
+	posts(t, s, 5)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v1/post", "[p5 p4 p3]"},
+		{"/v1/post?order=asc&limit=2", "[p1 p2]"},
+		{"/v1/post?app=app1", "[p4 p2]"},
+		{"/v1/post?map.app=app0&from=2&to=4", "[p3]"},
+		{"/v1/post?status=confirmed&limit=1", "[p5]"},
+		{"/v1/post?status=orphaned", "[]"},
+	}
+	for _, tt := range tests {
+		var res page
+		if code := serve(t, handler, tt.path, &res); code != http.StatusOK {
+			t.Errorf("GET %s = %d", tt.path, code)
+			continue
+		}
+		if got := ids(res.Docs); got != tt.want {
+			t.Errorf("GET %s = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/v1/unknown":             http.StatusNotFound,
+		"/v1/post?limit=0":        http.StatusBadRequest,
+		"/v1/post?order=up":       http.StatusBadRequest,
+		"/v1/post?from=x":         http.StatusBadRequest,
+		"/v1/post?status=lost":    http.StatusBadRequest,
+		"/v1/post?map.a.b=c":      http.StatusBadRequest,
+		"/v1/post?verified=maybe": http.StatusBadRequest,
+		"/v1/post?cursor=%21":     http.StatusBadRequest,
+	} {
+		if got := serve(t, handler, path, nil); got != code {
+			t.Errorf("GET %s = %d, want %d", path, got, code)
+		}
+	}
+}
+
+func TestListCollectionPages(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	handler := NewHandler(cfg, s, nil, nil)
+	posts(t, s, 5)
+
+	var seen []store.Doc
+	path := "/v1/post?limit=2"
+	for range 5 {
+		var res page
+		if code := serve(t, handler, path, &res); code != http.StatusOK {
+			t.Fatalf("GET %s = %d", path, code)
+		}
+		if res.Total != 5 {
+			t.Errorf("total = %d, want 5", res.Total)
+		}
+		seen = append(seen, res.Docs...)
+		if res.Cursor == "" {
+			break
+		}
+		path = "/v1/post?limit=2&cursor=" + res.Cursor
+	}
+	if got := ids(seen); got != "[p5 p4 p3 p2 p1]" {
+		t.Errorf("pages = %s", got)
+	}
+}
+
+func TestGetTx(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	handler := NewHandler(cfg, s, nil, nil)
+	posts(t, s, 1)
+
+	var doc store.Doc
+	if code := serve(t, handler, "/v1/tx/p1", &doc); code != http.StatusOK {
+		t.Fatalf("GET /v1/tx/p1 = %d", code)
+	}
+	if doc["_id"] != "p1" || doc["collection"] != "post" {
+		t.Errorf("tx = %v", doc)
+	}
+	if code := serve(t, handler, "/v1/tx/missing", nil); code != http.StatusNotFound {
+		t.Errorf("GET of a missing tx = %d", code)
+	}
+}
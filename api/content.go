@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/rohenaz/go-bmap-indexer/blob"
+	"github.com/rohenaz/go-bmap-indexer/config"
+)
+
+// getContent serves GET /v1/content/{hash}, an offloaded B or Ord content by
+// its reference or hex sha256 hash, with the media type it was stored with
+func getContent(cfg *config.Config, blobs blob.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if blobs == nil {
+			writeError(w, http.StatusNotFound, errors.New("no blob store is configured"))
+			return
+		}
+		ref, err := blob.ParseRef(r.PathValue("hash"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		data, mediaType, err := blobs.Get(ctx, ref)
+		if errors.Is(err, blob.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+
+		if mediaType == "" {
+			mediaType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", mediaType)
+		// contents never change, and are untrusted so must not run scripts
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", `"`+ref+`"`)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if r.Header.Get("If-None-Match") == `"`+ref+`"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
@@ -0,0 +1,40 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/identity"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// getIdentity serves GET /v1/identity/{key}, the BAP identity with the given
+// identity key, or the one that has signed with the given address
+func getIdentity(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		doc, err := s.GetTx(ctx, identity.Collection, key)
+		if err == store.ErrNotFound {
+			idKey, ok, resolveErr := identity.Resolve(ctx, s, key)
+			if resolveErr != nil {
+				writeQueryError(w, resolveErr)
+				return
+			}
+			if !ok {
+				writeError(w, http.StatusNotFound, fmt.Errorf("no identity for %s", key))
+				return
+			}
+			doc, err = s.GetTx(ctx, identity.Collection, idKey)
+		}
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, doc)
+	}
+}
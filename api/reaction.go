@@ -0,0 +1,38 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/reaction"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// reactions is the aggregate of a tx, with whether address=<address> reacted
+// when it is asked for
+type reactions struct {
+	*reaction.Reactions
+	Reacted *bool `json:"reacted,omitempty"`
+}
+
+// getReactions serves GET /v1/reactions/{txid}, the likes of a tx by emoji
+// and who made them
+func getReactions(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		agg, err := reaction.Get(ctx, s, r.PathValue("txid"))
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		res := reactions{Reactions: agg}
+		if address := r.URL.Query().Get("address"); address != "" {
+			reacted := agg.Reacted(address)
+			res.Reacted = &reacted
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/search"
+)
+
+// searchContent serves GET /v1/search?q=<text>, the posts and messages whose
+// content matches the text, the most relevant first. It filters on:
+//
+//	type=post|message
+//	app=<MAP app>
+//	channel=<MAP channel>
+//	since=<unix time>, until=<unix time>  timestamp range
+//
+// and pages with limit=<n> and offset=<n>.
+func searchContent(cfg *config.Config, idx search.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if idx == nil {
+			writeError(w, http.StatusNotFound, errors.New("search is not enabled"))
+			return
+		}
+
+		params := r.URL.Query()
+		q := search.Query{
+			Text:    params.Get("q"),
+			Type:    params.Get("type"),
+			App:     params.Get("app"),
+			Channel: params.Get("channel"),
+		}
+		if q.Text == "" {
+			writeError(w, http.StatusBadRequest, errors.New("q is required"))
+			return
+		}
+		if q.Type != "" && !slices.Contains(search.Types, q.Type) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid type %q", q.Type))
+			return
+		}
+		var err error
+		if q.Limit, err = pageLimit(cfg, params); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if v := params.Get("offset"); v != "" {
+			if q.Skip, err = strconv.ParseInt(v, 10, 64); err != nil || q.Skip < 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid offset %q", v))
+				return
+			}
+		}
+		for param, bound := range map[string]*float64{"since": &q.Since, "until": &q.Until} {
+			if v := params.Get(param); v != "" {
+				if *bound, err = strconv.ParseFloat(v, 64); err != nil || *bound < 0 {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", param, v))
+					return
+				}
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		res, err := idx.Search(ctx, cfg, q)
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
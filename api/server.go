@@ -0,0 +1,83 @@
+// Package api serves the indexed collections over HTTP
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/blob"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/search"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+)
+
+// Start serves the API on cfg.APIAddr until ctx is cancelled. blobs and idx
+// are nil when no blob store is configured and search is disabled.
+func Start(ctx context.Context, cfg *config.Config, s store.Store, blobs blob.Store, idx search.Index) error {
+	server := &http.Server{
+		Addr:              cfg.APIAddr,
+		Handler:           NewHandler(cfg, s, blobs, idx),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[ERROR]: shutting down api: %v", err)
+		}
+	}()
+
+	log.Printf("%sServing api on %s%s", chalk.Cyan, cfg.APIAddr, chalk.Reset)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NewHandler returns the routes of the API
+func NewHandler(cfg *config.Config, s store.Store, blobs blob.Store, idx search.Index) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/tx/{txid}", getTx(cfg, s))
+	mux.HandleFunc("GET /v1/{collection}", listCollection(cfg, s))
+	mux.HandleFunc("GET /q/{collection}/{query}", bitqueryHandler(cfg, s))
+	mux.HandleFunc("GET /v1/stream/sse", streamSSE(cfg, s))
+	mux.HandleFunc("GET /v1/stream/ws", streamWS(cfg, s))
+	mux.HandleFunc("GET /v1/content/{hash}", getContent(cfg, blobs))
+	mux.HandleFunc("GET /v1/identity/{key}", getIdentity(cfg, s))
+	mux.HandleFunc("GET /v1/thread/{txid}", getThread(cfg, s))
+	mux.HandleFunc("GET /v1/channels", listChannels(cfg, s))
+	mux.HandleFunc("GET /v1/channels/{id}/messages", listChannelMessages(cfg, s))
+	mux.HandleFunc("GET /v1/conversations", listConversations(cfg, s))
+	mux.HandleFunc("GET /v1/conversations/{id}/messages", listConversationMessages(cfg, s))
+	mux.HandleFunc("GET /v1/reactions/{txid}", getReactions(cfg, s))
+	mux.HandleFunc("GET /v1/search", searchContent(cfg, idx))
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR]: writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeQueryError reports a failed store query, telling a timeout apart
+func writeQueryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, errors.New("query timed out"))
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/feed"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+const (
+	streamBuffer = 256  // events a subscriber may fall behind before it is dropped
+	replayLimit  = 1000 // most stored documents replayed per collection on resume
+	heartbeat    = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// errResumeNotFound is returned when the tx to resume after is not stored
+var errResumeNotFound = errors.New("resume tx not found")
+
+// streamRequest is a live feed subscription. It takes the filters of
+// listCollection, except the block range, plus:
+//
+//	collection=<name>[,<name>...]  defaults to every collection
+//	since=<txid>  resume after this tx (or the SSE Last-Event-ID header)
+//	from=<height>  resume from this block height
+//
+// Live events are published by the sync running in the same process, so the
+// serve command alone only replays stored documents.
+type streamRequest struct {
+	collections []string
+	filter      store.Filter
+	since       string
+	from        uint32
+}
+
+func parseStream(cfg *config.Config, r *http.Request) (req streamRequest, err error) {
+	params := r.URL.Query()
+
+	req.collections = cfg.Collections()
+	if v := params.Get("collection"); v != "" {
+		req.collections = strings.Split(v, ",")
+		for _, c := range req.collections {
+			if !slices.Contains(cfg.Collections(), c) {
+				return req, fmt.Errorf("unknown collection %q", c)
+			}
+		}
+	}
+
+	req.since = params.Get("since")
+	if req.since == "" {
+		req.since = r.Header.Get("Last-Event-ID")
+	}
+	if v := params.Get("from"); v != "" {
+		height, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return req, fmt.Errorf("invalid from height %q", v)
+		}
+		req.from = uint32(height)
+	}
+
+	// from is the resume point here, not a filter
+	params.Del("from")
+	params.Del("to")
+	req.filter, err = collectionFilter(params)
+	return req, err
+}
+
+func (req streamRequest) match(event feed.Event) bool {
+	if !slices.Contains(req.collections, event.Collection) {
+		return false
+	}
+	ok, _ := store.Matches(event.Doc, req.filter)
+	return ok
+}
+
+// open subscribes to the feed, then reads the stored documents after the
+// resume point. Subscribing first means nothing is missed in between; the
+// live events already replayed are skipped by stream.
+func (req streamRequest) open(ctx context.Context, s store.Store) (*feed.Subscription, []feed.Event, error) {
+	sub := feed.Subscribe(streamBuffer, req.match)
+	if req.since == "" && req.from == 0 {
+		return sub, nil, nil
+	}
+
+	resume, sortBy, err := req.resumeFilter(ctx, s)
+	if err != nil {
+		sub.Close()
+		return nil, nil, err
+	}
+
+	var backlog []feed.Event
+	for _, collection := range req.collections {
+		docs, err := s.Query(ctx, collection, store.Query{
+			Filter: store.Filter{"$and": []interface{}{req.filter, resume}},
+			SortBy: sortBy,
+			Limit:  replayLimit,
+		})
+		if err != nil {
+			sub.Close()
+			return nil, nil, err
+		}
+		for _, doc := range docs {
+			if doc["_id"] != req.since {
+				backlog = append(backlog, feed.Event{Collection: collection, Doc: doc})
+			}
+		}
+	}
+	sort.SliceStable(backlog, func(i, j int) bool {
+		x, _ := lookupFloat(backlog[i].Doc, sortBy)
+		y, _ := lookupFloat(backlog[j].Doc, sortBy)
+		return x < y
+	})
+	return sub, backlog, nil
+}
+
+// resumeFilter selects the stored documents after the resume point
+func (req streamRequest) resumeFilter(ctx context.Context, s store.Store) (store.Filter, string, error) {
+	if req.since == "" {
+		return store.Filter{"blk.i": store.Filter{"$gte": req.from}}, "blk.i", nil
+	}
+	for _, collection := range req.collections {
+		doc, err := s.GetTx(ctx, collection, req.since)
+		if err == store.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		return store.Filter{"timestamp": store.Filter{"$gte": doc["timestamp"]}}, "timestamp", nil
+	}
+	return nil, "", fmt.Errorf("%w: %s", errResumeNotFound, req.since)
+}
+
+// writeOpenError reports a subscription that could not be opened
+func writeOpenError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errResumeNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeQueryError(w, err)
+}
+
+func lookupFloat(doc store.Doc, path string) (float64, bool) {
+	v, _ := store.Lookup(doc, path)
+	return store.ToFloat(v)
+}
+
+// stream sends the backlog and then live events until ctx is cancelled or
+// the subscription is dropped, pinging while idle
+func stream(ctx context.Context, sub *feed.Subscription, backlog []feed.Event, send func(feed.Event) error, ping func() error) error {
+	replayed := map[string]bool{}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return err
+		}
+		replayed[eventKey(event)] = true
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return err
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				return sub.Err()
+			}
+			if replayed[eventKey(event)] {
+				continue
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// eventKey identifies a document version, so a replayed document is only
+// sent again live if its status changed
+func eventKey(event feed.Event) string {
+	return fmt.Sprintf("%s/%v/%v", event.Collection, event.Doc["_id"], event.Doc["status"])
+}
+
+// streamSSE serves GET /v1/stream/sse as server-sent events. Each event is
+// named after its collection and has the txid as its id.
+func streamSSE(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseStream(cfg, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+
+		sub, backlog, err := req.open(r.Context(), s)
+		if err != nil {
+			writeOpenError(w, err)
+			return
+		}
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		rc := http.NewResponseController(w)
+		write := func(format string, args ...interface{}) error {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := fmt.Fprintf(w, format, args...); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		err = stream(r.Context(), sub, backlog, func(event feed.Event) error {
+			data, err := json.Marshal(event.Doc)
+			if err != nil {
+				return err
+			}
+			return write("id: %v\nevent: %s\ndata: %s\n\n", event.Doc["_id"], event.Collection, data)
+		}, func() error {
+			return write(": ping\n\n")
+		})
+		if err != nil {
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			write("event: error\ndata: %s\n\n", data)
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	// the feed is public like the rest of the API
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamWS serves GET /v1/stream/ws over a WebSocket. Each message is a
+// JSON event of the collection and document.
+func streamWS(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := parseStream(cfg, r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		sub, backlog, err := req.open(ctx, s)
+		if err != nil {
+			writeOpenError(w, err)
+			return
+		}
+		defer sub.Close()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("[ERROR]: websocket upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// the client only sends control frames, read them until it goes away
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		err = stream(ctx, sub, backlog, func(event feed.Event) error {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			return conn.WriteJSON(event)
+		}, func() error {
+			return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		})
+
+		code, reason := websocket.CloseNormalClosure, ""
+		if err != nil {
+			code, reason = websocket.CloseTryAgainLater, err.Error()
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+	}
+}
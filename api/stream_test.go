@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/rohenaz/go-bmap-indexer/feed"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// nextEvent reads the id and name of the next server-sent event, skipping
+// pings
+func nextEvent(t *testing.T, r *bufio.Reader) (id string, name string) {
+	t.Helper()
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = strings.TrimSuffix(l, "\n")
+		switch {
+		case strings.HasPrefix(l, "id: "):
+			id = strings.TrimPrefix(l, "id: ")
+		case strings.HasPrefix(l, "event: "):
+			name = strings.TrimPrefix(l, "event: ")
+		case l == "" && name != "":
+			return id, name
+		}
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	posts(t, s, 5)
+	srv := httptest.NewServer(NewHandler(cfg, s, nil, nil))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/v1/stream/sse?collection=post&app=app0&from=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("response = %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(res.Body)
+
+	// the stored posts from block 2 are replayed in block order
+	for _, want := range []string{"p3", "p5"} {
+		if id, name := nextEvent(t, r); id != want || name != "post" {
+			t.Errorf("replayed %s %s, want post %s", name, id, want)
+		}
+	}
+
+	// then the live posts that match, skipping those replayed already
+	live := func(id string, app string) store.Doc {
+		return store.Doc{"_id": id, "status": "confirmed", "MAP": []interface{}{map[string]interface{}{"type": "post", "app": app}}}
+	}
+	feed.Publish("post", live("p5", "app0"))
+	feed.Publish("like", live("l1", "app0"))
+	feed.Publish("post", live("p6", "app1"))
+	feed.Publish("post", live("p7", "app0"))
+	if id, _ := nextEvent(t, r); id != "p7" {
+		t.Errorf("live event %s, want p7", id)
+	}
+}
+
+func TestStreamWS(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	posts(t, s, 5)
+	srv := httptest.NewServer(NewHandler(cfg, s, nil, nil))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/v1/stream/ws?since=p3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the posts after p3 are replayed in time order
+	for _, want := range []string{"p4", "p5"} {
+		var event feed.Event
+		if err = conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Collection != "post" || event.Doc["_id"] != want {
+			t.Errorf("replayed %+v, want post %s", event, want)
+		}
+	}
+}
+
+func TestParseStream(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	handler := NewHandler(cfg, s, nil, nil)
+	posts(t, s, 1)
+
+	for path, code := range map[string]int{
+		"/v1/stream/sse?collection=post,unknown": http.StatusBadRequest,
+		"/v1/stream/sse?from=x":                  http.StatusBadRequest,
+		"/v1/stream/sse?status=lost":             http.StatusBadRequest,
+		"/v1/stream/sse?since=missing":           http.StatusNotFound,
+		"/v1/stream/ws?from=x":                   http.StatusBadRequest,
+	} {
+		if got := serve(t, handler, path, nil); got != code {
+			t.Errorf("GET %s = %d, want %d", path, got, code)
+		}
+	}
+}
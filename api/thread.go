@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/thread"
+)
+
+// getThread serves GET /v1/thread/{txid}, the tree of replies under a post,
+// with at most limit=<n> posts, the shallowest first
+func getThread(cfg *config.Config, s store.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := cfg.QueryMaxLimit
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 1 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+				return
+			}
+			limit = min(n, cfg.QueryMaxLimit)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), cfg.QueryTimeout)
+		defer cancel()
+
+		tree, err := thread.Get(ctx, s, r.PathValue("txid"), limit)
+		if errors.Is(err, store.ErrNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tree)
+	}
+}
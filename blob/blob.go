@@ -0,0 +1,99 @@
+// Package blob keeps contents offloaded from the indexed documents. Contents
+// are addressed by their raw sha256 CID.
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/rohenaz/go-bmap-indexer/config"
+)
+
+// ErrNotFound is returned by Get when no content has the given reference
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps content addressed blobs and their media types
+type Store interface {
+	// Put stores data under ref. Storing the same ref again is harmless.
+	Put(ctx context.Context, ref string, data []byte, mediaType string) error
+	// Get returns the data stored under ref and its media type
+	Get(ctx context.Context, ref string) (data []byte, mediaType string, err error)
+}
+
+// Hash returns the hex sha256 hash of data
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Ref returns the reference data is stored under
+func Ref(data []byte) (string, error) {
+	prefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.SHA2_256, MhLength: -1}
+	c, err := prefix.Sum(data)
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// ParseRef returns the reference of a content CID or hex sha256 hash
+func ParseRef(s string) (string, error) {
+	if digest, err := hex.DecodeString(s); err == nil && len(digest) == sha256.Size {
+		hash, err := mh.Encode(digest, mh.SHA2_256)
+		if err != nil {
+			return "", err
+		}
+		return cid.NewCidV1(cid.Raw, hash).String(), nil
+	}
+	c, err := cid.Decode(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a content hash or CID", s)
+	}
+	if prefix := c.Prefix(); prefix.Codec != cid.Raw || prefix.MhType != mh.SHA2_256 {
+		return "", fmt.Errorf("%q is not a raw sha256 CID", s)
+	}
+	// the CID may be in another base or version
+	return cid.NewCidV1(cid.Raw, c.Hash()).String(), nil
+}
+
+// Open opens the blob store selected by cfg.BlobStore
+func Open(cfg *config.Config) (Store, error) {
+	var s Store
+	switch cfg.BlobStore {
+	case "fs":
+		fs, err := OpenFS(cfg.BlobPath)
+		if err != nil {
+			return nil, err
+		}
+		s = fs
+	case "s3":
+		s = &S3{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		}
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", cfg.BlobStore)
+	}
+	return s, nil
+}
+
+// Put stores data in s, which may be nil if no blob store is configured, and
+// returns its reference
+func Put(ctx context.Context, s Store, data []byte, mediaType string) (string, error) {
+	if s == nil {
+		return "", errors.New("no blob store is open")
+	}
+	ref, err := Ref(data)
+	if err != nil {
+		return "", err
+	}
+	return ref, s.Put(ctx, ref, data, mediaType)
+}
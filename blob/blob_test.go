@@ -0,0 +1,70 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRef(t *testing.T) {
+	data := []byte("hello")
+	ref, err := Ref(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the raw sha256 CID of "hello"
+	if want := "bafkreibm6jg3ux5qumhcn2b3flc3tyu6dmlb4xa7u5bf44yegnrjhc4yeq"; ref != want {
+		t.Errorf("Ref = %s, want %s", ref, want)
+	}
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"cid", ref, ref, true},
+		{"hex sha256", Hash(data), ref, true},
+		{"cid v0", "QmRN6wdp1S2A5EtjW9A3M1vKSBuQQGcgvuhoMUoEz4iiT5", "", false},
+		{"short hex", "abcd", "", false},
+		{"garbage", "not a ref", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRef(tt.in)
+			if (err == nil) != tt.ok || got != tt.want {
+				t.Errorf("ParseRef(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFS(t *testing.T) {
+	fs, err := OpenFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	data := []byte("hello")
+	ref, err := Ref(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = fs.Get(ctx, ref); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put = %v, want ErrNotFound", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = fs.Put(ctx, ref, data, "text/plain"); err != nil {
+			t.Fatalf("Put %d: %v", i, err)
+		}
+	}
+	got, mediaType, err := fs.Get(ctx, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || mediaType != "text/plain" {
+		t.Errorf("Get = %q %q, want hello text/plain", got, mediaType)
+	}
+}
@@ -0,0 +1,72 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FS stores blobs as files, sharded by the last two characters of the
+// reference since CIDs share a prefix. The media type is kept in a .type
+// file next to the blob.
+type FS struct {
+	Dir string
+}
+
+// OpenFS returns a store in dir, creating it if needed
+func OpenFS(dir string) (*FS, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FS{Dir: dir}, nil
+}
+
+func (f *FS) path(ref string) string {
+	return filepath.Join(f.Dir, ref[len(ref)-2:], ref)
+}
+
+// Put writes the blob through a temporary file, so a partial write is never
+// served
+func (f *FS) Put(ctx context.Context, ref string, data []byte, mediaType string) error {
+	path := f.path(ref)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".type", []byte(mediaType), 0644); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ref+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the blob stored under ref
+func (f *FS) Get(ctx context.Context, ref string) ([]byte, string, error) {
+	if len(ref) < 2 || strings.ContainsAny(ref, `/\.`) {
+		return nil, "", ErrNotFound
+	}
+	path := f.path(ref)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", ErrNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+	mediaType, _ := os.ReadFile(path + ".type")
+	return data, string(mediaType), nil
+}
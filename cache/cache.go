@@ -4,7 +4,6 @@ package cache
 import (
 	"context"
 	"fmt"
-	"os"
 	"sync"
 
 	"github.com/redis/go-redis/v9"
@@ -26,9 +25,9 @@ func onRedisConnect(ctx context.Context, cn *redis.Conn) error {
 	return nil
 }
 
-func Connect() {
+// Connect to the redis cache at url
+func Connect(url string) {
 
-	url := os.Getenv("REDIS_URL")
 	opts, err := redis.ParseURL(url)
 	if err != nil {
 		panic(err)
@@ -55,3 +54,15 @@ func Set(key string, value string) error {
 func Get(key string) (string, error) {
 	return rdb.Get(ctx, key).Result()
 }
+
+// Close the redis connection if one was opened
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if rdb == nil {
+		return nil
+	}
+	Connected = false
+	return rdb.Close()
+}
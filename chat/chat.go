@@ -0,0 +1,322 @@
+// Package chat keeps a registry of the message channels and direct message
+// conversations, so a chat client can list them and page their messages
+// without scanning the message collection
+package chat
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// maxParticipants caps the senders kept on a channel
+const maxParticipants = 100
+
+// Registry collections
+const (
+	ChannelsCollection      = "channels"      // keyed by channel name
+	ConversationsCollection = "conversations" // keyed by the sorted participant pair
+)
+
+// Message contexts of the MAP message type
+const (
+	ContextChannel = "channel"
+	ContextBapID   = "bapID"
+	ContextPaymail = "paymail"
+)
+
+// Room is a channel or a direct message conversation
+type Room struct {
+	Id            string   `bson:"_id" json:"id"`
+	Participants  []string `bson:"participants" json:"participants"` // latest senders of a channel, most recent last, or the pair of a conversation
+	Messages      int64    `bson:"messages" json:"messages"`
+	LastMessageAt float64  `bson:"last_message_at" json:"last_message_at"`
+	LastTxid      string   `bson:"last_txid" json:"last_txid"`
+	Collections   []string `bson:"collections" json:"-"` // collections the messages are written to
+}
+
+// message is what a doc says about the room it was sent to
+type message struct {
+	channel      string // channel name, or "" for a direct message
+	conversation string // conversation key of a direct message
+	sender       string
+}
+
+// parse returns the room a message doc was sent to, ok false if it is not
+// a message. The sender is the BAP identity of the signer, or the signing
+// address when it has none.
+func parse(doc store.Doc) (m message, ok bool) {
+	m.sender, _ = doc["bap_id"].(string)
+	if m.sender == "" {
+		m.sender, _ = doc["signer"].(string)
+	}
+	for _, entry := range store.Entries(doc["MAP"]) {
+		if mapType, _ := entry["type"].(string); mapType != "message" {
+			continue
+		}
+		context, _ := entry["context"].(string)
+		switch context {
+		case ContextChannel:
+			if m.channel, _ = entry["channel"].(string); m.channel != "" {
+				return m, true
+			}
+		case ContextBapID, ContextPaymail:
+			// a direct message is only keyed when its sender is known
+			recipient, _ := entry[context].(string)
+			if recipient != "" && m.sender != "" {
+				m.conversation = ConversationKey(m.sender, recipient)
+				return m, true
+			}
+		}
+	}
+	return m, false
+}
+
+// key returns the registry collection and id of the room
+func (m message) key() [2]string {
+	if m.channel != "" {
+		return [2]string{ChannelsCollection, m.channel}
+	}
+	return [2]string{ConversationsCollection, m.conversation}
+}
+
+// ConversationKey returns the key of the conversation between two
+// participants, the same whichever of them sent the message
+func ConversationKey(a string, b string) string {
+	pair := []string{a, b}
+	sort.Strings(pair)
+	return strings.Join(pair, ":")
+}
+
+// Enrich sets the conversation key on a direct message, so the messages of
+// a conversation can be queried by it
+func Enrich(doc store.Doc) {
+	if m, ok := parse(doc); ok && m.conversation != "" {
+		doc["conversation"] = m.conversation
+	}
+}
+
+// MessageFilter selects the messages of a room
+func MessageFilter(collection string, id string) store.Filter {
+	if collection == ChannelsCollection {
+		return store.Filter{"MAP.context": ContextChannel, "MAP.channel": id}
+	}
+	return store.Filter{"conversation": id}
+}
+
+// Get returns the channel or conversation with the given id
+func Get(ctx context.Context, s store.Store, collection string, id string) (*Room, error) {
+	doc, err := s.GetTx(ctx, collection, id)
+	if err != nil {
+		return nil, err
+	}
+	r := &Room{}
+	return r, store.FromDoc(doc, r)
+}
+
+// Batch collects the messages written with a block file, to update their
+// rooms once they are stored
+type Batch struct {
+	s     store.Store
+	rooms map[[2]string]*update
+	order [][2]string
+}
+
+type update struct {
+	collections []string
+	senders     []string
+	lastAt      float64
+	lastTxid    string
+}
+
+// NewBatch returns an empty batch that updates the rooms in s
+func NewBatch(s store.Store) *Batch {
+	return &Batch{s: s, rooms: map[[2]string]*update{}}
+}
+
+// Add notes a write to collection, if it is a message
+func (b *Batch) Add(collection string, w store.Write) {
+	m, ok := parse(w.Doc)
+	if !ok {
+		return
+	}
+	key := m.key()
+	u := b.rooms[key]
+	if u == nil {
+		u = &update{}
+		b.rooms[key] = u
+		b.order = append(b.order, key)
+	}
+	if !slices.Contains(u.collections, collection) {
+		u.collections = append(u.collections, collection)
+	}
+	if m.sender != "" {
+		u.senders = recent(u.senders, m.sender)
+	}
+	// a mempool message has its time as a default
+	at, ok := store.ToFloat(w.Doc["timestamp"])
+	if !ok {
+		at, _ = store.ToFloat(w.Defaults["timestamp"])
+	}
+	if at >= u.lastAt {
+		u.lastAt = at
+		u.lastTxid, _ = w.Doc["_id"].(string)
+	}
+}
+
+// Index updates the rooms of the batch's messages
+func (b *Batch) Index(ctx context.Context) error {
+	for _, key := range b.order {
+		collection, id := key[0], key[1]
+		u := b.rooms[key]
+
+		r, err := Get(ctx, b.s, collection, id)
+		if err == store.ErrNotFound {
+			r = &Room{Id: id}
+		} else if err != nil {
+			return err
+		}
+		if collection == ConversationsCollection {
+			r.Participants = strings.SplitN(id, ":", 2)
+		} else {
+			r.Participants = recent(r.Participants, u.senders...)
+		}
+		r.Collections = unique(append(r.Collections, u.collections...))
+		if u.lastAt >= r.LastMessageAt {
+			r.LastMessageAt, r.LastTxid = u.lastAt, u.lastTxid
+		}
+
+		if err = count(ctx, b.s, collection, r); err != nil {
+			return err
+		}
+		if err = save(ctx, b.s, collection, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback updates the rooms of the messages of the blocks from height up,
+// once a reorg has orphaned them, so they count only the messages left. A
+// room with none left is removed. The messages are looked up in collections.
+func Rollback(ctx context.Context, s store.Store, collections []string, height uint32) error {
+	seen := map[[2]string]bool{}
+	var keys [][2]string
+	q := store.Query{Filter: store.Filter{"blk.i": store.Filter{"$gte": height}, "MAP.type": "message"}}
+	for _, collection := range collections {
+		err := store.Each(ctx, s, collection, q, func(doc store.Doc) error {
+			if m, ok := parse(doc); ok && !seen[m.key()] {
+				seen[m.key()] = true
+				keys = append(keys, m.key())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		collection, id := key[0], key[1]
+		r, err := Get(ctx, s, collection, id)
+		if err == store.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err = count(ctx, s, collection, r); err != nil {
+			return err
+		}
+		if r.Messages == 0 {
+			if err = s.DeleteTx(ctx, collection, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		r.LastMessageAt, r.LastTxid = 0, ""
+		for _, c := range r.Collections {
+			last, err := s.Query(ctx, c, store.Query{Filter: live(collection, id), SortBy: "timestamp", SortDesc: true, Limit: 1})
+			if err != nil {
+				return err
+			}
+			if len(last) == 0 {
+				continue
+			}
+			if at, _ := store.ToFloat(last[0]["timestamp"]); at >= r.LastMessageAt {
+				r.LastMessageAt = at
+				r.LastTxid, _ = last[0]["_id"].(string)
+			}
+		}
+		if err = save(ctx, s, collection, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// count sets the message count of a room from its stored messages, so a
+// message written twice is counted once
+func count(ctx context.Context, s store.Store, collection string, r *Room) error {
+	r.Messages = 0
+	for _, c := range r.Collections {
+		n, err := s.Count(ctx, c, live(collection, r.Id))
+		if err != nil {
+			return err
+		}
+		r.Messages += n
+	}
+	return nil
+}
+
+// live selects the messages of a room a reorg has not orphaned
+func live(collection string, id string) store.Filter {
+	filter := MessageFilter(collection, id)
+	filter["status"] = store.Filter{"$ne": "orphaned"} // crawler.StatusOrphaned
+	return filter
+}
+
+func save(ctx context.Context, s store.Store, collection string, r *Room) error {
+	doc, err := store.ToDoc(r)
+	if err != nil {
+		return err
+	}
+	return s.UpsertTx(ctx, collection, doc)
+}
+
+// recent moves the senders to the end of list, dropping the oldest beyond
+// maxParticipants
+func recent(list []string, senders ...string) []string {
+	for _, sender := range senders {
+		list = append(slices.DeleteFunc(list, func(p string) bool { return p == sender }), sender)
+	}
+	return list[max(0, len(list)-maxParticipants):]
+}
+
+func unique(list []string) []string {
+	slices.Sort(list)
+	return slices.Compact(list)
+}
+
+// EnsureIndexes creates the indexes the chat queries need: messages by
+// channel or conversation, newest first, and rooms by their last message
+func EnsureIndexes(ctx context.Context, s store.Store, cfg *config.Config) error {
+	for _, collection := range cfg.Collections() {
+		if err := store.EnsureIndex(ctx, s, collection, "MAP.channel", "-timestamp"); err != nil {
+			return err
+		}
+		if err := store.EnsureIndex(ctx, s, collection, "conversation", "-timestamp"); err != nil {
+			return err
+		}
+	}
+	for _, collection := range []string{ChannelsCollection, ConversationsCollection} {
+		if err := store.EnsureIndex(ctx, s, collection, "-last_message_at"); err != nil {
+			return err
+		}
+	}
+	return store.EnsureIndex(ctx, s, ConversationsCollection, "participants", "-last_message_at")
+}
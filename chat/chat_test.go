@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// channelMessage is a signed message to a channel, mined at height unless
+// it is 0
+func channelMessage(txid string, sender string, channel string, height int, timestamp int64) store.Write {
+	return messageWrite(txid, sender, height, timestamp, map[string]interface{}{
+		"type": "message", "context": ContextChannel, "channel": channel,
+	})
+}
+
+// directMessage is a signed message from sender to a BAP identity
+func directMessage(txid string, sender string, recipient string, height int, timestamp int64) store.Write {
+	return messageWrite(txid, sender, height, timestamp, map[string]interface{}{
+		"type": "message", "context": ContextBapID, ContextBapID: recipient,
+	})
+}
+
+func messageWrite(txid string, sender string, height int, timestamp int64, entry map[string]interface{}) store.Write {
+	doc := store.Doc{"_id": txid, "bap_id": sender, "timestamp": timestamp, "MAP": []interface{}{entry}}
+	if height > 0 {
+		doc["blk"] = map[string]interface{}{"i": height}
+	}
+	Enrich(doc)
+	return store.Write{Doc: doc}
+}
+
+// ingest writes the messages to the message collection and updates their
+// rooms as one block file
+func ingest(t *testing.T, s store.Store, writes ...store.Write) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.UpsertTxs(ctx, "message", writes); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBatch(s)
+	for _, w := range writes {
+		b.Add("message", w)
+	}
+	if err := b.Index(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func room(t *testing.T, s store.Store, collection string, id string) *Room {
+	t.Helper()
+	r, err := Get(context.Background(), s, collection, id)
+	if err != nil {
+		t.Fatalf("room %s: %v", id, err)
+	}
+	return r
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  store.Doc
+		want message
+		ok   bool
+	}{
+		{"channel", channelMessage("a", "alice", "general", 0, 0).Doc, message{channel: "general", sender: "alice"}, true},
+		{"bapID", directMessage("a", "bob", "alice", 0, 0).Doc, message{conversation: "alice:bob", sender: "bob"}, true},
+		{"paymail by address", store.Doc{"signer": "1Address", "MAP": []interface{}{
+			map[string]interface{}{"type": "message", "context": ContextPaymail, ContextPaymail: "a@b.c"},
+		}}, message{conversation: "1Address:a@b.c", sender: "1Address"}, true},
+		{"unsigned direct message", store.Doc{"MAP": []interface{}{
+			map[string]interface{}{"type": "message", "context": ContextBapID, ContextBapID: "alice"},
+		}}, message{}, false},
+		{"channel without a name", store.Doc{"MAP": []interface{}{
+			map[string]interface{}{"type": "message", "context": ContextChannel},
+		}}, message{}, false},
+		{"post", store.Doc{"MAP": []interface{}{map[string]interface{}{"type": "post"}}}, message{}, false},
+	}
+	for _, tt := range tests {
+		m, ok := parse(tt.doc)
+		if ok != tt.ok || (ok && m != tt.want) {
+			t.Errorf("%s: parse = %+v, %v, want %+v, %v", tt.name, m, ok, tt.want, tt.ok)
+		}
+	}
+	if ConversationKey("b", "a") != ConversationKey("a", "b") {
+		t.Error("conversation key depends on who sent the message")
+	}
+}
+
+func TestRecent(t *testing.T) {
+	list := recent([]string{"a", "b", "c"}, "a", "d")
+	if fmt.Sprint(list) != "[b c a d]" {
+		t.Errorf("recent = %v, want [b c a d]", list)
+	}
+	for i := 0; i < maxParticipants+10; i++ {
+		list = recent(list, fmt.Sprintf("s%d", i))
+	}
+	if len(list) != maxParticipants || list[len(list)-1] != fmt.Sprintf("s%d", maxParticipants+9) {
+		t.Errorf("%d participants, last %s", len(list), list[len(list)-1])
+	}
+}
+
+func TestIndex(t *testing.T) {
+	s, _ := storetest.Open(t)
+
+	ingest(t, s,
+		channelMessage("m1", "alice", "general", 1, 1),
+		channelMessage("m2", "bob", "general", 1, 3),
+		channelMessage("m3", "alice", "general", 1, 2),
+		directMessage("d1", "alice", "bob", 1, 5),
+	)
+	r := room(t, s, ChannelsCollection, "general")
+	if r.Messages != 3 || r.LastTxid != "m2" || r.LastMessageAt != 3 {
+		t.Errorf("channel = %+v", r)
+	}
+	if fmt.Sprint(r.Participants) != "[bob alice]" {
+		t.Errorf("participants = %v, want [bob alice]", r.Participants)
+	}
+
+	// a message written again is counted once
+	ingest(t, s, channelMessage("m2", "bob", "general", 1, 3))
+	if r = room(t, s, ChannelsCollection, "general"); r.Messages != 3 {
+		t.Errorf("%d messages after a rewrite, want 3", r.Messages)
+	}
+
+	// both sides of a conversation share it
+	ingest(t, s, directMessage("d2", "bob", "alice", 2, 6))
+	r = room(t, s, ConversationsCollection, ConversationKey("alice", "bob"))
+	if r.Messages != 2 || r.LastTxid != "d2" || fmt.Sprint(r.Participants) != "[alice bob]" {
+		t.Errorf("conversation = %+v", r)
+	}
+
+	// a mempool message has its time as a default
+	w := channelMessage("m4", "carol", "general", 0, 0)
+	delete(w.Doc, "timestamp")
+	w.Defaults = store.Doc{"timestamp": int64(10)}
+	ingest(t, s, w)
+	if r = room(t, s, ChannelsCollection, "general"); r.LastTxid != "m4" || r.LastMessageAt != 10 {
+		t.Errorf("channel after a mempool message = %+v", r)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+
+	ingest(t, s, channelMessage("m1", "alice", "general", 1, 1))
+	ingest(t, s,
+		channelMessage("m2", "bob", "general", 2, 2),
+		channelMessage("o1", "bob", "offtopic", 2, 3),
+	)
+	// the crawler orphans the docs of the blocks rolled back first
+	orphaned := store.Filter{"blk.i": store.Filter{"$gte": 2}}
+	if _, err := s.UpdateMany(ctx, "message", orphaned, store.Doc{"status": "orphaned"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rollback(ctx, s, cfg.Collections(), 2); err != nil {
+		t.Fatal(err)
+	}
+	r := room(t, s, ChannelsCollection, "general")
+	if r.Messages != 1 || r.LastTxid != "m1" || r.LastMessageAt != 1 {
+		t.Errorf("channel after rollback = %+v", r)
+	}
+	if _, err := Get(ctx, s, ChannelsCollection, "offtopic"); err != store.ErrNotFound {
+		t.Errorf("empty channel after rollback = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/api"
+	"github.com/rohenaz/go-bmap-indexer/chat"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/crawler"
+	"github.com/rohenaz/go-bmap-indexer/headers"
+	"github.com/rohenaz/go-bmap-indexer/identity"
+	"github.com/rohenaz/go-bmap-indexer/p2p"
+	"github.com/rohenaz/go-bmap-indexer/reaction"
+	"github.com/rohenaz/go-bmap-indexer/spv"
+	"github.com/rohenaz/go-bmap-indexer/state"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/thread"
+)
+
+func runSync(fs *flag.FlagSet, args []string) error {
+	cfg, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if d.Headers, err = headers.Open(ctx, cfg, d.Store); err != nil {
+		return err
+	}
+	go headers.Sync(ctx, cfg, d.Headers)
+
+	if err = ensureIndexes(ctx, d.Store, cfg); err != nil {
+		return err
+	}
+
+	if err = openVerifier(ctx, d, cfg); err != nil {
+		return err
+	}
+
+	currentBlock := state.LoadProgress(d.Store, cfg)
+
+	go crawler.SweepMempool(ctx, d.Store, cfg)
+	if cfg.EnableAPI {
+		go func() {
+			if err := api.Start(ctx, cfg, d.Store, d.Blobs, d.Search); err != nil {
+				log.Printf("[ERROR]: api: %v", err)
+			}
+		}()
+	}
+	// returns once the blocks already completed are ingested
+	crawler.SyncBlocks(ctx, d, cfg, int(currentBlock))
+	return nil
+}
+
+func runIngest(fs *flag.FlagSet, args []string) error {
+	cfg, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("ingest takes exactly one file or directory")
+	}
+	if err = openVerifier(ctx, d, cfg); err != nil {
+		return err
+	}
+
+	files, err := crawler.IngestPath(ctx, d, cfg, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Ingested %d block files from %s\n", files, fs.Arg(0))
+	return nil
+}
+
+func runReindex(fs *flag.FlagSet, args []string) error {
+	from := fs.Uint("from", 0, "first block height to reindex")
+	to := fs.Uint("to", 0, "last block height to reindex (defaults to -from)")
+	cfg, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if *to == 0 {
+		*to = *from
+	}
+	if err = openVerifier(ctx, d, cfg); err != nil {
+		return err
+	}
+
+	blocks, err := crawler.Reindex(ctx, d, cfg, uint32(*from), uint32(*to))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Reindexed %d blocks between %d and %d\n", blocks, *from, *to)
+	return nil
+}
+
+func runStatus(fs *flag.FlagSet, args []string) error {
+	cfg, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx := context.Background()
+	height := state.LoadProgress(d.Store, cfg)
+	fmt.Printf("Block height: %d\n", height)
+	tip, ok, err := headers.SavedTip(ctx, d.Store)
+	if err != nil {
+		return fmt.Errorf("reading chain tip: %w", err)
+	}
+	if ok {
+		fmt.Printf("Chain tip: %d (%d blocks behind)\n", tip, max(tip, height)-height)
+	}
+	for _, collection := range cfg.Collections() {
+		count, err := d.Store.Count(ctx, collection, nil)
+		if err != nil {
+			return fmt.Errorf("counting %s: %w", collection, err)
+		}
+		fmt.Printf("%-12s %d\n", collection, count)
+	}
+
+	failed, err := d.Store.Count(ctx, crawler.FailedBlocksCollection, nil)
+	if err != nil {
+		return fmt.Errorf("counting failed blocks: %w", err)
+	}
+	fmt.Printf("Failed blocks: %d\n", failed)
+
+	quarantined, err := d.Store.Count(ctx, crawler.QuarantineCollection, nil)
+	if err != nil {
+		return fmt.Errorf("counting quarantined txs: %w", err)
+	}
+	fmt.Printf("Quarantined txs: %d\n", quarantined)
+	return nil
+}
+
+func runServe(fs *flag.FlagSet, args []string) error {
+	cfg, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err = ensureIndexes(ctx, d.Store, cfg); err != nil {
+		return err
+	}
+	return api.Start(ctx, cfg, d.Store, d.Blobs, d.Search)
+}
+
+// openVerifier opens the SPV verifier for the commands that write mined txs,
+// unless txs are trusted. Its headers are kept in sync until ctx is
+// cancelled if nothing else syncs them.
+func openVerifier(ctx context.Context, d *crawler.Deps, cfg *config.Config) error {
+	if cfg.SkipSPV {
+		return nil
+	}
+	if d.Headers == nil {
+		chain, err := headers.Open(ctx, cfg, d.Store)
+		if err != nil {
+			return err
+		}
+		d.Headers = chain
+		go headers.Sync(ctx, cfg, chain)
+	}
+	var err error
+	d.Verifier, err = spv.Open(cfg, d.Headers)
+	return err
+}
+
+// ensureIndexes creates the indexes the crawler and the API query by, for
+// stores that support them
+func ensureIndexes(ctx context.Context, s store.Store, cfg *config.Config) error {
+	if err := chat.EnsureIndexes(ctx, s, cfg); err != nil {
+		return fmt.Errorf("creating chat indexes: %w", err)
+	}
+	if err := reaction.EnsureIndexes(ctx, s); err != nil {
+		return fmt.Errorf("creating reaction indexes: %w", err)
+	}
+	if err := identity.EnsureIndexes(ctx, s); err != nil {
+		return fmt.Errorf("creating identity indexes: %w", err)
+	}
+	if err := thread.EnsureIndexes(ctx, s); err != nil {
+		return fmt.Errorf("creating thread indexes: %w", err)
+	}
+	if err := state.EnsureIndexes(ctx, s); err != nil {
+		return fmt.Errorf("creating graph indexes: %w", err)
+	}
+	return nil
+}
+
+func runP2P(fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 || args[0] != "serve" {
+		fs.Usage()
+		return errors.New("unknown p2p command")
+	}
+	cfg, d, err := setup(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	// convert jsonld files to individual cbor files suitable for p2p transmission
+	p2p.CreateContentCache(cfg)
+	p2p.Start(ctx, cfg)
+	return nil
+}
+
+func runExport(fs *flag.FlagSet, args []string) error {
+	collection := fs.String("collection", "", "collection to export")
+	out := fs.String("out", "", "file to write to (defaults to stdout)")
+	from := fs.Uint("from", 0, "only export documents from this block height")
+	to := fs.Uint("to", 0, "only export documents up to this block height")
+	status := fs.String("status", "", "only export documents with this status: "+strings.Join(crawler.Statuses, ", "))
+	_, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	if *collection == "" {
+		fs.Usage()
+		return errors.New("export requires -collection")
+	}
+	if *status != "" && !slices.Contains(crawler.Statuses, *status) {
+		return fmt.Errorf("unknown status %q", *status)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	filter := store.Filter{}
+	blk := store.Filter{}
+	if *from > 0 {
+		blk["$gte"] = *from
+	}
+	if *to > 0 {
+		blk["$lte"] = *to
+	}
+	if len(blk) > 0 {
+		filter["blk.i"] = blk
+	}
+	if *status != "" {
+		filter["status"] = *status
+	}
+
+	enc := json.NewEncoder(w)
+	var count int
+	q := store.Query{Filter: filter, SortBy: "blk.i"}
+	err = store.Each(context.Background(), d.Store, *collection, q, func(doc store.Doc) error {
+		count++
+		return enc.Encode(doc)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d documents from %s\n", count, *collection)
+	return nil
+}
+
+func runFailed(fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "retry") {
+		fs.Usage()
+		return errors.New("unknown failed command")
+	}
+	sub := args[0]
+	height := fs.Uint("height", 0, "only retry the block at this height")
+	cfg, d, err := setup(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	if sub == "list" {
+		blocks, err := crawler.FailedBlocks(d.Store)
+		if err != nil {
+			return err
+		}
+		for _, block := range blocks {
+			fmt.Printf("%d\tretries=%d\tfailed_txs=%d\tfailed_at=%s\t%s\n",
+				block.Height, block.Retries, len(block.FailedTxs), block.FailedAt.Format(time.RFC3339), block.Error)
+		}
+		return nil
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if err = openVerifier(ctx, d, cfg); err != nil {
+		return err
+	}
+	recovered, failed, err := crawler.RetryFailedBlocks(ctx, d, cfg, uint32(*height))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Recovered %d blocks, %d still failing\n", recovered, failed)
+	return nil
+}
+
+func runReorgs(fs *flag.FlagSet, args []string) error {
+	limit := fs.Int64("limit", 20, "number of reorgs to list, most recent first")
+	_, d, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	reorgs, err := crawler.Reorgs(d.Store, *limit)
+	if err != nil {
+		return err
+	}
+	for _, reorg := range reorgs {
+		fmt.Printf("%d\tdetected_at=%s\tblocks=%d\tdocs=%d\t%s\n",
+			reorg.Height, reorg.DetectedAt.Format(time.RFC3339), len(reorg.OrphanedBlocks), reorg.OrphanedDocs, reorg.Reason)
+		for _, block := range reorg.OrphanedBlocks {
+			fmt.Printf("\torphaned %d %s\n", block.Height, block.Hash)
+		}
+	}
+	return nil
+}
+
+func runState(fs *flag.FlagSet, args []string) error {
+	if len(args) == 0 || (args[0] != "sync" && args[0] != "rebuild") {
+		fs.Usage()
+		return errors.New("unknown state command")
+	}
+	sub := args[0]
+	cfg, d, err := setup(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	defer teardown(d)
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if sub == "rebuild" {
+		if err = state.ClearState(ctx, d.Store); err != nil {
+			return err
+		}
+	}
+	height, err := state.SyncState(ctx, d.Store, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Social graph built to block %d\n", height)
+	return nil
+}
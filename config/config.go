@@ -1,16 +1,401 @@
 package config
 
-var BitcoinSchemaTypes = []string{"friend", "like", "repost", "post", "message"}
-
-// There are config constants
-const (
-	SkipSPV           = true
-	SubscriptionID    = "5af4235fe3e2a36965a46805a10dd48e0d659467c7f5df0a8c48ba5d32e406dd"
-	MinerAPIEndpoint  = "https://mapi.gorillapool.iom/mapi/tx/"
-	JunglebusEndpoint = "https://junglebus.gorillapool.io/"
-	FromBlock         = 817000                            // "Welcome to the Future" post = 574287
-	BockSyncRetries   = 5                                 // number of retries before block is marked failed
-	DeleteAfterIngest = false                             // delete json data files after ingesting to db. If using p2p this will effective disable seeding (jerk)
-	EnableP2P         = true                              // enable p2p layer
-	OutputTypes       = "friend,like,repost,post,message" // you can adjust these to change the output types you want to index
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
+
+var BitcoinSchemaTypes = []string{"friend", "like", "unlike", "repost", "post", "message"}
+
+// Config holds the runtime configuration of the indexer. It is built once at
+// startup by Load and handed to the packages that need it.
+type Config struct {
+	Store             string   `yaml:"store"`       // "mongo" or the embedded "bolt" store
+	StorePath         string   `yaml:"store_path"`  // file used by the bolt store
+	SearchPath        string   `yaml:"search_path"` // full-text index used with the bolt store, empty to disable search with it
+	MongoURL          string   `yaml:"mongo_url"`
+	RedisURL          string   `yaml:"redis_url"`
+	SkipSPV           bool     `yaml:"skip_spv"`           // true to trust every tx, false to verify the merkle proof of every mined tx
+	SubscriptionID    string   `yaml:"subscription_id"`    // junglebus subscription
+	MinerAPIEndpoint  string   `yaml:"miner_api_endpoint"` // mapi endpoint used for verification
+	JunglebusEndpoint string   `yaml:"junglebus_endpoint"`
+	FromBlock         uint32   `yaml:"from_block"`          // "Welcome to the Future" post = 574287
+	BlockSyncRetries  int      `yaml:"block_sync_retries"`  // number of retries before block is marked failed
+	DeleteAfterIngest bool     `yaml:"delete_after_ingest"` // delete json data files after ingesting to db. If using p2p this will effective disable seeding (jerk)
+	EnableP2P         bool     `yaml:"enable_p2p"`          // enable p2p layer
+	OutputTypes       []string `yaml:"output_types"`        // you can adjust these to change the output types you want to index
+	RequireSignature  []string `yaml:"require_signature"`   // collections that only index txs with valid AIP or SIGMA signatures
+	P2PPrivateKey     string   `yaml:"p2p_private_key"`     // WIF used as the libp2p identity
+	BootstrapPeerID   string   `yaml:"bootstrap_peer_id"`
+
+	SPVUnverified    string `yaml:"spv_unverified"`     // "quarantine" or "reject" mined txs that fail verification
+	HeadersFile      string `yaml:"headers_file"`       // file of 80 byte block headers to seed the header chain with
+	HeadersFileStart uint32 `yaml:"headers_file_start"` // height of the first header in headers_file
+
+	ReconnectMaxBackoff time.Duration `yaml:"reconnect_max_backoff"` // longest wait between junglebus reconnect attempts
+	StallTimeout        time.Duration `yaml:"stall_timeout"`         // resubscribe if junglebus sends nothing for this long, 0 to disable
+	MempoolTTL          time.Duration `yaml:"mempool_ttl"`           // evict mempool txs not mined within this long, 0 to keep them
+
+	EnableAPI     bool          `yaml:"enable_api"`      // serve the query API while syncing
+	APIAddr       string        `yaml:"api_addr"`        // address the query API listens on
+	QueryMaxLimit int64         `yaml:"query_max_limit"` // most documents an API query returns
+	QueryTimeout  time.Duration `yaml:"query_timeout"`   // longest an API query may run
+
+	Routes    []Route     `yaml:"routes"`    // MAP entry to collection routing, only set in the config file
+	Retention []Retention `yaml:"retention"` // what is kept of B and Ord contents, only set in the config file
+
+	BlobStore   string `yaml:"blob_store"` // "fs" or "s3" to keep offloaded contents, empty to disable
+	BlobPath    string `yaml:"blob_path"`  // directory of the fs blob store
+	S3Endpoint  string `yaml:"s3_endpoint"`
+	S3Region    string `yaml:"s3_region"`
+	S3Bucket    string `yaml:"s3_bucket"`
+	S3AccessKey string `yaml:"s3_access_key"`
+	S3SecretKey string `yaml:"s3_secret_key"`
+}
+
+// Default returns the configuration used when nothing else is specified
+func Default() *Config {
+	return &Config{
+		Store:             "mongo",
+		StorePath:         "bmap.db",
+		SearchPath:        "search.bleve",
+		SkipSPV:           true,
+		SubscriptionID:    "5af4235fe3e2a36965a46805a10dd48e0d659467c7f5df0a8c48ba5d32e406dd",
+		MinerAPIEndpoint:  "https://mapi.gorillapool.iom/mapi/tx/",
+		JunglebusEndpoint: "https://junglebus.gorillapool.io/",
+		FromBlock:         817000,
+		BlockSyncRetries:  5,
+		DeleteAfterIngest: false,
+		EnableP2P:         true,
+		OutputTypes:       append([]string(nil), BitcoinSchemaTypes...),
+		SPVUnverified:     "quarantine",
+
+		ReconnectMaxBackoff: 5 * time.Minute,
+		StallTimeout:        time.Hour,
+		MempoolTTL:          72 * time.Hour,
+
+		EnableAPI:     false,
+		APIAddr:       ":3000",
+		QueryMaxLimit: 100,
+		QueryTimeout:  10 * time.Second,
+
+		BlobPath: "blobs",
+		S3Region: "us-east-1",
+	}
+}
+
+// setting describes a config value that can be overridden from the
+// environment or the command line
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{"store", "BMAP_STORE", "storage backend, mongo or bolt", false, func(c *Config, v string) error {
+		c.Store = v
+		return nil
+	}},
+	{"store-path", "BMAP_STORE_PATH", "file used by the bolt store", false, func(c *Config, v string) error {
+		c.StorePath = v
+		return nil
+	}},
+	{"search-path", "BMAP_SEARCH_PATH", "full-text index used with the bolt store, empty to disable search with it", false, func(c *Config, v string) error {
+		c.SearchPath = v
+		return nil
+	}},
+	{"mongo-url", "MONGO_URL", "mongo connection string", false, func(c *Config, v string) error {
+		c.MongoURL = v
+		return nil
+	}},
+	{"redis-url", "REDIS_URL", "redis connection string", false, func(c *Config, v string) error {
+		c.RedisURL = v
+		return nil
+	}},
+	{"skip-spv", "BMAP_SKIP_SPV", "trust every tx without verifying it", true, func(c *Config, v string) (err error) {
+		c.SkipSPV, err = strconv.ParseBool(v)
+		return
+	}},
+	{"subscription-id", "BMAP_SUBSCRIPTION_ID", "junglebus subscription id", false, func(c *Config, v string) error {
+		c.SubscriptionID = v
+		return nil
+	}},
+	{"miner-api-endpoint", "BMAP_MINER_API_ENDPOINT", "miner api endpoint", false, func(c *Config, v string) error {
+		c.MinerAPIEndpoint = v
+		return nil
+	}},
+	{"junglebus-endpoint", "BMAP_JUNGLEBUS_ENDPOINT", "junglebus endpoint", false, func(c *Config, v string) error {
+		c.JunglebusEndpoint = v
+		return nil
+	}},
+	{"from-block", "BMAP_FROM_BLOCK", "block height to start crawling from", false, func(c *Config, v string) error {
+		height, err := strconv.ParseUint(v, 10, 32)
+		c.FromBlock = uint32(height)
+		return err
+	}},
+	{"block-sync-retries", "BMAP_BLOCK_SYNC_RETRIES", "number of retries before a block is marked failed", false, func(c *Config, v string) (err error) {
+		c.BlockSyncRetries, err = strconv.Atoi(v)
+		return
+	}},
+	{"delete-after-ingest", "BMAP_DELETE_AFTER_INGEST", "delete json data files after ingesting", true, func(c *Config, v string) (err error) {
+		c.DeleteAfterIngest, err = strconv.ParseBool(v)
+		return
+	}},
+	{"enable-p2p", "BMAP_ENABLE_P2P", "enable the p2p layer", true, func(c *Config, v string) (err error) {
+		c.EnableP2P, err = strconv.ParseBool(v)
+		return
+	}},
+	{"output-types", "BMAP_OUTPUT_TYPES", "comma separated MAP types to index", false, func(c *Config, v string) error {
+		c.OutputTypes = splitList(v)
+		return nil
+	}},
+	{"require-signature", "BMAP_REQUIRE_SIGNATURE", "comma separated collections that only index validly signed txs", false, func(c *Config, v string) error {
+		c.RequireSignature = splitList(v)
+		return nil
+	}},
+	{"p2p-private-key", "BMAP_P2P_PK", "WIF private key used as the p2p identity", false, func(c *Config, v string) error {
+		c.P2PPrivateKey = v
+		return nil
+	}},
+	{"bootstrap-peer-id", "BOOTSTRAP_PEER_ID", "p2p bootstrap peer id", false, func(c *Config, v string) error {
+		c.BootstrapPeerID = v
+		return nil
+	}},
+	{"spv-unverified", "BMAP_SPV_UNVERIFIED", "quarantine or reject mined txs that fail verification", false, func(c *Config, v string) error {
+		c.SPVUnverified = v
+		return nil
+	}},
+	{"headers-file", "BMAP_HEADERS_FILE", "file of 80 byte block headers to verify against", false, func(c *Config, v string) error {
+		c.HeadersFile = v
+		return nil
+	}},
+	{"headers-file-start", "BMAP_HEADERS_FILE_START", "height of the first header in the headers file", false, func(c *Config, v string) error {
+		height, err := strconv.ParseUint(v, 10, 32)
+		c.HeadersFileStart = uint32(height)
+		return err
+	}},
+	{"reconnect-max-backoff", "BMAP_RECONNECT_MAX_BACKOFF", "longest wait between junglebus reconnect attempts", false, func(c *Config, v string) (err error) {
+		c.ReconnectMaxBackoff, err = time.ParseDuration(v)
+		return
+	}},
+	{"stall-timeout", "BMAP_STALL_TIMEOUT", "resubscribe if junglebus sends nothing for this long, 0 to disable", false, func(c *Config, v string) (err error) {
+		c.StallTimeout, err = time.ParseDuration(v)
+		return
+	}},
+	{"mempool-ttl", "BMAP_MEMPOOL_TTL", "evict mempool txs not mined within this long, 0 to keep them", false, func(c *Config, v string) (err error) {
+		c.MempoolTTL, err = time.ParseDuration(v)
+		return
+	}},
+	{"enable-api", "BMAP_ENABLE_API", "serve the query API while syncing", true, func(c *Config, v string) (err error) {
+		c.EnableAPI, err = strconv.ParseBool(v)
+		return
+	}},
+	{"api-addr", "BMAP_API_ADDR", "address the query API listens on", false, func(c *Config, v string) error {
+		c.APIAddr = v
+		return nil
+	}},
+	{"query-max-limit", "BMAP_QUERY_MAX_LIMIT", "most documents an API query returns", false, func(c *Config, v string) (err error) {
+		c.QueryMaxLimit, err = strconv.ParseInt(v, 10, 64)
+		return
+	}},
+	{"query-timeout", "BMAP_QUERY_TIMEOUT", "longest an API query may run", false, func(c *Config, v string) (err error) {
+		c.QueryTimeout, err = time.ParseDuration(v)
+		return
+	}},
+	{"blob-store", "BMAP_BLOB_STORE", "blob store for offloaded contents, fs or s3", false, func(c *Config, v string) error {
+		c.BlobStore = v
+		return nil
+	}},
+	{"blob-path", "BMAP_BLOB_PATH", "directory of the fs blob store", false, func(c *Config, v string) error {
+		c.BlobPath = v
+		return nil
+	}},
+	{"s3-endpoint", "BMAP_S3_ENDPOINT", "url of the s3 compatible blob store", false, func(c *Config, v string) error {
+		c.S3Endpoint = v
+		return nil
+	}},
+	{"s3-region", "BMAP_S3_REGION", "region of the s3 blob store", false, func(c *Config, v string) error {
+		c.S3Region = v
+		return nil
+	}},
+	{"s3-bucket", "BMAP_S3_BUCKET", "bucket of the s3 blob store", false, func(c *Config, v string) error {
+		c.S3Bucket = v
+		return nil
+	}},
+	{"s3-access-key", "BMAP_S3_ACCESS_KEY", "access key of the s3 blob store", false, func(c *Config, v string) error {
+		c.S3AccessKey = v
+		return nil
+	}},
+	{"s3-secret-key", "BMAP_S3_SECRET_KEY", "secret key of the s3 blob store", false, func(c *Config, v string) error {
+		c.S3SecretKey = v
+		return nil
+	}},
+}
+
+// settingValue adapts a setting to flag.Value so flags are only applied when
+// they are actually passed on the command line
+type settingValue struct {
+	setting
+	value string
+}
+
+func (s *settingValue) String() string   { return s.value }
+func (s *settingValue) IsBoolFlag() bool { return s.isBool }
+func (s *settingValue) Set(v string) error {
+	s.value = v
+	return nil
+}
+
+// Load builds the configuration from defaults, an optional YAML file, the
+// environment and the command line flags in fs, in increasing order of
+// precedence. The config file is taken from -config or BMAP_CONFIG. An
+// environment variable set to an empty string is ignored like an unset one,
+// so a value is only cleared by the config file or a flag.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	configPath := fs.String("config", os.Getenv("BMAP_CONFIG"), "path to a YAML config file")
+	for _, s := range settings {
+		fs.Var(&settingValue{setting: s}, s.flag, s.usage+" (env "+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err = yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", *configPath, err)
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(c, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := f.Value.(*settingValue); ok && err == nil {
+			if setErr := v.set(c, v.value); setErr != nil {
+				err = fmt.Errorf("invalid -%s: %w", v.flag, setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the configuration is usable
+func (c *Config) Validate() error {
+	var errs []error
+	switch c.Store {
+	case "mongo":
+		if c.MongoURL == "" {
+			errs = append(errs, errors.New("mongo_url is required"))
+		}
+	case "bolt":
+		if c.StorePath == "" {
+			errs = append(errs, errors.New("store_path is required for the bolt store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("store must be mongo or bolt, not %q", c.Store))
+	}
+	if c.SubscriptionID == "" {
+		errs = append(errs, errors.New("subscription_id is required"))
+	}
+	if u, err := url.Parse(c.JunglebusEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("junglebus_endpoint %q is not a valid url", c.JunglebusEndpoint))
+	}
+	if c.SPVUnverified != "quarantine" && c.SPVUnverified != "reject" {
+		errs = append(errs, fmt.Errorf("spv_unverified must be quarantine or reject, not %q", c.SPVUnverified))
+	}
+	if c.BlockSyncRetries < 0 {
+		errs = append(errs, errors.New("block_sync_retries must not be negative"))
+	}
+	if c.ReconnectMaxBackoff < time.Second {
+		errs = append(errs, errors.New("reconnect_max_backoff must be at least 1s"))
+	}
+	if c.StallTimeout < 0 {
+		errs = append(errs, errors.New("stall_timeout must not be negative"))
+	}
+	if c.MempoolTTL < 0 {
+		errs = append(errs, errors.New("mempool_ttl must not be negative"))
+	}
+	if c.APIAddr == "" {
+		errs = append(errs, errors.New("api_addr is required"))
+	}
+	if c.QueryMaxLimit < 1 {
+		errs = append(errs, errors.New("query_max_limit must be at least 1"))
+	}
+	if c.QueryTimeout <= 0 {
+		errs = append(errs, errors.New("query_timeout must be positive"))
+	}
+	errs = append(errs, validateRoutes(c.Routes)...)
+	switch c.BlobStore {
+	case "":
+	case "fs":
+		if c.BlobPath == "" {
+			errs = append(errs, errors.New("blob_path is required for the fs blob store"))
+		}
+	case "s3":
+		if u, err := url.Parse(c.S3Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("s3_endpoint %q is not a valid url", c.S3Endpoint))
+		}
+		if c.S3Bucket == "" || c.S3Region == "" {
+			errs = append(errs, errors.New("s3_bucket and s3_region are required for the s3 blob store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("blob_store must be fs, s3 or empty, not %q", c.BlobStore))
+	}
+	errs = append(errs, validateRetention(c.Retention, c.BlobStore)...)
+	if len(c.OutputTypes) == 0 {
+		errs = append(errs, errors.New("output_types must list at least one type"))
+	}
+	for _, t := range c.OutputTypes {
+		if t == "" {
+			errs = append(errs, errors.New("output_types contains an empty type"))
+			break
+		}
+	}
+	for _, collection := range c.RequireSignature {
+		if collection == "" || strings.HasPrefix(collection, "_") {
+			errs = append(errs, fmt.Errorf("require_signature: invalid collection %q", collection))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+func splitList(v string) (list []string) {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	yamlFile := filepath.Join(t.TempDir(), "config.yaml")
+	yaml := "store: bolt\napi_addr: \":4000\"\nquery_max_limit: 40\nenable_api: true\n"
+	if err := os.WriteFile(yamlFile, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		addr    string
+		limit   int64
+		api     bool
+		timeout time.Duration
+	}{
+		{"defaults", map[string]string{"BMAP_STORE": "bolt"}, nil, ":3000", 100, false, 10 * time.Second},
+		{"config file", nil, []string{"-config", yamlFile}, ":4000", 40, true, 10 * time.Second},
+		{"config file from the environment", map[string]string{"BMAP_CONFIG": yamlFile}, nil, ":4000", 40, true, 10 * time.Second},
+		{"environment over config file", map[string]string{"BMAP_API_ADDR": ":5000", "BMAP_ENABLE_API": "false"}, []string{"-config", yamlFile}, ":5000", 40, false, 10 * time.Second},
+		{"empty environment ignored", map[string]string{"BMAP_API_ADDR": "", "BMAP_QUERY_MAX_LIMIT": ""}, []string{"-config", yamlFile}, ":4000", 40, true, 10 * time.Second},
+		{"flags over environment", map[string]string{"BMAP_API_ADDR": ":5000", "BMAP_QUERY_TIMEOUT": "5s"},
+			[]string{"-config", yamlFile, "-api-addr", ":6000", "-query-timeout=2s"}, ":6000", 40, true, 2 * time.Second},
+		{"bool flag without a value", map[string]string{"BMAP_STORE": "bolt", "BMAP_ENABLE_API": "false"}, []string{"-enable-api"}, ":3000", 100, true, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.APIAddr != tt.addr || c.QueryMaxLimit != tt.limit || c.EnableAPI != tt.api || c.QueryTimeout != tt.timeout {
+				t.Errorf("api_addr %q, query_max_limit %d, enable_api %v, query_timeout %s, want %q, %d, %v, %s",
+					c.APIAddr, c.QueryMaxLimit, c.EnableAPI, c.QueryTimeout, tt.addr, tt.limit, tt.api, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"invalid environment", map[string]string{"BMAP_QUERY_MAX_LIMIT": "many"}, nil, "invalid BMAP_QUERY_MAX_LIMIT"},
+		{"invalid flag", nil, []string{"-stall-timeout", "soon"}, "invalid -stall-timeout"},
+		{"unknown flag", nil, []string{"-nope"}, "flag provided but not defined"},
+		{"missing config file", nil, []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, "reading config file"},
+		{"invalid result", map[string]string{"BMAP_STORE": "sqlite"}, nil, "store must be mongo or bolt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv("BMAP_STORE", "bolt")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(new(strings.Builder))
+			if _, err := Load(fs, tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// clearEnv hides the settings of the environment the tests run in, which
+// Load ignores when empty
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("BMAP_CONFIG", "")
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   string // part of the error, "" for a valid config
+	}{
+		{"defaults with a mongo url", func(c *Config) {}, ""},
+		{"bolt", func(c *Config) { c.Store, c.MongoURL = "bolt", "" }, ""},
+		{"mongo without url", func(c *Config) { c.MongoURL = "" }, "mongo_url is required"},
+		{"bolt without path", func(c *Config) { c.Store, c.StorePath = "bolt", "" }, "store_path is required"},
+		{"unknown store", func(c *Config) { c.Store = "sqlite" }, "store must be mongo or bolt"},
+		{"no subscription", func(c *Config) { c.SubscriptionID = "" }, "subscription_id is required"},
+		{"relative junglebus url", func(c *Config) { c.JunglebusEndpoint = "junglebus" }, "junglebus_endpoint"},
+		{"unknown spv_unverified", func(c *Config) { c.SPVUnverified = "keep" }, "spv_unverified"},
+		{"negative retries", func(c *Config) { c.BlockSyncRetries = -1 }, "block_sync_retries"},
+		{"short backoff", func(c *Config) { c.ReconnectMaxBackoff = time.Millisecond }, "reconnect_max_backoff"},
+		{"negative stall timeout", func(c *Config) { c.StallTimeout = -time.Second }, "stall_timeout"},
+		{"stall timeout disabled", func(c *Config) { c.StallTimeout = 0 }, ""},
+		{"negative mempool ttl", func(c *Config) { c.MempoolTTL = -time.Second }, "mempool_ttl"},
+		{"no api addr", func(c *Config) { c.APIAddr = "" }, "api_addr is required"},
+		{"zero query limit", func(c *Config) { c.QueryMaxLimit = 0 }, "query_max_limit"},
+		{"zero query timeout", func(c *Config) { c.QueryTimeout = 0 }, "query_timeout"},
+		{"fs blob store", func(c *Config) { c.BlobStore = "fs" }, ""},
+		{"fs blob store without path", func(c *Config) { c.BlobStore, c.BlobPath = "fs", "" }, "blob_path is required"},
+		{"s3 blob store", func(c *Config) { c.BlobStore, c.S3Endpoint, c.S3Bucket = "s3", "https://s3.example.com", "b" }, ""},
+		{"s3 blob store without bucket", func(c *Config) { c.BlobStore, c.S3Endpoint = "s3", "https://s3.example.com" }, "s3_bucket and s3_region"},
+		{"unknown blob store", func(c *Config) { c.BlobStore = "ftp" }, "blob_store must be"},
+		{"no output types", func(c *Config) { c.OutputTypes = nil }, "output_types must list"},
+		{"empty output type", func(c *Config) { c.OutputTypes = []string{"post", ""} }, "output_types contains an empty type"},
+		{"reserved signed collection", func(c *Config) { c.RequireSignature = []string{"_state"} }, "require_signature"},
+	}
+	for _, tt := range tests {
+		c := Default()
+		c.MongoURL = "mongodb://localhost:27017"
+		tt.modify(c)
+		err := c.Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: Validate = %v, want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+
+	// every problem is reported at once
+	c := Default()
+	c.SubscriptionID, c.APIAddr = "", ""
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "mongo_url") || !strings.Contains(err.Error(), "subscription_id") || !strings.Contains(err.Error(), "api_addr") {
+		t.Errorf("Validate = %v, want every problem", err)
+	}
+}
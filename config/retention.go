@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Retention actions, from the most to the least content kept
+const (
+	RetainKeep     = "keep"     // store the content as is
+	RetainOffload  = "offload"  // move the content to the blob store, keeping its reference
+	RetainTruncate = "truncate" // keep the first TruncateBytes of the content
+	RetainHash     = "hash"     // keep only the hash and size of the content
+	RetainDrop     = "drop"     // keep only the size of the content
+)
+
+// RetainActions lists the retention actions from the most to the least
+// content kept
+var RetainActions = []string{RetainKeep, RetainOffload, RetainTruncate, RetainHash, RetainDrop}
+
+// Retention decides what is kept of the B and Ord contents of a tx written
+// to Collection. Rules are checked in order and the first match wins.
+type Retention struct {
+	Protocol      string   `yaml:"protocol"`       // "B" or "Ord", empty for both
+	Collection    string   `yaml:"collection"`     // collection to match, empty or "*" for any
+	MediaTypes    []string `yaml:"media_types"`    // media types to match, like image/png or image/*, empty for any
+	Action        string   `yaml:"action"`         // one of RetainActions
+	TruncateBytes int      `yaml:"truncate_bytes"` // bytes kept by the truncate action
+	MaxSize       int      `yaml:"max_size"`       // content larger than this is only hashed, 0 for no limit
+}
+
+func (r Retention) matches(protocol string, collection string, mediaType string) bool {
+	if r.Protocol != "" && r.Protocol != protocol {
+		return false
+	}
+	if r.Collection != "" && r.Collection != "*" && r.Collection != collection {
+		return false
+	}
+	if len(r.MediaTypes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.MediaTypes, func(pattern string) bool {
+		return matchMediaType(pattern, mediaType)
+	})
+}
+
+// matchMediaType matches a media type, ignoring its parameters, against an
+// exact type or a type/* wildcard
+func matchMediaType(pattern string, mediaType string) bool {
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	pattern = strings.ToLower(pattern)
+	if pattern == "*" || pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(pattern, "/*")
+	return ok && strings.HasPrefix(mediaType, prefix+"/")
+}
+
+// Retain returns the retention rule for content of the given protocol and
+// media type in a tx written to collection. Without a matching rule binary
+// content is offloaded when there is a blob store. Otherwise B content is
+// kept in the indexed collections and Ord content is dropped.
+func (c *Config) Retain(protocol string, collection string, mediaType string) Retention {
+	for _, r := range c.Retention {
+		if r.matches(protocol, collection, mediaType) {
+			return r
+		}
+	}
+	if c.BlobStore != "" && !textual(mediaType) {
+		return Retention{Action: RetainOffload}
+	}
+	if protocol == "B" && slices.Contains(c.Collections(), collection) {
+		return Retention{Action: RetainKeep}
+	}
+	return Retention{Action: RetainDrop}
+}
+
+// textual reports whether content of the media type is text, which is kept
+// inline rather than offloaded by default
+func textual(mediaType string) bool {
+	for _, pattern := range []string{"text/*", "application/json", "application/xml", "application/javascript"} {
+		if matchMediaType(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateRetention(rules []Retention, blobStore string) (errs []error) {
+	for i, r := range rules {
+		if r.Protocol != "" && r.Protocol != "B" && r.Protocol != "Ord" {
+			errs = append(errs, fmt.Errorf("retention %d: protocol must be B or Ord, not %q", i, r.Protocol))
+		}
+		if !slices.Contains(RetainActions, r.Action) {
+			errs = append(errs, fmt.Errorf("retention %d: action must be one of %s, not %q", i, strings.Join(RetainActions, ", "), r.Action))
+		}
+		if r.Action == RetainTruncate && r.TruncateBytes < 1 {
+			errs = append(errs, fmt.Errorf("retention %d: truncate needs truncate_bytes of at least 1", i))
+		}
+		if r.Action == RetainOffload && blobStore == "" {
+			errs = append(errs, fmt.Errorf("retention %d: offload needs a blob_store", i))
+		}
+		if r.MaxSize < 0 {
+			errs = append(errs, fmt.Errorf("retention %d: max_size must not be negative", i))
+		}
+	}
+	return errs
+}
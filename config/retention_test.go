@@ -0,0 +1,80 @@
+package config
+
+import "testing"
+
+func TestMatchMediaType(t *testing.T) {
+	tests := []struct {
+		pattern, mediaType string
+		want               bool
+	}{
+		{"image/png", "image/png", true},
+		{"image/png", "IMAGE/PNG", true},
+		{"text/plain", "text/plain; charset=utf-8", true},
+		{"image/*", "image/gif", true},
+		{"image/*", "imagex/gif", false},
+		{"image/*", "text/plain", false},
+		{"*", "anything", true},
+		{"*/*", "", true},
+		{"image/png", "image/jpeg", false},
+	}
+	for _, tt := range tests {
+		if got := matchMediaType(tt.pattern, tt.mediaType); got != tt.want {
+			t.Errorf("matchMediaType(%q, %q) = %v, want %v", tt.pattern, tt.mediaType, got, tt.want)
+		}
+	}
+}
+
+func TestRetain(t *testing.T) {
+	c := Default()
+	c.Retention = []Retention{
+		{Protocol: "Ord", MediaTypes: []string{"image/*"}, Action: RetainHash},
+		{Collection: "post", MediaTypes: []string{"text/markdown"}, Action: RetainTruncate, TruncateBytes: 10},
+		{Protocol: "B", Collection: "message", Action: RetainKeep, MaxSize: 100},
+	}
+	tests := []struct {
+		protocol, collection, mediaType string
+		blobStore                       string
+		want                            string
+	}{
+		{"Ord", "post", "image/png", "", RetainHash},
+		{"B", "post", "image/png", "", RetainKeep},
+		{"B", "post", "text/markdown", "", RetainTruncate},
+		{"B", "message", "image/png", "", RetainKeep},
+		// the defaults
+		{"B", "like", "text/plain", "", RetainKeep},
+		{"B", "unknown", "text/plain", "", RetainDrop},
+		{"Ord", "post", "text/plain", "", RetainDrop},
+		{"B", "post", "image/png", "fs", RetainOffload},
+		{"Ord", "post", "video/mp4", "fs", RetainOffload},
+		{"B", "post", "application/json", "fs", RetainKeep},
+	}
+	for _, tt := range tests {
+		c.BlobStore = tt.blobStore
+		if got := c.Retain(tt.protocol, tt.collection, tt.mediaType); got.Action != tt.want {
+			t.Errorf("Retain(%s, %s, %s) with blob store %q = %s, want %s",
+				tt.protocol, tt.collection, tt.mediaType, tt.blobStore, got.Action, tt.want)
+		}
+	}
+}
+
+func TestValidateRetention(t *testing.T) {
+	tests := []struct {
+		rule      Retention
+		blobStore string
+		ok        bool
+	}{
+		{Retention{Action: RetainKeep}, "", true},
+		{Retention{Protocol: "Ord", Action: RetainOffload}, "fs", true},
+		{Retention{Action: RetainTruncate, TruncateBytes: 1}, "", true},
+		{Retention{Protocol: "BitCom", Action: RetainKeep}, "", false},
+		{Retention{Action: "shred"}, "", false},
+		{Retention{Action: RetainTruncate}, "", false},
+		{Retention{Action: RetainOffload}, "", false},
+		{Retention{Action: RetainKeep, MaxSize: -1}, "", false},
+	}
+	for _, tt := range tests {
+		if errs := validateRetention([]Retention{tt.rule}, tt.blobStore); (len(errs) == 0) != tt.ok {
+			t.Errorf("validateRetention(%+v, %q) = %v, want ok %v", tt.rule, tt.blobStore, errs, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Route sends the MAP entries matching Type and App to Collection. Routes
+// are checked in order and the first match wins. An entry no route matches
+// goes to the collection named after its MAP type, unless that name is
+// reserved.
+type Route struct {
+	Type       string `yaml:"type"`       // MAP type to match, empty or "*" for any
+	App        string `yaml:"app"`        // MAP app to match, empty or "*" for any
+	Collection string `yaml:"collection"` // collection to write to, defaults to the MAP type
+	Ignore     bool   `yaml:"ignore"`     // drop matching entries instead of writing them
+}
+
+// derivedCollections are written by the indexers, so no MAP entry may be
+// written to them. Collections starting with "_" are reserved too.
+var derivedCollections = []string{"identities", "reactions", "channels", "conversations", "follows", "counts"}
+
+// validCollection reports whether MAP entries may be written to collection
+func validCollection(collection string) bool {
+	return collection != "" && !strings.HasPrefix(collection, "_") && !strings.ContainsAny(collection, "$.\x00") &&
+		!slices.Contains(derivedCollections, collection)
+}
+
+func (r Route) matches(mapType string, app string) bool {
+	return (r.Type == "" || r.Type == "*" || r.Type == mapType) &&
+		(r.App == "" || r.App == "*" || r.App == app)
+}
+
+// Route returns the collection a MAP entry of the given type and app is
+// written to, or ok false if it is not written anywhere
+func (c *Config) Route(mapType string, app string) (collection string, ok bool) {
+	for _, r := range c.Routes {
+		if !r.matches(mapType, app) {
+			continue
+		}
+		if r.Ignore {
+			return "", false
+		}
+		if r.Collection != "" {
+			return r.Collection, true
+		}
+		break
+	}
+	if !validCollection(mapType) {
+		return "", false
+	}
+	return mapType, true
+}
+
+// Collections returns the collections documents are known to be written to:
+// the output types and the collections routes rename to
+func (c *Config) Collections() []string {
+	collections := append([]string(nil), c.OutputTypes...)
+	for _, r := range c.Routes {
+		if r.Ignore || r.Collection == "" {
+			continue
+		}
+		if !slices.Contains(collections, r.Collection) {
+			collections = append(collections, r.Collection)
+		}
+	}
+	return collections
+}
+
+func validateRoutes(routes []Route) (errs []error) {
+	for i, r := range routes {
+		if r.Ignore && r.Collection != "" {
+			errs = append(errs, fmt.Errorf("route %d: ignore and collection are exclusive", i))
+		}
+		if r.Collection != "" && !validCollection(r.Collection) {
+			errs = append(errs, fmt.Errorf("route %d: invalid collection %q", i, r.Collection))
+		}
+		if r.Collection == "" && !r.Ignore && (r.Type == "" || r.Type == "*") {
+			errs = append(errs, fmt.Errorf("route %d: a route matching any type needs a collection or ignore", i))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	c := Default()
+	c.Routes = []Route{
+		{Type: "post", App: "spam", Ignore: true},
+		{Type: "post", App: "treechat", Collection: "treechat_posts"},
+		{App: "games", Collection: "games"},
+		{Type: "message", App: "*"},
+		{Type: "message", Collection: "never"},
+	}
+	tests := []struct {
+		mapType, app string
+		collection   string
+		ok           bool
+	}{
+		{"post", "bsocial", "post", true},
+		{"post", "spam", "", false},
+		{"post", "treechat", "treechat_posts", true},
+		{"like", "games", "games", true},
+		// the first match wins, and one without a collection keeps the type
+		{"message", "games", "games", true},
+		{"message", "bsocial", "message", true},
+		{"", "bsocial", "", false},
+		// reserved names are never written to
+		{"_headers", "bsocial", "", false},
+		{"identities", "bsocial", "", false},
+		{"a$b", "bsocial", "", false},
+		{"system.users", "bsocial", "", false},
+	}
+	for _, tt := range tests {
+		collection, ok := c.Route(tt.mapType, tt.app)
+		if collection != tt.collection || ok != tt.ok {
+			t.Errorf("Route(%q, %q) = %q, %v, want %q, %v", tt.mapType, tt.app, collection, ok, tt.collection, tt.ok)
+		}
+	}
+
+	c.OutputTypes = []string{"post", "games"}
+	if got := fmt.Sprint(c.Collections()); got != "[post games treechat_posts never]" {
+		t.Errorf("Collections = %s", got)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	tests := []struct {
+		route Route
+		ok    bool
+	}{
+		{Route{Type: "post", Collection: "posts"}, true},
+		{Route{Type: "post", Ignore: true}, true},
+		{Route{Type: "post"}, true},
+		{Route{App: "x", Collection: "x"}, true},
+		{Route{Type: "post", Collection: "posts", Ignore: true}, false},
+		{Route{Type: "post", Collection: "_blocks"}, false},
+		{Route{Type: "post", Collection: "a.b"}, false},
+		{Route{Type: "post", Collection: "follows"}, false},
+		{Route{Type: "*"}, false},
+		{Route{App: "x"}, false},
+	}
+	for _, tt := range tests {
+		if errs := validateRoutes([]Route{tt.route}); (len(errs) == 0) != tt.ok {
+			t.Errorf("validateRoutes(%+v) = %v, want ok %v", tt.route, errs, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package crawler
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"golang.org/x/exp/slices"
+)
+
+// CollectionsCollection lists every collection txs were written to, keyed by
+// its name. Rollbacks and mempool evictions go through it, so they reach the
+// collections unrouted MAP types fall back to as well as the configured ones.
+const CollectionsCollection = "_collections"
+
+// recorded caches the collections this process listed, by store
+var recorded sync.Map
+
+type recordedKey struct {
+	store      store.Store
+	collection string
+}
+
+// collectionWrites returns the writes that list collections
+func collectionWrites(collections []string) []store.Write {
+	writes := make([]store.Write, 0, len(collections))
+	for _, collection := range collections {
+		writes = append(writes, store.Write{Doc: store.Doc{"_id": collection}})
+	}
+	return writes
+}
+
+// recordCollections lists the collections in s, writing only those this
+// process has not listed there before
+func recordCollections(ctx context.Context, s store.Store, collections []string) error {
+	var missing []string
+	for _, collection := range collections {
+		if _, ok := recorded.Load(recordedKey{s, collection}); !ok {
+			missing = append(missing, collection)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := s.UpsertTxs(ctx, CollectionsCollection, collectionWrites(missing)); err != nil {
+		return err
+	}
+	for _, collection := range missing {
+		recorded.Store(recordedKey{s, collection}, true)
+	}
+	return nil
+}
+
+// writtenCollections returns the configured collections and every other
+// collection txs were written to in s
+func writtenCollections(ctx context.Context, s store.Store, cfg *config.Config) ([]string, error) {
+	collections := cfg.Collections()
+	err := store.Each(ctx, s, CollectionsCollection, store.Query{}, func(doc store.Doc) error {
+		if collection, _ := doc["_id"].(string); collection != "" && !slices.Contains(collections, collection) {
+			collections = append(collections, collection)
+		}
+		return nil
+	})
+	return collections, err
+}
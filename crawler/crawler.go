@@ -2,10 +2,9 @@ package crawler
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
 	"os"
-	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -15,64 +14,150 @@ import (
 	"github.com/GorillaPool/go-junglebus/models"
 	"github.com/bitcoin-sv/go-sdk/transaction"
 	"github.com/bitcoinschema/go-bmap"
+	"github.com/rohenaz/go-bmap-indexer/blob"
 	"github.com/rohenaz/go-bmap-indexer/config"
 	"github.com/rohenaz/go-bmap-indexer/database"
+	"github.com/rohenaz/go-bmap-indexer/headers"
 	"github.com/rohenaz/go-bmap-indexer/p2p"
 	"github.com/rohenaz/go-bmap-indexer/persist"
+	"github.com/rohenaz/go-bmap-indexer/search"
+	"github.com/rohenaz/go-bmap-indexer/spv"
 	"github.com/rohenaz/go-bmap-indexer/state"
+	"github.com/rohenaz/go-bmap-indexer/store"
 	"github.com/ttacon/chalk"
 	"go.mongodb.org/mongo-driver/bson"
-	"golang.org/x/exp/slices"
 )
 
+// Deps are the stores the crawler writes to and the services it checks
+// blocks against. Only Store is required, the others are nil when disabled.
+type Deps struct {
+	Store    store.Store
+	Blobs    blob.Store     // holds the contents retention offloads
+	Verifier *spv.Verifier  // checks the merkle proofs of mined txs
+	Headers  *headers.Chain // the main chain committed blocks are checked against
+	Search   search.Index   // indexes the text of posts and messages
+}
+
 // var wgs map[uint32]*sync.WaitGroup
 var cancelChannel chan int
 var eventChannel chan *Event
 
-func SyncBlocks(height int) (newBlock int) {
+// subscription generation, used to drop events from a closed subscription
+var generation uint64
+
+var errDisconnected = errors.New("disconnected from junglebus")
+var errStalled = errors.New("no events from junglebus")
+var errCancelled = errors.New("crawl cancelled")
+
+// errUnparsable marks a tx that cannot be parsed, which fails the same way
+// on every retry
+var errUnparsable = errors.New("unparsable tx")
+
+// SyncBlocks supervises the crawl until ctx is cancelled, ingesting the
+// blocks as they complete. Whenever the crawl dies it resubscribes from the
+// last committed height, backing off exponentially between attempts. It
+// returns once the completed blocks are ingested, or left for the next run
+// if ctx was cancelled.
+func SyncBlocks(ctx context.Context, d *Deps, cfg *config.Config, height int) (newBlock int) {
 	// Setup crawl timer
 	crawlStart := time.Now()
 
-	// Crawl will mutate currentBlock
-	newBlock = Crawl(height)
+	blocks := make(chan doneBlock, 1000)
+	processed := make(chan struct{})
+	go func() {
+		processDone(ctx, d, cfg, blocks)
+		close(processed)
+	}()
+
+	newBlock = height
+	attempt := 0
+	for ctx.Err() == nil {
+		started := time.Now()
+		resumeBlock, err := crawl(ctx, d, cfg, blocks, newBlock)
+		if ctx.Err() != nil {
+			break
+		}
+
+		// a crawl that made progress starts the backoff over
+		if resumeBlock > newBlock {
+			attempt = 0
+		}
+		attempt++
+
+		// resubscribe from the last committed height
+		if progress := int(state.LoadProgress(d.Store, cfg)); progress > resumeBlock {
+			resumeBlock = progress
+		}
+		nextBlock := resumeBlock
+		var requested cancelRequest
+		if errors.As(err, &requested) {
+			nextBlock = requested.height
+		}
+
+		delay := reconnectDelay(cfg, attempt)
+		log.Printf("%s[RECONNECT %d]: %v after %s, resubscribing from block %d in %s%s\n",
+			chalk.Yellow, attempt, err, time.Since(started).Round(time.Second), nextBlock, delay, chalk.Reset)
+		if nextBlock > resumeBlock {
+			log.Printf("%s[GAP]: blocks %d-%d will not be crawled%s\n", chalk.Yellow, resumeBlock, nextBlock-1, chalk.Reset)
+		} else if nextBlock < resumeBlock {
+			log.Printf("%s[GAP]: blocks %d-%d will be crawled again%s\n", chalk.Yellow, nextBlock, resumeBlock-1, chalk.Reset)
+		}
+		newBlock = nextBlock
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	// no more blocks will be completed, let processDone finish up
+	close(blocks)
+	<-processed
 
 	// Crawl complete
 	diff := time.Since(crawlStart).Seconds()
 
-	// TODO: I believe if we get here crawl has actually died
-	fmt.Printf("Junglebus closed after %fs\nBlock height: %d\n", diff, height)
+	fmt.Printf("Junglebus closed after %fs\nBlock height: %d\n", diff, newBlock)
 	return
 }
 
-type BlockState struct {
-	Height  int
-	Retries int
-}
-
-type CrawlState struct {
-	Height int
-	Blocks []BlockState
+// reconnectDelay returns the exponential backoff delay for a reconnect attempt
+func reconnectDelay(cfg *config.Config, attempt int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempt && delay < cfg.ReconnectMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > cfg.ReconnectMaxBackoff {
+		delay = cfg.ReconnectMaxBackoff
+	}
+	return delay
 }
 
 type Event struct {
+	Generation  uint64
 	Type        string
+	Code        uint32
 	Error       error
 	Height      uint32
 	Time        uint32
+	Hash        string
 	Id          string
 	Transaction []byte
+	Proof       []byte // merkle proof of a mined tx, if junglebus sent one
 	Status      string
 }
 
 func init() {
-	// TODO: Is this needed?
 	// wgs = make(map[uint32]*sync.WaitGroup)
-	// cancelChannel = make(chan int)
+	cancelChannel = make(chan int, 1)
 	eventChannel = make(chan *Event, 1000000) // Buffered channel
 }
 
-// Crawl loops over the new bmap transactions since the given block height
-func Crawl(height int) (newHeight int) {
+// crawl loops over the new bmap transactions since the given block height
+// until ctx is cancelled or the subscription dies, queueing completed blocks
+// on blocks. It returns the height to resubscribe from and the reason the
+// crawl stopped.
+func crawl(ctx context.Context, d *Deps, cfg *config.Config, blocks chan<- doneBlock, height int) (newHeight int, err error) {
 
 	// readyFiles := make(chan string, 1000) // Adjust buffer size as needed
 	// make the first waitgroup for the initial block
@@ -80,33 +165,37 @@ func Crawl(height int) (newHeight int) {
 	// wgs[uint32(height)] = &sync.WaitGroup{}
 
 	junglebusClient, err := junglebus.New(
-		junglebus.WithHTTP(config.JunglebusEndpoint),
+		junglebus.WithHTTP(cfg.JunglebusEndpoint),
 	)
 	if err != nil {
-		log.Fatalln(err.Error())
+		return height, fmt.Errorf("creating junglebus client: %w", err)
 	}
 
-	subscriptionID := config.SubscriptionID
-
-	// get from block from block.tmp
-	fromBlock := uint64(config.FromBlock)
-
-	lastBlock := uint64(state.LoadProgress())
+	subscriptionID := cfg.SubscriptionID
 
-	if lastBlock > fromBlock {
-		fromBlock = lastBlock
+	fromBlock := uint64(cfg.FromBlock)
+	if uint64(height) > fromBlock {
+		fromBlock = uint64(height)
 	}
 
+	// stamp events so stragglers from a previous subscription are ignored
+	generation++
+	gen := generation
+	lastDoneHeight = 0
+
 	eventHandler := junglebus.EventHandler{
 		// Mined tx callback
 		OnTransaction: func(tx *models.TransactionResponse) {
 			// log.Printf("[TX]: %d - %d: %v", tx.BlockHeight, len(tx.Transaction), tx.Id)
 
 			eventChannel <- &Event{
+				Generation:  gen,
 				Type:        "transaction",
 				Height:      tx.BlockHeight,
 				Time:        tx.BlockTime,
+				Hash:        tx.BlockHash,
 				Transaction: tx.Transaction,
+				Proof:       tx.Merkle,
 				Id:          tx.Id,
 			}
 		},
@@ -115,99 +204,128 @@ func Crawl(height int) (newHeight int) {
 			log.Printf("[MEM]: %d: %v", tx.BlockHeight, tx.Id)
 
 			eventChannel <- &Event{
+				Generation:  gen,
 				Type:        "mempool",
 				Transaction: tx.Transaction,
 				Id:          tx.Id,
 			}
 		},
 		OnStatus: func(status *models.ControlResponse) {
-			if status.Status == "error" {
+			if status.StatusCode == uint32(junglebus.SubscriptionReorg) {
+				log.Printf("[REORG %d]: %v", status.Block, status.Message)
+				eventChannel <- &Event{Generation: gen, Type: "reorg", Height: status.Block, Status: status.Message}
+				return
+			}
+			if status.Status == "error" || status.StatusCode == uint32(junglebus.SubscriptionError) {
 				log.Printf("[ERROR %d]: %v", status.StatusCode, status.Message)
-				eventChannel <- &Event{Type: "error", Error: fmt.Errorf("%d: %s", status.StatusCode, status.Message)}
+				eventChannel <- &Event{Generation: gen, Type: "error", Code: status.StatusCode, Error: fmt.Errorf("%d: %s", status.StatusCode, status.Message)}
 				return
 			} else {
 				eventChannel <- &Event{
-					Type:   "status",
-					Height: status.Block,
-					Status: status.Status,
+					Generation: gen,
+					Type:       "status",
+					Height:     status.Block,
+					Status:     status.Status,
 				}
 			}
 		},
 		OnError: func(err error) {
 			log.Printf("[ERROR]: %v", err)
-			eventChannel <- &Event{Type: "error", Error: err}
+			eventChannel <- &Event{Generation: gen, Type: "error", Error: err}
 		},
 	}
 
 	fmt.Printf("Initializing from block %d\n", fromBlock)
 
 	var subscription *junglebus.Subscription
-	if subscription, err = junglebusClient.Subscribe(context.Background(), subscriptionID, fromBlock, eventHandler); err != nil {
+	if subscription, err = junglebusClient.Subscribe(ctx, subscriptionID, fromBlock, eventHandler); err != nil {
 		log.Printf("ERROR: failed getting subscription %s", err.Error())
-		unsubscribeError := subscription.Unsubscribe()
-
-		if err = subscription.Unsubscribe(); unsubscribeError != nil {
-			log.Printf("ERROR: failed unsubscribing %s", err.Error())
-		}
+		return int(fromBlock), err
 	}
 
 	// wait indefinitely to make sure we dont stop
 	// before more mempool txs come in
-	go eventListener(subscription)
+	doneBlock, err := eventListener(ctx, d, cfg, blocks, subscription, gen)
+
+	// return the new block height to resubscribe from
+	if uint64(doneBlock) >= fromBlock {
+		return int(doneBlock) + 1, err
+	}
+	return int(fromBlock), err
+}
 
-	// have a channel here listen for the stop signal, decrement the waitgroup
-	// and return the new block height to resubscribe from
+// cancelRequest is returned by the event listener when CancelCrawl is called
+type cancelRequest struct {
+	height int
+}
 
-	// Print tx line to stdout
-	// if err != nil {
-	// 	fmt.Println(err)
-	// }
+func (c cancelRequest) Error() string {
+	return fmt.Sprintf("%v at block %d", errCancelled, c.height)
+}
 
-	return
+func (c cancelRequest) Unwrap() error {
+	return errCancelled
 }
 
+// CancelCrawl stops the current subscription and resubscribes from
+// newBlockHeight
 func CancelCrawl(newBlockHeight int) {
 	log.Printf("%s[INFO]: Canceling crawl at block %d%s\n", chalk.Yellow, newBlockHeight, chalk.Reset)
-	cancelChannel <- newBlockHeight
+	select {
+	case cancelChannel <- newBlockHeight:
+	default:
+		log.Printf("%s[INFO]: Crawl cancel already pending%s\n", chalk.Yellow, chalk.Reset)
+	}
 }
 
-func processTransactionEvent(rawtx []byte, blockHeight uint32, blockTime uint32) {
-	if len(rawtx) > 0 {
-		// log.Printf("[TX]: %d: %s | Data Length: %d", blockHeight, tx.Id, len(tx.Transaction))
-		t, err := transaction.NewTransactionFromBytes(rawtx)
-		if err != nil {
-			log.Printf("[ERROR]: %v", err)
-			return
-		}
-		bmapTx, err := bmap.NewFromTx(t)
-		if err != nil {
-			log.Printf("[ERROR]: %v", err)
-			return
-		}
-
-		bmapTx.Blk.I = blockHeight
-		bmapTx.Blk.T = blockTime
-
-		// log.Printf("[BMAP]: %d: %s | Data Length: %d | First 10 bytes: %x", tx.BlockHeight, bmapTx.Tx.Tx.H, len(tx.Transaction), tx.Transaction[:10])
-		// indexerTx := database.IndexerTx{
-		// 	*bmapTx,
-		// 	0,
-		// }
-		// that doesnt work
-		indexerTx := &database.IndexerTx{
-			Tx:        *bmapTx,
-			Timestamp: 0,
-		}
+// processTransactionEvent parses a mined tx and appends it to its block file,
+// unless it fails SPV verification
+func processTransactionEvent(d *Deps, cfg *config.Config, rawtx []byte, blockHeight uint32, blockTime uint32, blockHash string, proof []byte) error {
+	indexerTx, err := parseMinedTx(rawtx, blockHeight, blockTime, blockHash)
+	if err != nil || indexerTx == nil {
+		return err
+	}
+	if ok, err := verifyTx(d, cfg, indexerTx, proof); !ok || err != nil {
+		return err
+	}
+	_, _, err = processTx(d, cfg, indexerTx)
+	return err
+}
 
-		_, _, _ = processTx(indexerTx)
-		// if err != nil {
-		// 	log.Printf("[ERROR]: %v", err)
-		// 	return
-		// }
+// parseMinedTx parses a tx mined in the block at blockHeight, returning nil
+// if there is no tx
+func parseMinedTx(rawtx []byte, blockHeight uint32, blockTime uint32, blockHash string) (*database.IndexerTx, error) {
+	if len(rawtx) == 0 {
+		return nil, nil
+	}
+	// log.Printf("[TX]: %d: %s | Data Length: %d", blockHeight, tx.Id, len(tx.Transaction))
+	t, err := transaction.NewTransactionFromBytes(rawtx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing tx: %w", errUnparsable, err)
+	}
+	bmapTx, err := bmap.NewFromTx(t)
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing bmap: %w", errUnparsable, err)
 	}
+
+	bmapTx.Blk.I = blockHeight
+	bmapTx.Blk.T = blockTime
+
+	// log.Printf("[BMAP]: %d: %s | Data Length: %d | First 10 bytes: %x", tx.BlockHeight, bmapTx.Tx.Tx.H, len(tx.Transaction), tx.Transaction[:10])
+	// indexerTx := database.IndexerTx{
+	// 	*bmapTx,
+	// 	0,
+	// }
+	// that doesnt work
+	return &database.IndexerTx{
+		Tx:          *bmapTx,
+		Timestamp:   0,
+		BlockHash:   blockHash,
+		Transaction: t,
+	}, nil
 }
 
-func processMempoolEvent(rawtx []byte) (path string, height uint32, err error) {
+func processMempoolEvent(d *Deps, cfg *config.Config, rawtx []byte) (path string, height uint32, err error) {
 	t, err := transaction.NewTransactionFromBytes(rawtx)
 	if err != nil {
 		return "", 0, err
@@ -218,9 +336,10 @@ func processMempoolEvent(rawtx []byte) (path string, height uint32, err error) {
 	}
 	fmt.Printf("%sProcessing mempool tx %s%s\n", chalk.Cyan, bmapTx.Tx.Tx.H, chalk.Reset)
 
-	bsonData, err := PrepareForIngestion(&database.IndexerTx{
-		Tx:        *bmapTx,
-		Timestamp: time.Now().Unix(),
+	bsonData, err := PrepareForIngestion(d, cfg, &database.IndexerTx{
+		Tx:          *bmapTx,
+		Timestamp:   time.Now().Unix(),
+		Transaction: t,
 	})
 	if err != nil {
 		return
@@ -228,34 +347,54 @@ func processMempoolEvent(rawtx []byte) (path string, height uint32, err error) {
 	// bsonData in a block gets saved as json to a file and re-read
 	// In that process some things get changed a bit
 	// Json marshall/unmarshall ensures the data matches the data processed in blocks
-	bsonDataJson, err := json.Marshal(bsonData)
+	bsonDataNew, err := jsonDoc(bsonData)
 	if err != nil {
 		return
 	}
-	var bsonDataNew bson.M
-	err = json.Unmarshal(bsonDataJson, &bsonDataNew)
-	if err != nil {
+
+	if err = saveTransaction(d, cfg, bsonDataNew); err != nil {
 		return
 	}
 
-	saveTransaction(bsonDataNew)
-
 	return path, bmapTx.Blk.I, nil
 }
 
-func processBlockDoneEvent(height uint32, count uint32) {
+// processBlockDoneEvent ingests a completed block and records progress. A
+// block that keeps failing is parked in the failed block ledger so the crawl
+// can move on. It returns false if the block was left for the next run.
+func processBlockDoneEvent(ctx context.Context, d *Deps, cfg *config.Config, height uint32, count uint32) bool {
 
 	filename := fmt.Sprintf("data/%d.json", height)
+	block := crawlState.take(height)
 
 	// // check if the file exists at path
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) && len(block.FailedTxs) == 0 {
 		log.Printf("No block file found for %d ", height)
-		return
+		return false
+	}
+
+	// the header of a new tip block may not be synced yet
+	if chain := d.Headers; chain != nil {
+		if err := chain.WaitFor(ctx, height); err != nil && ctx.Err() == nil {
+			log.Printf("%s[HEADERS]: %v%s", chalk.Yellow, err, chalk.Reset)
+		}
 	}
 
-	ingest(filename)
-	state.SaveProgress(height)
-	if config.DeleteAfterIngest && !config.EnableP2P {
+	// a block replacing the one we have at this height orphans it
+	if err := detectReorg(ctx, d, cfg, block); err != nil {
+		log.Printf("[ERROR]: checking block %d for a reorg: %v", height, err)
+		return false
+	}
+
+	// the block is committed along with the progress
+	if !retryBlock(ctx, d, cfg, block) {
+		return false
+	}
+	// the social graph catches up on its next block if this fails
+	if _, err := state.SyncState(ctx, d.Store, cfg); err != nil {
+		log.Printf("[ERROR]: syncing state: %v", err)
+	}
+	if cfg.DeleteAfterIngest && !cfg.EnableP2P {
 		fmt.Printf("%sDeleting file in crawler %s%s\n", chalk.Cyan, filename, chalk.Reset)
 		err := os.Remove(filename)
 		if err != nil {
@@ -264,16 +403,22 @@ func processBlockDoneEvent(height uint32, count uint32) {
 	}
 
 	// log ingestions in green using chalk
-	log.Printf("%sIngested %d txs from block %d%s", chalk.Cyan, count, height, chalk.Reset)
+	if chain := d.Headers; chain != nil && chain.TipHeight() > 0 {
+		lag := max(chain.TipHeight(), height) - height
+		log.Printf("%sIngested %d txs from block %d, %d blocks behind the tip%s", chalk.Cyan, count, height, lag, chalk.Reset)
+	} else {
+		log.Printf("%sIngested %d txs from block %d%s", chalk.Cyan, count, height, chalk.Reset)
+	}
 
-	if config.EnableP2P {
+	if cfg.EnableP2P {
 		p2p.ReadyBlock = height
 	}
+	return true
 }
 
-func processTx(bmapData *database.IndexerTx) (path string, bsonData bson.M, err error) {
+func processTx(d *Deps, cfg *config.Config, bmapData *database.IndexerTx) (path string, bsonData bson.M, err error) {
 
-	bsonData, err = PrepareForIngestion(bmapData)
+	bsonData, err = PrepareForIngestion(d, cfg, bmapData)
 	if err != nil {
 		log.Printf("[ERROR]: %v", err)
 		return "", nil, err
@@ -290,7 +435,7 @@ func processTx(bmapData *database.IndexerTx) (path string, bsonData bson.M, err
 	return path, bsonData, err
 }
 
-func PrepareForIngestion(bmapData *database.IndexerTx) (bsonData bson.M, err error) {
+func PrepareForIngestion(d *Deps, cfg *config.Config, bmapData *database.IndexerTx) (bsonData bson.M, err error) {
 
 	// delete input.Tape from the inputs and outputs
 	for i := range bmapData.Tx.In {
@@ -309,55 +454,62 @@ func PrepareForIngestion(bmapData *database.IndexerTx) (bsonData bson.M, err err
 		"out": bmapData.Tx.Out,
 	}
 
-	if bmapData.AIP != nil {
-		bsonData["AIP"] = bmapData.AIP
+	if bmapData.Timestamp != 0 {
+		bsonData["timestamp"] = bmapData.Timestamp
 	}
 
-	if bmapData.AIP != nil {
-		bsonData["SIGMA"] = bmapData.Sigma
+	if bmapData.BlockHash != "" {
+		bsonData["blk"] = bson.M{"i": bmapData.Blk.I, "t": bmapData.Blk.T, "h": bmapData.BlockHash}
+	}
+
+	if !cfg.SkipSPV && bmapData.Blk.I > 0 {
+		bsonData["spv_verified"] = bmapData.SPVVerified
+	}
+
+	// every AIP and SIGMA signature is checked, the doc is verified when
+	// all of them are valid
+	if bmapData.AIP != nil || bmapData.Sigma != nil {
+		aips, sigmas, signer, verified := verifySignatures(bmapData)
+		if aips != nil {
+			bsonData["AIP"] = aips
+		}
+		if sigmas != nil {
+			bsonData["SIGMA"] = sigmas
+		}
+		bsonData["verified"] = verified
+		if verified {
+			bsonData["signer"] = signer
+		}
 	}
 
 	if bmapData.BAP != nil {
 		bsonData["BAP"] = bmapData.BAP
 	}
 
-	if bmapData.Ord != nil {
-		// remove the data
-		for _, o := range bmapData.Ord {
-			o.Data = []byte{}
+	// B and Ord contents, and the AIP signed data holding them, are kept
+	// as the retention policy of the collections the tx is written to allows
+	collections := txCollections(cfg, bmapData.MAP)
 
-			// take only the first 255 characters
-			if len(o.ContentType) > 255 {
-				o.ContentType = o.ContentType[:255]
-			}
+	var stripped []*Stripped
+	if bmapData.Ord != nil {
+		records := retainOrd(d.Blobs, cfg, collections, bmapData.Ord)
+		for _, r := range records {
+			stripped = append(stripped, r.Stripped)
 		}
-
-		bsonData["Ord"] = bmapData.Ord
+		bsonData["Ord"] = records
 	}
 
 	if bmapData.B != nil {
-		for _, b := range bmapData.B {
-			// remove the data if its not a message
-			var removeData = true
-			// only if this is a bitcoinschema type, do we keep the data
-			// TODO: Allow user to select the types they want to index fully
-			if len(bmapData.MAP) > 0 && bmapData.MAP[0]["type"] != nil {
-				if slices.Contains(strings.Split(config.OutputTypes, ","), fmt.Sprintf("%v", bmapData.MAP[0]["type"])) {
-					removeData = false
-				}
-			}
-			if removeData {
-				b.Data.Bytes = nil
-				b.Data.UTF8 = ""
-			} else if b.Data.UTF8 != "" {
-				b.Data.Bytes = nil
-			}
-			if len(b.MediaType) > 255 {
-				b.MediaType = b.MediaType[:255]
-			}
+		records := retainB(d.Blobs, cfg, collections, bmapData.B)
+		for _, r := range records {
+			stripped = append(stripped, r.Stripped)
 		}
+		bsonData["B"] = records
+	}
 
-		bsonData["B"] = bmapData.B
+	// the data AIP signed holds the B contents verbatim
+	if aips, ok := bsonData["AIP"].([]aipRecord); ok {
+		bsonData["AIP"] = retainAIP(aips, stripped)
 	}
 
 	if bmapData.BOOST != nil {
@@ -369,19 +521,10 @@ func PrepareForIngestion(bmapData *database.IndexerTx) (bsonData bson.M, err err
 		return
 	}
 
+	// the collections are chosen from every MAP entry when the tx is
+	// written, see config.Route
 	bsonData["MAP"] = bmapData.MAP
 
-	if collection, ok := bmapData.MAP[0]["type"].(string); ok {
-		bsonData["collection"] = collection
-	} else {
-		// log.Println("Error: MAP 'type' key does not exist.")
-		return
-	}
-	if _, ok := bmapData.MAP[0]["app"].(string); !ok {
-		// log.Println("Error: MAP 'app' key does not exist.")
-		return
-	}
-
 	for key, value := range bsonData {
 		if str, ok := value.(string); ok {
 			if !utf8.ValidString(str) {
@@ -0,0 +1,42 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	cfg := config.Default()
+	cfg.ReconnectMaxBackoff = 10 * time.Second
+	for attempt, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := reconnectDelay(cfg, attempt); got != want {
+			t.Errorf("attempt %d: delay %s, want %s", attempt, got, want)
+		}
+	}
+	if got := reconnectDelay(cfg, 1000); got != cfg.ReconnectMaxBackoff {
+		t.Errorf("attempt 1000: delay %s, want the max", got)
+	}
+
+	cfg.ReconnectMaxBackoff = 1500 * time.Millisecond
+	if got := reconnectDelay(cfg, 3); got != cfg.ReconnectMaxBackoff {
+		t.Errorf("delay %s, want the max of %s", got, cfg.ReconnectMaxBackoff)
+	}
+}
+
+func TestSyncBlocksAgain(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// each call has its own queue of completed blocks to close
+	for range 2 {
+		if got := SyncBlocks(ctx, d, cfg, 10); got != 10 {
+			t.Errorf("SyncBlocks = %d, want 10", got)
+		}
+	}
+}
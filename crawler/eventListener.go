@@ -1,77 +1,236 @@
 package crawler
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"time"
 
 	"github.com/GorillaPool/go-junglebus"
+	"github.com/rohenaz/go-bmap-indexer/config"
 	"github.com/ttacon/chalk"
 )
 
-// map of block height to tx count
-var blocksDone = make(chan map[uint32]uint32, 1000)
+// doneBlock is a completed block waiting to be ingested, or a reorg that
+// orphans the blocks from Height up
+type doneBlock struct {
+	Height uint32
+	Count  uint32
+	Reorg  bool
+}
 
 var txCount uint32
 
-func eventListener(subscription *junglebus.Subscription) {
-	// var crawlHeight uint32
-	// var wg sync.WaitGroup
-	for event := range eventChannel {
-		switch event.Type {
-		case "transaction":
-			txCount++
-			// log.Printf("%sTransaction %s %s\n", chalk.Green, event.Id, chalk.Reset)
-			processTransactionEvent(event.Transaction, event.Height, event.Time)
-
-		case "status":
-			switch event.Status {
-			case "disconnected":
-				log.Fatalf("%sDisconnected from Junglebus.%s\n", chalk.Green, chalk.Reset)
-			case "connected":
-				log.Printf("%sConnected to Junglebus%s\n", chalk.Green, chalk.Reset)
-
-				continue
-			case "waiting":
-				log.Printf("%sWaiting for new blocks%s\n", chalk.Green, chalk.Reset)
-				// if config.EnableP2P && !p2p.Started {
-				// 	// convert jsonld files to individual cbor files suitable for p2p transmission
-				// 	p2p.CreateContentCache()
-				// 	go p2p.Start()
-				// }
-				continue
-			case "block-done":
-				// copy the var
-				var count = txCount
-				if count > 0 {
-					log.Printf("%sBlock %d done with %d transactions%s\n", chalk.Green, event.Height, count, chalk.Reset)
-					blocksDone <- map[uint32]uint32{event.Height: count}
-				}
-				txCount = 0
-				continue
-			}
-		case "mempool":
-			_, _, err := processMempoolEvent(event.Transaction)
+// height of the block currently being written to disk
+var txHeight uint32
+
+// last block completed by the current subscription
+var lastDoneHeight uint32
+
+// unsubscriber is the junglebus subscription a listener shuts down
+type unsubscriber interface {
+	Unsubscribe() error
+}
+
+// eventListener handles the events of subscription generation gen until ctx
+// is cancelled, the connection drops, junglebus stalls or CancelCrawl is
+// called, then shuts the subscription down. It returns the last block height
+// junglebus reported as done and why the listener stopped.
+func eventListener(ctx context.Context, d *Deps, cfg *config.Config, blocks chan<- doneBlock, subscription unsubscriber, gen uint64) (doneHeight uint32, err error) {
+	txs := newTxPipeline(d, cfg)
+	defer txs.close()
+
+	// a subscription that goes quiet for too long is treated as dead
+	var stalled <-chan time.Time
+	var stallTimer *time.Timer
+	if cfg.StallTimeout > 0 {
+		stallTimer = time.NewTimer(cfg.StallTimeout)
+		defer stallTimer.Stop()
+		stalled = stallTimer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Printf("%sShutting down crawler%s\n", chalk.Green, chalk.Reset)
+			return shutdownListener(d, cfg, txs, blocks, subscription, gen, doneHeight), nil
+		case height := <-cancelChannel:
+			return shutdownListener(d, cfg, txs, blocks, subscription, gen, doneHeight), cancelRequest{height}
+		case <-stalled:
+			return shutdownListener(d, cfg, txs, blocks, subscription, gen, doneHeight), fmt.Errorf("%w for %s", errStalled, cfg.StallTimeout)
+		case event := <-eventChannel:
+			height, err := handleEvent(d, cfg, txs, blocks, event, gen)
 			if err != nil {
-				fmt.Printf("%s%s%s\n", chalk.Red, err.Error(), chalk.Reset)
-				continue
+				return shutdownListener(d, cfg, txs, blocks, subscription, gen, doneHeight), err
+			} else if height > 0 {
+				doneHeight = height
+			}
+			// reset once the event is handled, as a block waits for its txs
+			if stallTimer != nil && event.Generation == gen {
+				stallTimer.Reset(cfg.StallTimeout)
 			}
-		case "error":
-			log.Printf("%sERROR: %s%s\n", chalk.Green, event.Error.Error(), chalk.Reset)
 		}
 	}
 }
 
-func ProcessDone() {
-	for heightMap := range blocksDone {
-		// loop over single entry map
-		for height, txCount := range heightMap {
-			if txCount > 0 {
-				processBlockDoneEvent(height, txCount)
-				//if config.EnableP2P {
-				// p2p.CreateContentCache()
-				//}
+// handleEvent processes a single event of subscription generation gen. Mined
+// txs are handed to txs, and a block is only queued on blocks once
+// they are written. It returns the height of a completed block, if any, and
+// an error when the subscription can not continue.
+func handleEvent(d *Deps, cfg *config.Config, txs *txPipeline, blocks chan<- doneBlock, event *Event, gen uint64) (doneHeight uint32, err error) {
+	if event.Generation != gen {
+		// left over from a subscription we already closed
+		return 0, nil
+	}
+
+	switch event.Type {
+	case "transaction":
+		if event.Height <= lastDoneHeight {
+			// junglebus went back to a height it already sent
+			log.Printf("%s[REORG]: block %d sent again after block %d%s\n", chalk.Yellow, event.Height, lastDoneHeight, chalk.Reset)
+			queueReorg(blocks, event.Height)
+		}
+		if txCount == 0 || txHeight != event.Height {
+			startBlock(txs, event.Height)
+		}
+		txCount++
+		txHeight = event.Height
+		crawlState.seen(event.Height, event.Hash)
+		// log.Printf("%sTransaction %s %s\n", chalk.Green, event.Id, chalk.Reset)
+		txs.submit(event)
+
+	case "status":
+		switch event.Status {
+		case "disconnected":
+			log.Printf("%sDisconnected from Junglebus.%s\n", chalk.Green, chalk.Reset)
+			return 0, errDisconnected
+		case "connected":
+			log.Printf("%sConnected to Junglebus%s\n", chalk.Green, chalk.Reset)
+		case "waiting":
+			log.Printf("%sWaiting for new blocks%s\n", chalk.Green, chalk.Reset)
+			// if config.EnableP2P && !p2p.Started {
+			// 	// convert jsonld files to individual cbor files suitable for p2p transmission
+			// 	p2p.CreateContentCache()
+			// 	go p2p.Start()
+			// }
+		case "block-done":
+			// copy the var
+			var count = txCount
+			if count > 0 {
+				txs.flush()
+				log.Printf("%sBlock %d done with %d transactions%s\n", chalk.Green, event.Height, count, chalk.Reset)
+				blocks <- doneBlock{Height: event.Height, Count: count}
 			}
-			break
+			txCount = 0
+			lastDoneHeight = event.Height
+			return event.Height, nil
+		}
+	case "mempool":
+		_, _, err := processMempoolEvent(d, cfg, event.Transaction)
+		if err != nil {
+			fmt.Printf("%s%s%s\n", chalk.Red, err.Error(), chalk.Reset)
+		}
+	case "reorg":
+		queueReorg(blocks, event.Height)
+	case "error":
+		log.Printf("%sERROR: %s%s\n", chalk.Green, event.Error.Error(), chalk.Reset)
+		if event.Code == uint32(junglebus.SubscriptionError) {
+			return 0, fmt.Errorf("subscription error: %w", event.Error)
+		}
+	}
+	return 0, nil
+}
+
+// shutdownListener unsubscribes from junglebus, drains the events already
+// buffered and rolls back the block file of any block left incomplete
+func shutdownListener(d *Deps, cfg *config.Config, txs *txPipeline, blocks chan<- doneBlock, subscription unsubscriber, gen uint64, doneHeight uint32) uint32 {
+	if err := subscription.Unsubscribe(); err != nil {
+		log.Printf("%sERROR: failed unsubscribing %s%s\n", chalk.Green, err.Error(), chalk.Reset)
+	}
+
+	for len(eventChannel) > 0 {
+		if height, _ := handleEvent(d, cfg, txs, blocks, <-eventChannel, gen); height > 0 {
+			doneHeight = height
+		}
+	}
+	txs.flush()
+
+	if txCount > 0 {
+		log.Printf("%sRolling back incomplete block %d%s\n", chalk.Green, txHeight, chalk.Reset)
+		discardBlock(txHeight)
+		txCount = 0
+	}
+
+	return doneHeight
+}
+
+// startBlock clears anything left at height by an earlier crawl, such as the
+// block file of an incomplete block or of a block since orphaned
+func startBlock(txs *txPipeline, height uint32) {
+	txs.flush()
+	if txCount > 0 {
+		log.Printf("%sRolling back incomplete block %d%s\n", chalk.Green, txHeight, chalk.Reset)
+		discardBlock(txHeight)
+		txCount = 0
+	}
+	discardBlock(height)
+}
+
+// discardBlock removes the block file and crawl state of height
+func discardBlock(height uint32) {
+	crawlState.take(height)
+	filename := fmt.Sprintf("data/%d.json", height)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("%s%s %s: %v%s\n", chalk.Cyan, "Error deleting file", filename, err, chalk.Reset)
+	}
+}
+
+// queueReorg asks processDone to roll back the blocks from height up, in
+// order with the blocks already queued
+func queueReorg(blocks chan<- doneBlock, height uint32) {
+	blocks <- doneBlock{Height: height, Reorg: true}
+	if height > 0 {
+		lastDoneHeight = height - 1
+	}
+}
+
+// processDone ingests the completed blocks queued on blocks until it is
+// closed. Once ctx is cancelled the remaining blocks are left to be replayed
+// on the next run. In between blocks, the committed blocks are checked
+// against the headers.
+func processDone(ctx context.Context, d *Deps, cfg *config.Config, blocks <-chan doneBlock) {
+	ticker := time.NewTicker(chainCheckInterval)
+	defer ticker.Stop()
+	for {
+		var block doneBlock
+		select {
+		case <-ticker.C:
+			if ctx.Err() == nil {
+				checkChain(ctx, d, cfg)
+			}
+			continue
+		case b, ok := <-blocks:
+			if !ok {
+				return
+			}
+			block = b
+		}
+		if ctx.Err() != nil {
+			log.Printf("%sLeaving block %d for the next run%s", chalk.Cyan, block.Height, chalk.Reset)
+			continue
+		}
+		if block.Reorg {
+			if err := rollback(ctx, d, cfg, block.Height, "reorg reported by junglebus", ""); err != nil {
+				log.Printf("[ERROR]: rolling back from block %d: %v", block.Height, err)
+			}
+			continue
+		}
+		if block.Count > 0 {
+			processBlockDoneEvent(ctx, d, cfg, block.Height, block.Count)
+			//if config.EnableP2P {
+			// p2p.CreateContentCache()
+			//}
 		}
 	}
 }
@@ -0,0 +1,207 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GorillaPool/go-junglebus"
+	"github.com/bitcoin-sv/go-sdk/transaction"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// fakeSubscription records whether the listener unsubscribed
+type fakeSubscription struct {
+	unsubscribed bool
+}
+
+func (f *fakeSubscription) Unsubscribe() error {
+	f.unsubscribed = true
+	return nil
+}
+
+// postTx returns the raw bytes of a tx with a MAP post output
+func postTx(t *testing.T, content string) []byte {
+	t.Helper()
+	tx := transaction.NewTransaction()
+	if err := tx.AddInputFrom("a3a1c7f3ba0a8f9c2e8f4b7a3c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d", 0, "", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	parts := [][]byte{
+		[]byte("19HxigV4QyBv3tHpQVcUEQyq1pzZVdoAut"), []byte(content), []byte("text/plain"), []byte("utf-8"), []byte("|"),
+		[]byte("1PuQa7K62MiKCtssSLKy1kh56WWU7MtUR5"), []byte("SET"), []byte("app"), []byte("test"), []byte("type"), []byte("post"),
+	}
+	if err := tx.AddOpReturnPartsOutput(parts); err != nil {
+		t.Fatal(err)
+	}
+	return tx.Bytes()
+}
+
+// listen queues events of subscription generation gen and resets the crawl
+// state the listener keeps in package variables
+func listen(t *testing.T, gen uint64, lastDone uint32, events ...*Event) {
+	t.Helper()
+	saved := eventChannel
+	eventChannel = make(chan *Event, len(events))
+	txCount, txHeight, lastDoneHeight = 0, 0, lastDone
+	t.Cleanup(func() {
+		eventChannel = saved
+		txCount, txHeight, lastDoneHeight = 0, 0, 0
+	})
+	for _, event := range events {
+		event.Generation = gen
+		eventChannel <- event
+	}
+}
+
+func TestShutdownListener(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+	data := inDataDir(t)
+	if err := s.SaveProgress(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// block 5 is complete, block 6 is still being sent when the crawl is cancelled
+	listen(t, 7, 4,
+		&Event{Type: "transaction", Id: "a", Height: 5, Hash: "hash5", Transaction: postTx(t, "a")},
+		&Event{Type: "status", Status: "block-done", Height: 5},
+		&Event{Type: "transaction", Id: "b", Height: 6, Hash: "hash6", Transaction: postTx(t, "b")},
+	)
+	t.Cleanup(func() { crawlState.take(5) })
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	sub := &fakeSubscription{}
+	blocks := make(chan doneBlock, 10)
+	doneHeight, err := eventListener(cancelled, d, cfg, blocks, sub, 7)
+	if err != nil || doneHeight != 5 {
+		t.Errorf("eventListener = %d, %v, want block 5 done", doneHeight, err)
+	}
+	if !sub.unsubscribed {
+		t.Error("did not unsubscribe")
+	}
+	if len(eventChannel) != 0 {
+		t.Errorf("%d events left buffered", len(eventChannel))
+	}
+
+	// the complete block is queued, the incomplete one rolled back
+	select {
+	case block := <-blocks:
+		if block.Height != 5 || block.Count != 1 {
+			t.Errorf("queued block %+v, want block 5 with 1 tx", block)
+		}
+	default:
+		t.Error("block 5 not queued")
+	}
+	if _, err = os.Stat(filepath.Join(data, "5.json")); err != nil {
+		t.Errorf("block file 5: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(data, "6.json")); !os.IsNotExist(err) {
+		t.Errorf("block file 6 kept: %v", err)
+	}
+	if block := crawlState.take(6); block.Hash != "" {
+		t.Errorf("crawl state of block 6 kept: %+v", block)
+	}
+
+	// nothing is committed after the cancel, the next run resumes after the
+	// last complete block that was
+	blocks <- doneBlock{Height: 5, Count: 1}
+	close(blocks)
+	processDone(cancelled, d, cfg, blocks)
+	if got := progress(t, s); got != 4 {
+		t.Errorf("progress = %d, want 4", got)
+	}
+	if n := count(t, s, "post", nil); n != 0 {
+		t.Errorf("%d posts committed", n)
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	inDataDir(t)
+	listen(t, 3, 10)
+	t.Cleanup(func() { crawlState.take(12) })
+	txs := newTxPipeline(d, cfg)
+	defer txs.close()
+	blocks := make(chan doneBlock, 10)
+
+	tests := []struct {
+		event  Event
+		height uint32
+		err    error // nil, or the error the event is wrapped in
+		queued *doneBlock
+	}{
+		{Event{Generation: 2, Type: "status", Status: "disconnected"}, 0, nil, nil},
+		{Event{Generation: 3, Type: "status", Status: "connected"}, 0, nil, nil},
+		{Event{Generation: 3, Type: "status", Status: "block-done", Height: 11}, 11, nil, nil},
+		{Event{Generation: 3, Type: "transaction", Id: "a", Height: 12, Transaction: postTx(t, "a")}, 0, nil, nil},
+		{Event{Generation: 3, Type: "status", Status: "block-done", Height: 12}, 12, nil, &doneBlock{Height: 12, Count: 1}},
+		{Event{Generation: 3, Type: "transaction", Id: "b", Height: 12, Transaction: postTx(t, "b")}, 0, nil, &doneBlock{Height: 12, Reorg: true}},
+		{Event{Generation: 3, Type: "reorg", Height: 9}, 0, nil, &doneBlock{Height: 9, Reorg: true}},
+		{Event{Generation: 3, Type: "error", Error: errors.New("timeout")}, 0, nil, nil},
+		{Event{Generation: 3, Type: "error", Code: uint32(junglebus.SubscriptionError), Error: errors.New("gone")}, 0, errors.New("subscription error: gone"), nil},
+		{Event{Generation: 3, Type: "status", Status: "disconnected"}, 0, errDisconnected, nil},
+	}
+	for i, tt := range tests {
+		event := tt.event
+		height, err := handleEvent(d, cfg, txs, blocks, &event, 3)
+		if height != tt.height || fmt.Sprint(err) != fmt.Sprint(tt.err) {
+			t.Errorf("event %d: %+v = %d, %v, want %d, %v", i, tt.event, height, err, tt.height, tt.err)
+		}
+		select {
+		case block := <-blocks:
+			if tt.queued == nil || block != *tt.queued {
+				t.Errorf("event %d: queued %+v, want %v", i, block, tt.queued)
+			}
+		default:
+			if tt.queued != nil {
+				t.Errorf("event %d: nothing queued, want %+v", i, *tt.queued)
+			}
+		}
+	}
+}
+
+func TestEventListenerStops(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	inDataDir(t)
+	cfg.StallTimeout = 20 * time.Millisecond
+
+	// junglebus sends nothing
+	listen(t, 1, 0)
+	sub := &fakeSubscription{}
+	started := time.Now()
+	_, err := eventListener(context.Background(), d, cfg, make(chan doneBlock, 10), sub, 1)
+	if !errors.Is(err, errStalled) || !sub.unsubscribed {
+		t.Errorf("stalled listener = %v, unsubscribed %v", err, sub.unsubscribed)
+	}
+	if elapsed := time.Since(started); elapsed < cfg.StallTimeout {
+		t.Errorf("stalled after %s, before the %s timeout", elapsed, cfg.StallTimeout)
+	}
+
+	// the connection drops after a block
+	listen(t, 2, 0,
+		&Event{Type: "status", Status: "block-done", Height: 20},
+		&Event{Type: "status", Status: "disconnected"},
+	)
+	sub = &fakeSubscription{}
+	doneHeight, err := eventListener(context.Background(), d, cfg, make(chan doneBlock, 10), sub, 2)
+	if err != errDisconnected || doneHeight != 20 || !sub.unsubscribed {
+		t.Errorf("disconnected listener = %d, %v, unsubscribed %v", doneHeight, err, sub.unsubscribed)
+	}
+
+	// CancelCrawl asks for a resubscription from another height
+	listen(t, 3, 0)
+	CancelCrawl(15)
+	_, err = eventListener(context.Background(), d, cfg, make(chan doneBlock, 10), &fakeSubscription{}, 3)
+	var requested cancelRequest
+	if !errors.As(err, &requested) || requested.height != 15 {
+		t.Errorf("cancelled listener = %v, want a request for block 15", err)
+	}
+}
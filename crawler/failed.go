@@ -0,0 +1,265 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/headers"
+	"github.com/rohenaz/go-bmap-indexer/state"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// headerWait is how long a block waits for its header between attempts
+const headerWait = 10 * time.Second
+
+// FailedBlocksCollection holds blocks that could not be synced after
+// config.BlockSyncRetries attempts
+const FailedBlocksCollection = "_failed_blocks"
+
+// FailedTx is a tx that could not be parsed, kept so it can be retried
+type FailedTx struct {
+	Id    string `bson:"id"`
+	Time  uint32 `bson:"time"`
+	RawTx []byte `bson:"rawtx"`
+	Proof []byte `bson:"proof,omitempty"`
+	Error string `bson:"error"`
+}
+
+// BlockState tracks the sync attempts of a block that failed
+type BlockState struct {
+	Height    uint32     `bson:"height"`
+	Hash      string     `bson:"hash,omitempty"`
+	Retries   int        `bson:"retries"`
+	Error     string     `bson:"error"`
+	FailedTxs []FailedTx `bson:"failed_txs,omitempty"`
+	FailedAt  time.Time  `bson:"failed_at"`
+
+	committed bool // the block file was committed without the failed txs
+}
+
+// CrawlState is the ledger of blocks being crawled that are not yet ingested
+type CrawlState struct {
+	sync.Mutex
+	Height int
+	Blocks map[uint32]*BlockState
+}
+
+var crawlState = &CrawlState{Blocks: make(map[uint32]*BlockState)}
+
+// block returns the state of height, adding it if needed. The caller must
+// hold the lock.
+func (c *CrawlState) block(height uint32) *BlockState {
+	block, ok := c.Blocks[height]
+	if !ok {
+		block = &BlockState{Height: height}
+		c.Blocks[height] = block
+	}
+	return block
+}
+
+// seen records the hash of a block as its txs arrive
+func (c *CrawlState) seen(height uint32, hash string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if hash != "" {
+		c.block(height).Hash = hash
+	}
+}
+
+// failTx records a tx of height that could not be parsed
+func (c *CrawlState) failTx(height uint32, tx FailedTx) {
+	c.Lock()
+	defer c.Unlock()
+
+	block := c.block(height)
+	block.FailedTxs = append(block.FailedTxs, tx)
+	block.Error = tx.Error
+}
+
+// take removes and returns the state of a block, creating an empty one if
+// none was recorded
+func (c *CrawlState) take(height uint32) *BlockState {
+	c.Lock()
+	defer c.Unlock()
+
+	block, ok := c.Blocks[height]
+	if !ok {
+		return &BlockState{Height: height}
+	}
+	delete(c.Blocks, height)
+	return block
+}
+
+// syncBlock re-parses the failed txs of a block and commits its block file
+// with every tx that was written. The txs that still fail are left in
+// block.FailedTxs, and those worth retrying are returned as an error. A tx
+// that cannot be parsed fails the same way every time, so it is not.
+func syncBlock(ctx context.Context, d *Deps, cfg *config.Config, block *BlockState) error {
+	var errs []error
+	var remaining []FailedTx
+	for _, tx := range block.FailedTxs {
+		err := processTransactionEvent(d, cfg, tx.RawTx, block.Height, tx.Time, block.Hash, tx.Proof)
+		if err == nil {
+			continue
+		}
+		tx.Error = err.Error()
+		remaining = append(remaining, tx)
+		if !errors.Is(err, errUnparsable) {
+			errs = append(errs, fmt.Errorf("tx %s: %w", tx.Id, err))
+		}
+	}
+	recovered := len(remaining) < len(block.FailedTxs)
+	block.FailedTxs = remaining
+
+	// txs written to the block file since it was committed need another
+	// commit
+	if !block.committed || recovered {
+		if err := commitBlock(ctx, d, cfg, block); err != nil {
+			return err
+		}
+		block.committed = true
+	}
+	return errors.Join(errs...)
+}
+
+// failedTxsError describes the txs of a block that still fail
+func failedTxsError(block *BlockState) error {
+	var errs []error
+	for _, tx := range block.FailedTxs {
+		errs = append(errs, fmt.Errorf("tx %s: %s", tx.Id, tx.Error))
+	}
+	return errors.Join(errs...)
+}
+
+// retryBlock syncs a block, retrying up to cfg.BlockSyncRetries times before
+// parking it in the failed block collection. A block whose header is not
+// synced yet is retried until it is, without using up its retries. Once the
+// block file is committed only the txs that still fail are parked, and txs
+// that cannot be parsed are parked without retrying. It returns false only
+// if ctx was cancelled before the block was synced or parked.
+func retryBlock(ctx context.Context, d *Deps, cfg *config.Config, block *BlockState) bool {
+	err := syncBlock(ctx, d, cfg, block)
+	for err != nil && ctx.Err() == nil && (block.Retries < cfg.BlockSyncRetries || errors.Is(err, headers.ErrNotSynced)) {
+		delay := headerWait
+		if errors.Is(err, headers.ErrNotSynced) {
+			log.Printf("%s[WAIT]: block %d: %v%s", chalk.Yellow, block.Height, err, chalk.Reset)
+		} else {
+			block.Retries++
+			delay = time.Duration(block.Retries) * time.Second
+			log.Printf("%s[RETRY %d/%d]: block %d: %v%s", chalk.Yellow, block.Retries, cfg.BlockSyncRetries, block.Height, err, chalk.Reset)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			err = syncBlock(ctx, d, cfg, block)
+		}
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("%sBlock %d not ingested: %v%s", chalk.Cyan, block.Height, ctx.Err(), chalk.Reset)
+		return false
+	}
+	if err == nil && len(block.FailedTxs) > 0 {
+		err = failedTxsError(block)
+	}
+	if err != nil {
+		block.Error = err.Error()
+		block.FailedAt = time.Now()
+		if block.committed {
+			log.Printf("%s[FAILED]: parking %d txs of block %d after %d retries: %v%s", chalk.Red, len(block.FailedTxs), block.Height, block.Retries, err, chalk.Reset)
+		} else {
+			log.Printf("%s[FAILED]: parking block %d after %d retries: %v%s", chalk.Red, block.Height, block.Retries, err, chalk.Reset)
+		}
+		if err = parkBlock(d.Store, block); err != nil {
+			log.Printf("[ERROR]: could not park block %d: %v", block.Height, err)
+		}
+		// move on past the parked block
+		if !block.committed {
+			state.SaveProgress(d.Store, block.Height)
+		}
+	}
+	return true
+}
+
+func parkBlock(s store.Store, block *BlockState) error {
+	return s.UpsertTx(context.Background(), FailedBlocksCollection, store.Doc{
+		"_id":        block.Height,
+		"height":     block.Height,
+		"hash":       block.Hash,
+		"retries":    block.Retries,
+		"error":      block.Error,
+		"failed_txs": block.FailedTxs,
+		"failed_at":  block.FailedAt,
+	})
+}
+
+// FailedBlocks returns the parked blocks in height order, with the hashes
+// they are committed under when re-driven
+func FailedBlocks(s store.Store) (blocks []BlockState, err error) {
+	q := store.Query{SortBy: "height"}
+	err = store.Each(context.Background(), s, FailedBlocksCollection, q, func(doc store.Doc) error {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var block BlockState
+		if err = bson.Unmarshal(raw, &block); err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+		return nil
+	})
+	return
+}
+
+// RetryFailedBlocks re-drives parked blocks, or only the block at height if
+// it is not 0. Blocks that sync are removed from the failed block collection,
+// the rest have their retry count and error updated.
+func RetryFailedBlocks(ctx context.Context, d *Deps, cfg *config.Config, height uint32) (recovered int, failed int, err error) {
+	blocks, err := FailedBlocks(d.Store)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for i := range blocks {
+		block := &blocks[i]
+		if height != 0 && block.Height != height {
+			continue
+		}
+		if ctx.Err() != nil {
+			return recovered, failed, ctx.Err()
+		}
+
+		log.Printf("%sRetrying failed block %d%s", chalk.Cyan, block.Height, chalk.Reset)
+		syncErr := syncBlock(ctx, d, cfg, block)
+		if syncErr == nil && len(block.FailedTxs) > 0 {
+			syncErr = failedTxsError(block)
+		}
+		if syncErr != nil {
+			failed++
+			block.Retries++
+			block.Error = syncErr.Error()
+			block.FailedAt = time.Now()
+			log.Printf("%s[FAILED]: block %d: %v%s", chalk.Red, block.Height, syncErr, chalk.Reset)
+			if err = parkBlock(d.Store, block); err != nil {
+				return recovered, failed, err
+			}
+			continue
+		}
+
+		recovered++
+		if err = d.Store.DeleteTx(ctx, FailedBlocksCollection, block.Height); err != nil {
+			return recovered, failed, err
+		}
+	}
+	return recovered, failed, nil
+}
@@ -0,0 +1,176 @@
+package crawler
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// inDataDir runs the test in a directory with an empty data directory, where
+// commitBlock reads the block files
+func inDataDir(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err = os.Mkdir("data", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return "data"
+}
+
+func progress(t *testing.T, s store.Store) uint32 {
+	t.Helper()
+	height, _, err := s.LoadProgress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return height
+}
+
+func TestCommitBlock(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+	data := inDataDir(t)
+
+	writeBlock(t, data, 5, line("p1", "post", 5), line("l1", "like", 5))
+	if err := commitBlock(ctx, d, cfg, &BlockState{Height: 5, Hash: "hash5"}); err != nil {
+		t.Fatal(err)
+	}
+	if progress(t, s) != 5 || count(t, s, "post", store.Filter{}) != 1 || count(t, s, "like", store.Filter{}) != 1 {
+		t.Errorf("progress %d, %d posts", progress(t, s), count(t, s, "post", store.Filter{}))
+	}
+	block, err := s.GetTx(ctx, BlocksCollection, uint32(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block["hash"] != "hash5" || store.ToInt(block["txs"]) != 2 {
+		t.Errorf("block = %v", block)
+	}
+
+	// a block file that cannot be read in full writes nothing
+	writeBlock(t, data, 6, line("p2", "post", 6), "{not json")
+	if err = commitBlock(ctx, d, cfg, &BlockState{Height: 6, Hash: "hash6"}); err == nil {
+		t.Error("committing a block with a bad line did not fail")
+	}
+	if progress(t, s) != 5 || count(t, s, "post", store.Filter{}) != 1 {
+		t.Errorf("after a failed commit: progress %d, %d posts", progress(t, s), count(t, s, "post", store.Filter{}))
+	}
+	if _, err = s.GetTx(ctx, BlocksCollection, uint32(6)); err != store.ErrNotFound {
+		t.Errorf("hash of the failed block = %v, want ErrNotFound", err)
+	}
+	if err = commitBlock(ctx, d, cfg, &BlockState{Height: 7}); err == nil {
+		t.Error("committing a block without a file did not fail")
+	}
+
+	// committing a block again is harmless
+	if err = commitBlock(ctx, d, cfg, &BlockState{Height: 5, Hash: "hash5"}); err != nil {
+		t.Fatal(err)
+	}
+	if progress(t, s) != 5 || count(t, s, "post", store.Filter{}) != 1 {
+		t.Errorf("after committing again: progress %d, %d posts", progress(t, s), count(t, s, "post", store.Filter{}))
+	}
+}
+
+func TestRetryFailedBlocks(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+	data := inDataDir(t)
+
+	for _, height := range []uint32{3, 4} {
+		if err := parkBlock(s, &BlockState{Height: height, Hash: "hash", Retries: 5, Error: "failed"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeBlock(t, data, 3, line("p1", "post", 3))
+
+	recovered, failed, err := RetryFailedBlocks(ctx, d, cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered != 1 || failed != 1 {
+		t.Errorf("recovered %d, failed %d, want 1 and 1", recovered, failed)
+	}
+	blocks, err := FailedBlocks(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Height != 4 || blocks[0].Retries != 6 || blocks[0].Hash != "hash" {
+		t.Errorf("failed blocks = %+v", blocks)
+	}
+	if count(t, s, "post", store.Filter{}) != 1 {
+		t.Error("the recovered block was not committed")
+	}
+
+	// only the block asked for is retried
+	writeBlock(t, data, 4, line("p2", "post", 4))
+	if recovered, failed, err = RetryFailedBlocks(ctx, d, cfg, 9); err != nil || recovered+failed != 0 {
+		t.Errorf("retrying block 9 = %d, %d, %v", recovered, failed, err)
+	}
+	if recovered, _, err = RetryFailedBlocks(ctx, d, cfg, 4); err != nil || recovered != 1 {
+		t.Errorf("retrying block 4 = %d, %v", recovered, err)
+	}
+	if blocks, _ = FailedBlocks(s); len(blocks) != 0 {
+		t.Errorf("failed blocks = %+v", blocks)
+	}
+}
+
+func TestRetryBlockWithBadTx(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	cfg.BlockSyncRetries = 3
+	ctx := context.Background()
+	data := inDataDir(t)
+
+	// the good txs of the block are in its file, and the bad one failed to
+	// parse
+	writeBlock(t, data, 8, line("p1", "post", 8), line("p2", "post", 8))
+	bad := FailedTx{Id: "bad", RawTx: []byte{1, 2, 3}, Error: "parsing tx"}
+	block := &BlockState{Height: 8, Hash: "hash8", FailedTxs: []FailedTx{bad}}
+	if !retryBlock(ctx, d, cfg, block) {
+		t.Fatal("the block was not synced or parked")
+	}
+	if progress(t, s) != 8 || count(t, s, "post", store.Filter{}) != 2 {
+		t.Errorf("progress %d, %d posts, want 8 and 2", progress(t, s), count(t, s, "post", store.Filter{}))
+	}
+	// a tx that cannot be parsed is parked without retrying
+	blocks, err := FailedBlocks(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Retries != 0 || len(blocks[0].FailedTxs) != 1 || blocks[0].FailedTxs[0].Id != "bad" {
+		t.Errorf("failed blocks = %+v", blocks)
+	}
+
+	// a block whose every tx failed is committed empty
+	block = &BlockState{Height: 9, Hash: "hash9", FailedTxs: []FailedTx{bad}}
+	if !retryBlock(ctx, d, cfg, block) {
+		t.Fatal("the block was not synced or parked")
+	}
+	if progress(t, s) != 9 {
+		t.Errorf("progress %d, want 9", progress(t, s))
+	}
+	if blocks, _ = FailedBlocks(s); len(blocks) != 2 {
+		t.Errorf("failed blocks = %+v", blocks)
+	}
+
+	// retrying the parked block keeps the tx that still fails
+	recovered, failed, err := RetryFailedBlocks(ctx, d, cfg, 8)
+	if err != nil || recovered != 0 || failed != 1 {
+		t.Errorf("retrying block 8 = %d, %d, %v", recovered, failed, err)
+	}
+	if count(t, s, "post", store.Filter{}) != 2 {
+		t.Errorf("%d posts after the retry, want 2", count(t, s, "post", store.Filter{}))
+	}
+}
@@ -0,0 +1,54 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rohenaz/go-bmap-indexer/chat"
+	"github.com/rohenaz/go-bmap-indexer/search"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/thread"
+)
+
+// indexer collects the docs written with a block file or a mempool tx, and
+// updates what it derives from them once they are stored
+type indexer interface {
+	Add(collection string, w store.Write)
+	Index(ctx context.Context) error
+}
+
+// namedIndexer is an indexer and what it indexes, for its errors
+type namedIndexer struct {
+	name string
+	indexer
+}
+
+// indexers run in order, so a reply is linked before it is searchable
+type indexers []namedIndexer
+
+// newIndexers returns the indexers of a block file or a mempool tx written
+// to s
+func newIndexers(d *Deps) indexers {
+	return indexers{
+		{"threads", thread.NewBatch(d.Store)},
+		{"chat rooms", chat.NewBatch(d.Store)},
+		{"text", search.NewBatch(d.Search)},
+	}
+}
+
+// Add notes a write to collection with every indexer
+func (l indexers) Add(collection string, w store.Write) {
+	for _, i := range l {
+		i.Add(collection, w)
+	}
+}
+
+// Index runs every indexer, stopping at the first that fails
+func (l indexers) Index(ctx context.Context) error {
+	for _, i := range l {
+		if err := i.Index(ctx); err != nil {
+			return fmt.Errorf("indexing %s: %w", i.name, err)
+		}
+	}
+	return nil
+}
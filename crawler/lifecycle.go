@@ -0,0 +1,74 @@
+package crawler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+)
+
+// Lifecycle status of an indexed document, kept in its "status" field
+const (
+	StatusMempool   = "mempool"   // seen in mempool, not mined yet
+	StatusConfirmed = "confirmed" // mined in a block on the main chain
+	StatusOrphaned  = "orphaned"  // mined in a block a reorg rolled back
+	StatusEvicted   = "evicted"   // not mined within config.MempoolTTL
+)
+
+// Statuses lists every lifecycle status
+var Statuses = []string{StatusMempool, StatusConfirmed, StatusOrphaned, StatusEvicted}
+
+// SweepMempool evicts mempool documents that were not mined within
+// cfg.MempoolTTL, checking periodically until ctx is cancelled
+func SweepMempool(ctx context.Context, s store.Store, cfg *config.Config) {
+	if cfg.MempoolTTL == 0 {
+		return
+	}
+	interval := 10 * time.Minute
+	if cfg.MempoolTTL < interval {
+		interval = cfg.MempoolTTL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := evictMempool(ctx, s, cfg, time.Now().Add(-cfg.MempoolTTL)); err != nil && ctx.Err() == nil {
+				log.Printf("[ERROR]: sweeping mempool: %v", err)
+			}
+		}
+	}
+}
+
+// evictMempool marks the mempool documents first seen before cutoff evicted.
+// A document that is mined later becomes confirmed again.
+func evictMempool(ctx context.Context, s store.Store, cfg *config.Config, cutoff time.Time) error {
+	expired := store.Filter{
+		"status":     StatusMempool,
+		"first_seen": store.Filter{"$lt": float64(cutoff.Unix())},
+	}
+	evicted := store.Doc{"status": StatusEvicted, "evicted_at": float64(time.Now().Unix())}
+
+	collections, err := writtenCollections(ctx, s, cfg)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, collection := range collections {
+		count, err := s.UpdateMany(ctx, collection, expired, evicted)
+		if err != nil {
+			return err
+		}
+		total += count
+	}
+	if total > 0 {
+		log.Printf("%sEvicted %d mempool txs not mined within %s%s", chalk.Cyan, total, cfg.MempoolTTL, chalk.Reset)
+	}
+	return nil
+}
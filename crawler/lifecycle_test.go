@@ -0,0 +1,102 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// parsed round trips a line through JSON, as it is read from a block file
+func parsed(t *testing.T, doc map[string]interface{}) bson.M {
+	t.Helper()
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m bson.M
+	if err = json.Unmarshal(raw, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPrepareWrite(t *testing.T) {
+	cfg := config.Default()
+
+	mempool := parsed(t, line("m", "post", 0))
+	mempool["timestamp"] = 50.0
+	_, w, ok := prepareWrite(cfg, mempool)
+	if !ok || w.Doc["status"] != nil || w.Doc["timestamp"] != nil || w.Defaults["status"] != StatusMempool ||
+		w.Defaults["first_seen"] != 50.0 || w.Defaults["timestamp"] != 50.0 {
+		t.Errorf("mempool write = %v, defaults %v", w.Doc, w.Defaults)
+	}
+
+	collections, w, ok := prepareWrite(cfg, parsed(t, line("c", "post", 7)))
+	if !ok || len(collections) != 1 || collections[0] != "post" {
+		t.Fatalf("collections = %v, %v", collections, ok)
+	}
+	if w.Doc["status"] != StatusConfirmed || w.Doc["confirmed_at"] != 1007.0 ||
+		w.Defaults["first_seen"] != 1007.0 || w.Defaults["timestamp"] != 1007.0 {
+		t.Errorf("confirmed write = %v, defaults %v", w.Doc, w.Defaults)
+	}
+
+	if _, _, ok = prepareWrite(cfg, parsed(t, line("x", "", 7))); ok {
+		t.Error("a doc without a MAP type was written")
+	}
+}
+
+func TestEvictMempool(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+
+	seen := time.Now().Add(-2 * time.Hour).Unix()
+	old := parsed(t, line("old", "post", 0))
+	old["timestamp"] = float64(seen)
+	oldPoll := parsed(t, line("poll", "poll", 0))
+	oldPoll["timestamp"] = float64(seen)
+	for _, doc := range []bson.M{old, parsed(t, line("new", "post", 0)), oldPoll} {
+		if err := saveTransaction(d, cfg, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := evictMempool(ctx, s, cfg, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusEvicted}); n != 1 {
+		t.Errorf("%d evicted posts, want 1", n)
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusMempool, "_id": "new"}); n != 1 {
+		t.Errorf("the recent post is not in mempool")
+	}
+	// polls are not an output type, but were written to a collection too
+	if n := count(t, s, "poll", store.Filter{"status": StatusEvicted}); n != 1 {
+		t.Errorf("%d evicted polls, want 1", n)
+	}
+
+	// an evicted tx that is mined is confirmed, and keeps when it was seen
+	if err := saveTransaction(d, cfg, parsed(t, line("old", "post", 9))); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := s.GetTx(ctx, "post", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["status"] != StatusConfirmed || store.ToInt(doc["first_seen"]) != seen {
+		t.Errorf("mined post = %v", doc)
+	}
+
+	// seeing a mined tx in mempool again does not undo its confirmation
+	if err = saveTransaction(d, cfg, parsed(t, line("old", "post", 0))); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusConfirmed}); n != 1 {
+		t.Errorf("%d confirmed posts, want 1", n)
+	}
+}
@@ -0,0 +1,106 @@
+package crawler
+
+import (
+	"log"
+	"sync"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/database"
+)
+
+// CONCURRENT_VERIFIES caps the mined txs being parsed and verified at once
+var CONCURRENT_VERIFIES = 8
+
+// pipelineDepth is how many mined txs can be queued before the event
+// listener waits for them
+const pipelineDepth = 1000
+
+// minedTx is a mined tx on its way from the event listener to its block file
+type minedTx struct {
+	event *Event
+	tx    *database.IndexerTx
+	ok    bool // false if the tx failed verification, so it is not written
+	err   error
+	done  chan struct{}
+}
+
+// txPipeline parses and verifies the mined txs of a subscription on a pool
+// of workers, so a slow merkle proof does not hold up the event listener,
+// and writes them to their block files in the order they arrived
+type txPipeline struct {
+	d       *Deps
+	cfg     *config.Config
+	verify  chan *minedTx
+	write   chan *minedTx
+	pending sync.WaitGroup // txs not written yet
+	workers sync.WaitGroup
+}
+
+func newTxPipeline(d *Deps, cfg *config.Config) *txPipeline {
+	p := &txPipeline{
+		d:      d,
+		cfg:    cfg,
+		verify: make(chan *minedTx, pipelineDepth),
+		write:  make(chan *minedTx, pipelineDepth),
+	}
+	p.workers.Add(CONCURRENT_VERIFIES + 1)
+	for i := 0; i < CONCURRENT_VERIFIES; i++ {
+		go func() {
+			defer p.workers.Done()
+			for t := range p.verify {
+				t.tx, t.err = parseMinedTx(t.event.Transaction, t.event.Height, t.event.Time, t.event.Hash)
+				if t.err == nil && t.tx != nil {
+					t.ok, t.err = verifyTx(d, cfg, t.tx, t.event.Proof)
+				}
+				close(t.done)
+			}
+		}()
+	}
+	go func() {
+		defer p.workers.Done()
+		for t := range p.write {
+			<-t.done
+			p.finish(t)
+			p.pending.Done()
+		}
+	}()
+	return p
+}
+
+// submit queues a mined tx, waiting only if pipelineDepth txs are queued
+func (p *txPipeline) submit(event *Event) {
+	t := &minedTx{event: event, done: make(chan struct{})}
+	p.pending.Add(1)
+	p.write <- t
+	p.verify <- t
+}
+
+// finish writes a verified tx to its block file, or records it as failed
+func (p *txPipeline) finish(t *minedTx) {
+	if t.err == nil && t.ok {
+		_, _, t.err = processTx(p.d, p.cfg, t.tx)
+	}
+	if t.err != nil {
+		log.Printf("[ERROR]: tx %s in block %d: %v", t.event.Id, t.event.Height, t.err)
+		crawlState.failTx(t.event.Height, FailedTx{
+			Id:    t.event.Id,
+			Time:  t.event.Time,
+			RawTx: t.event.Transaction,
+			Proof: t.event.Proof,
+			Error: t.err.Error(),
+		})
+	}
+}
+
+// flush waits until every tx submitted so far is written or failed
+func (p *txPipeline) flush() {
+	p.pending.Wait()
+}
+
+// close flushes the pipeline and stops its workers
+func (p *txPipeline) close() {
+	p.flush()
+	close(p.verify)
+	close(p.write)
+	p.workers.Wait()
+}
@@ -0,0 +1,203 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/chat"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/identity"
+	"github.com/rohenaz/go-bmap-indexer/search"
+	"github.com/rohenaz/go-bmap-indexer/state"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/thread"
+	"github.com/ttacon/chalk"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// BlocksCollection holds the hash of every committed block, keyed by height
+const BlocksCollection = "_blocks"
+
+// ReorgsCollection is the log of chain reorganizations, for downstream
+// consumers to react to
+const ReorgsCollection = "_reorgs"
+
+// OrphanedBlock is a block rolled back by a reorg
+type OrphanedBlock struct {
+	Height uint32 `bson:"height"`
+	Hash   string `bson:"hash"`
+}
+
+// Reorg records a rollback of the blocks from Height up
+type Reorg struct {
+	Id             string          `bson:"_id"`
+	Height         uint32          `bson:"height"`
+	Reason         string          `bson:"reason"`
+	NewHash        string          `bson:"new_hash,omitempty"`
+	OrphanedBlocks []OrphanedBlock `bson:"orphaned_blocks"`
+	OrphanedDocs   int64           `bson:"orphaned_docs"`
+	DetectedAt     time.Time       `bson:"detected_at"`
+}
+
+// chainCheckInterval is how often committed blocks are checked against the
+// headers, and chainCheckDepth how many of the latest are checked
+const (
+	chainCheckInterval = time.Minute
+	chainCheckDepth    = 100
+)
+
+// checkChain rolls back the committed blocks the headers show are no longer
+// on the main chain, and resubscribes from the first of them
+func checkChain(ctx context.Context, d *Deps, cfg *config.Config) {
+	chain := d.Headers
+	if chain == nil {
+		return
+	}
+	q := store.Query{SortBy: "height", SortDesc: true, Limit: chainCheckDepth}
+	docs, err := d.Store.Query(ctx, BlocksCollection, q)
+	if err != nil {
+		log.Printf("[ERROR]: checking blocks against headers: %v", err)
+		return
+	}
+
+	var orphaned uint32
+	var mainHash string
+	for _, doc := range docs {
+		height := blockHeight(doc)
+		hash, _ := doc["hash"].(string)
+		if h, ok := chain.HashAt(height); ok && h != hash {
+			orphaned, mainHash = height, h
+		}
+	}
+	if orphaned == 0 {
+		return
+	}
+	if err = rollback(ctx, d, cfg, orphaned, "block not on the main chain", mainHash); err != nil {
+		log.Printf("[ERROR]: rolling back from block %d: %v", orphaned, err)
+		return
+	}
+	CancelCrawl(int(orphaned))
+}
+
+// detectReorg compares the hash of a block about to be committed with the
+// hash committed at the same height before, rolling back from that height if
+// they differ
+func detectReorg(ctx context.Context, d *Deps, cfg *config.Config, block *BlockState) error {
+	if block.Hash == "" {
+		return nil
+	}
+	doc, err := d.Store.GetTx(ctx, BlocksCollection, block.Height)
+	if err == store.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if hash, _ := doc["hash"].(string); hash == "" || hash == block.Hash {
+		return nil
+	}
+	return rollback(ctx, d, cfg, block.Height, "block hash changed", block.Hash)
+}
+
+// rollback orphans the blocks from height up. Their documents keep their
+// data but have the orphaned status until the new chain confirms them
+// again. The progress is moved back so the new chain's blocks are committed
+// in order.
+func rollback(ctx context.Context, d *Deps, cfg *config.Config, height uint32, reason string, newHash string) error {
+	reorg := Reorg{
+		Id:         fmt.Sprintf("%d-%d", height, time.Now().UnixNano()),
+		Height:     height,
+		Reason:     reason,
+		NewHash:    newHash,
+		DetectedAt: time.Now(),
+	}
+
+	q := store.Query{Filter: store.Filter{"height": store.Filter{"$gte": height}}, SortBy: "height"}
+	err := store.Each(ctx, d.Store, BlocksCollection, q, func(doc store.Doc) error {
+		hash, _ := doc["hash"].(string)
+		reorg.OrphanedBlocks = append(reorg.OrphanedBlocks, OrphanedBlock{Height: blockHeight(doc), Hash: hash})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	collections, err := writtenCollections(ctx, d.Store, cfg)
+	if err != nil {
+		return err
+	}
+	orphaned := store.Filter{"blk.i": store.Filter{"$gte": height}}
+	for _, collection := range collections {
+		count, err := d.Store.UpdateMany(ctx, collection, orphaned, store.Doc{"status": StatusOrphaned})
+		if err != nil {
+			return fmt.Errorf("orphaning %s: %w", collection, err)
+		}
+		reorg.OrphanedDocs += count
+	}
+
+	if err = identity.Rollback(ctx, d.Store, height); err != nil {
+		return fmt.Errorf("rolling back identities: %w", err)
+	}
+	if err = state.Rollback(ctx, d.Store, height); err != nil {
+		return fmt.Errorf("rolling back state: %w", err)
+	}
+	if err = thread.Rollback(ctx, d.Store, height); err != nil {
+		return fmt.Errorf("rolling back threads: %w", err)
+	}
+	if err = chat.Rollback(ctx, d.Store, collections, height); err != nil {
+		return fmt.Errorf("rolling back chat rooms: %w", err)
+	}
+	if err = search.Rollback(ctx, d.Store, d.Search, collections, height); err != nil {
+		return fmt.Errorf("rolling back the search index: %w", err)
+	}
+
+	for _, block := range reorg.OrphanedBlocks {
+		if err = d.Store.DeleteTx(ctx, BlocksCollection, block.Height); err != nil {
+			return err
+		}
+		if v := d.Verifier; v != nil {
+			v.Forget(block.Height)
+		}
+	}
+	if height > 0 {
+		if err = d.Store.RewindProgress(ctx, height-1); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("%s[REORG]: %s at block %d, orphaned %d blocks and %d documents%s",
+		chalk.Red, reason, height, len(reorg.OrphanedBlocks), reorg.OrphanedDocs, chalk.Reset)
+
+	raw, err := bson.Marshal(reorg)
+	if err != nil {
+		return err
+	}
+	var doc store.Doc
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	return d.Store.UpsertTx(ctx, ReorgsCollection, doc)
+}
+
+func blockHeight(doc store.Doc) uint32 {
+	return uint32(store.ToInt(doc["height"]))
+}
+
+// Reorgs returns the logged reorgs, most recent first
+func Reorgs(s store.Store, limit int64) (reorgs []Reorg, err error) {
+	q := store.Query{SortBy: "detected_at", SortDesc: true, Limit: limit}
+	err = store.Each(context.Background(), s, ReorgsCollection, q, func(doc store.Doc) error {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var reorg Reorg
+		if err = bson.Unmarshal(raw, &reorg); err != nil {
+			return err
+		}
+		reorgs = append(reorgs, reorg)
+		return nil
+	})
+	return
+}
@@ -0,0 +1,137 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/rohenaz/go-bmap-indexer/headers"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+func TestDetectReorg(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+	data := inDataDir(t)
+
+	for height := uint32(1); height <= 3; height++ {
+		// polls are not an output type, so they go to the collection of
+		// their type
+		writeBlock(t, data, height, line(fmt.Sprintf("p%d", height), "post", int(height)),
+			line(fmt.Sprintf("q%d", height), "poll", int(height)))
+		if err := commitBlock(ctx, d, cfg, &BlockState{Height: height, Hash: fmt.Sprintf("hash%d", height)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the same hash, or a block never committed, is no reorg
+	for _, block := range []*BlockState{{Height: 2, Hash: "hash2"}, {Height: 4, Hash: "hash4"}, {Height: 2}} {
+		if err := detectReorg(ctx, d, cfg, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusOrphaned}); n != 0 {
+		t.Fatalf("%d orphaned posts without a reorg", n)
+	}
+
+	if err := detectReorg(ctx, d, cfg, &BlockState{Height: 2, Hash: "other2"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusOrphaned}); n != 2 {
+		t.Errorf("%d orphaned posts, want 2", n)
+	}
+	if n := count(t, s, "poll", store.Filter{"status": StatusOrphaned}); n != 2 {
+		t.Errorf("%d orphaned polls, want 2", n)
+	}
+	if n := count(t, s, BlocksCollection, store.Filter{}); n != 1 {
+		t.Errorf("%d committed blocks after the reorg, want 1", n)
+	}
+	if height := progress(t, s); height != 1 {
+		t.Errorf("progress after the reorg = %d, want 1", height)
+	}
+	reorgs, err := Reorgs(s, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reorgs) != 1 || reorgs[0].Height != 2 || reorgs[0].NewHash != "other2" ||
+		len(reorgs[0].OrphanedBlocks) != 2 || reorgs[0].OrphanedBlocks[0].Hash != "hash2" || reorgs[0].OrphanedDocs != 4 {
+		t.Errorf("reorgs = %+v", reorgs)
+	}
+
+	// the new chain confirms the tx again
+	if err = commitBlock(ctx, d, cfg, &BlockState{Height: 2, Hash: "other2"}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := s.GetTx(ctx, "post", "p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["status"] != StatusConfirmed {
+		t.Errorf("status of a tx mined again = %v", doc["status"])
+	}
+}
+
+// mineHeaders returns count headers from height 1 at the regtest target
+func mineHeaders(count int) []*headers.Header {
+	var chain []*headers.Header
+	var prev chainhash.Hash
+	for height := uint32(1); height <= uint32(count); height++ {
+		h := &headers.Header{Height: height, Version: 1, Prev: prev, Time: height, Bits: 0x207fffff}
+		for ; ; h.Nonce++ {
+			h.Hash = chainhash.DoubleHashH(h.Bytes())
+			// a hash whose top byte is below 0x7f meets the target
+			if h.Hash[chainhash.HashSize-1] < 0x7f {
+				break
+			}
+		}
+		chain = append(chain, h)
+		prev = h.Hash
+	}
+	return chain
+}
+
+func TestCheckChain(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+	data := inDataDir(t)
+
+	chain, err := headers.Open(ctx, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Deps{Store: s, Headers: chain}
+	mined := mineHeaders(3)
+	if _, err = chain.Add(ctx, mined); err != nil {
+		t.Fatal(err)
+	}
+	for height := uint32(1); height <= 3; height++ {
+		hash := mined[height-1].Hash.String()
+		if height == 3 {
+			hash = "stale"
+		}
+		writeBlock(t, data, height, line(fmt.Sprintf("p%d", height), "post", int(height)))
+		if err = commitBlock(ctx, d, cfg, &BlockState{Height: height, Hash: hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the block the headers do not have on the main chain is rolled back
+	checkChain(ctx, d, cfg)
+	select {
+	case height := <-cancelChannel:
+		if height != 3 {
+			t.Errorf("crawl cancelled at %d, want 3", height)
+		}
+	default:
+		t.Error("the crawl was not cancelled")
+	}
+	if n := count(t, s, "post", store.Filter{"status": StatusOrphaned}); n != 1 {
+		t.Errorf("%d orphaned posts, want 1", n)
+	}
+	if height := progress(t, s); height != 2 {
+		t.Errorf("progress = %d, want 2", height)
+	}
+}
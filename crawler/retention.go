@@ -0,0 +1,167 @@
+package crawler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/bitcoinschema/go-b"
+	"github.com/bitcoinschema/go-bmap/ord"
+	magic "github.com/bitcoinschema/go-map"
+	"github.com/rohenaz/go-bmap-indexer/blob"
+	"github.com/rohenaz/go-bmap-indexer/config"
+)
+
+// Stripped notes the content a retention rule removed from a B or Ord record
+type Stripped struct {
+	Action string `json:"action"`           // the retention action applied
+	Size   int    `json:"size"`             // bytes of the original content
+	Hash   string `json:"sha256,omitempty"` // hash of the original content
+	Ref    string `json:"ref,omitempty"`    // blob store reference of offloaded content, served on /v1/content/{ref}
+	Reason string `json:"reason,omitempty"` // why a stricter action than the rule's was applied
+}
+
+// bRecord is a B record with a note of what retention stripped from it
+type bRecord struct {
+	b.B
+	Stripped *Stripped `json:"stripped,omitempty"`
+}
+
+// ordRecord is an Ord record with a note of what retention stripped from it
+type ordRecord struct {
+	ord.Ordinal
+	Stripped *Stripped `json:"stripped,omitempty"`
+}
+
+// txCollections returns the collections a tx is routed to by its MAP
+// entries, see config.Route
+func txCollections(cfg *config.Config, maps []magic.MAP) (collections []string) {
+	for _, m := range maps {
+		mapType, _ := m["type"].(string)
+		app, _ := m["app"].(string)
+		if collection, ok := cfg.Route(mapType, app); ok && !slices.Contains(collections, collection) {
+			collections = append(collections, collection)
+		}
+	}
+	return collections
+}
+
+// retainB applies the retention policy to the B records of a tx
+func retainB(blobs blob.Store, cfg *config.Config, collections []string, records []*b.B) []bRecord {
+	retained := make([]bRecord, 0, len(records))
+	for _, r := range records {
+		if len(r.MediaType) > 255 {
+			r.MediaType = r.MediaType[:255]
+		}
+		record := bRecord{B: *r}
+		if r.Data.UTF8 != "" {
+			var data []byte
+			data, record.Stripped = retain(blobs, cfg, "B", collections, r.MediaType, []byte(r.Data.UTF8))
+			record.Data = b.Data{UTF8: validUTF8(data)}
+		} else {
+			record.Data.Bytes, record.Stripped = retain(blobs, cfg, "B", collections, r.MediaType, r.Data.Bytes)
+		}
+		retained = append(retained, record)
+	}
+	return retained
+}
+
+// retainOrd applies the retention policy to the Ord records of a tx
+func retainOrd(blobs blob.Store, cfg *config.Config, collections []string, records []*ord.Ordinal) []ordRecord {
+	retained := make([]ordRecord, 0, len(records))
+	for _, r := range records {
+		// take only the first 255 characters
+		if len(r.ContentType) > 255 {
+			r.ContentType = r.ContentType[:255]
+		}
+		record := ordRecord{Ordinal: *r}
+		record.Data, record.Stripped = retain(blobs, cfg, "Ord", collections, r.ContentType, r.Data)
+		if record.Data == nil {
+			record.Data = []byte{}
+		}
+		retained = append(retained, record)
+	}
+	return retained
+}
+
+// retainAIP drops the data AIP signed when retention stripped any B or Ord
+// content of the tx, as that data holds the content verbatim. Signatures are
+// checked before this, so their validity is kept. SIGMA records hold only the
+// signature, not the data it signs.
+func retainAIP(aips []aipRecord, stripped []*Stripped) []aipRecord {
+	if !slices.ContainsFunc(stripped, func(s *Stripped) bool { return s != nil }) {
+		return aips
+	}
+	for i := range aips {
+		size := 0
+		for _, d := range aips[i].Data {
+			size += len(d)
+		}
+		if size == 0 {
+			continue
+		}
+		aips[i].Data = nil
+		aips[i].Stripped = &Stripped{Action: config.RetainDrop, Size: size, Reason: "holds content stripped from B or Ord"}
+	}
+	return aips
+}
+
+// retain returns what is kept of the content and a note of what was removed,
+// or nil if nothing was. A tx written to several collections keeps as much
+// as the most generous of their rules allows.
+func retain(blobs blob.Store, cfg *config.Config, protocol string, collections []string, mediaType string, data []byte) ([]byte, *Stripped) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	if len(collections) == 0 {
+		collections = []string{""}
+	}
+
+	var rule config.Retention
+	var reason string
+	for i, collection := range collections {
+		r := cfg.Retain(protocol, collection, mediaType)
+		why := ""
+		if r.MaxSize > 0 && len(data) > r.MaxSize && r.Action != config.RetainDrop {
+			why = fmt.Sprintf("larger than max_size %d", r.MaxSize)
+			r.Action = config.RetainHash
+		}
+		if i == 0 || slices.Index(config.RetainActions, r.Action) < slices.Index(config.RetainActions, rule.Action) {
+			rule, reason = r, why
+		}
+	}
+
+	stripped := &Stripped{Action: rule.Action, Size: len(data), Reason: reason}
+	switch rule.Action {
+	case config.RetainKeep:
+		return data, nil
+	case config.RetainTruncate:
+		if len(data) <= rule.TruncateBytes {
+			return data, nil
+		}
+		stripped.Hash = blob.Hash(data)
+		return data[:rule.TruncateBytes], stripped
+	case config.RetainOffload:
+		ref, err := blob.Put(context.Background(), blobs, data, mediaType)
+		if err == nil {
+			stripped.Ref = ref
+			return nil, stripped
+		}
+		log.Printf("[ERROR]: offloading %s content: %v", protocol, err)
+		stripped.Action, stripped.Reason = config.RetainHash, "offload failed"
+		fallthrough
+	case config.RetainHash:
+		stripped.Hash = blob.Hash(data)
+	}
+	return nil, stripped
+}
+
+// validUTF8 drops a rune cut in half by truncation
+func validUTF8(data []byte) string {
+	for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	return string(data)
+}
@@ -0,0 +1,96 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bitcoinschema/go-aip"
+	"github.com/bitcoinschema/go-b"
+	"github.com/rohenaz/go-bmap-indexer/blob"
+	"github.com/rohenaz/go-bmap-indexer/config"
+)
+
+func TestRetainContent(t *testing.T) {
+	cfg := config.Default()
+	cfg.Retention = []config.Retention{
+		{Collection: "post", MediaTypes: []string{"text/markdown"}, Action: config.RetainTruncate, TruncateBytes: 4},
+		{Collection: "post", Action: config.RetainKeep, MaxSize: 8},
+		{Collection: "message", Action: config.RetainHash},
+		{Collection: "archive", Action: config.RetainOffload},
+	}
+	data := []byte("0123456789")
+	tests := []struct {
+		name        string
+		collections []string
+		mediaType   string
+		data        []byte
+		want        []byte
+		action      string // of the note, "" for none
+	}{
+		{"keep", []string{"post"}, "text/plain", data[:8], data[:8], ""},
+		{"larger than max_size", []string{"post"}, "text/plain", data, nil, config.RetainHash},
+		{"truncate", []string{"post"}, "text/markdown", data, data[:4], config.RetainTruncate},
+		{"short enough to keep", []string{"post"}, "text/markdown", data[:3], data[:3], ""},
+		{"hash", []string{"message"}, "text/plain", data, nil, config.RetainHash},
+		{"most generous collection", []string{"message", "post"}, "text/plain", data[:8], data[:8], ""},
+		{"no collection", nil, "text/plain", data, nil, config.RetainDrop},
+		{"empty", []string{"message"}, "text/plain", []byte{}, []byte{}, ""},
+		{"offload without a blob store", []string{"archive"}, "image/png", data, nil, config.RetainHash},
+	}
+	for _, tt := range tests {
+		got, stripped := retain(nil, cfg, "B", tt.collections, tt.mediaType, tt.data)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: kept %q, want %q", tt.name, got, tt.want)
+		}
+		switch {
+		case tt.action == "" && stripped != nil:
+			t.Errorf("%s: stripped %+v", tt.name, stripped)
+		case tt.action != "" && (stripped == nil || stripped.Action != tt.action || stripped.Size != len(tt.data)):
+			t.Errorf("%s: stripped %+v, want %s", tt.name, stripped, tt.action)
+		case stripped != nil && stripped.Action != config.RetainDrop && stripped.Hash != blob.Hash(tt.data):
+			t.Errorf("%s: hash %s, want the hash of the content", tt.name, stripped.Hash)
+		}
+	}
+
+	cfg.BlobStore, cfg.BlobPath = "fs", t.TempDir()
+	blobs, err := blob.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, stripped := retain(blobs, cfg, "B", []string{"archive"}, "image/png", data)
+	if got != nil || stripped == nil || stripped.Action != config.RetainOffload || stripped.Ref == "" {
+		t.Fatalf("offload = %q, %+v", got, stripped)
+	}
+	stored, _, err := blobs.Get(context.Background(), stripped.Ref)
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("offloaded content = %q, %v", stored, err)
+	}
+}
+
+func TestRetainB(t *testing.T) {
+	cfg := config.Default()
+	cfg.Retention = []config.Retention{{Action: config.RetainTruncate, TruncateBytes: 4}}
+
+	// a rune cut by truncation is dropped
+	records := retainB(nil, cfg, []string{"post"}, []*b.B{{MediaType: "text/plain", Data: b.Data{UTF8: "abcé"}}})
+	if len(records) != 1 || records[0].Data.UTF8 != "abc" || records[0].Stripped == nil {
+		t.Errorf("records = %+v", records)
+	}
+}
+
+func TestRetainAIP(t *testing.T) {
+	aips := func() []aipRecord {
+		return []aipRecord{{Aip: aip.Aip{Data: []string{"6a", "content"}}, Verified: true}, {Verified: true}}
+	}
+	if got := retainAIP(aips(), []*Stripped{nil}); got[0].Data == nil {
+		t.Error("signed data dropped when no content was stripped")
+	}
+	got := retainAIP(aips(), []*Stripped{nil, {Action: config.RetainHash}})
+	if got[0].Data != nil || got[0].Stripped == nil || got[0].Stripped.Size != 9 || !got[0].Verified {
+		t.Errorf("aip = %+v", got[0])
+	}
+	if got[1].Stripped != nil {
+		t.Errorf("aip without data = %+v", got[1])
+	}
+}
@@ -0,0 +1,71 @@
+package crawler
+
+import (
+	bsm "github.com/bitcoin-sv/go-sdk/compat/bsm"
+	"github.com/bitcoin-sv/go-sdk/transaction"
+	"github.com/bitcoinschema/go-aip"
+	"github.com/bitcoinschema/go-sigma"
+	"github.com/rohenaz/go-bmap-indexer/database"
+)
+
+// aipRecord is an AIP signature with whether it is valid for the data it signs
+type aipRecord struct {
+	aip.Aip
+	Verified bool      `json:"verified"`
+	Stripped *Stripped `json:"stripped,omitempty"` // set when retention dropped the signed data
+}
+
+// sigmaRecord is a SIGMA signature with whether it is valid for the tx
+type sigmaRecord struct {
+	sigma.Sig
+	Verified bool `json:"verified"`
+}
+
+// verifySignatures checks every AIP and SIGMA signature of a tx. The tx is
+// verified when it has at least one signature and all of them are valid,
+// and signer is the address of its first signature.
+func verifySignatures(bmapData *database.IndexerTx) (aips []aipRecord, sigmas []sigmaRecord, signer string, verified bool) {
+	verified = len(bmapData.AIP)+len(bmapData.Sigma) > 0
+
+	for _, a := range bmapData.AIP {
+		// Validate replaces a paymail pubkey with its address
+		valid, _ := a.Validate()
+		aips = append(aips, aipRecord{Aip: *a, Verified: valid})
+		verified = verified && valid
+		if signer == "" && valid {
+			signer = a.AlgorithmSigningComponent
+		}
+	}
+
+	instances := map[int]int{}
+	for _, s := range bmapData.Sigma {
+		valid := verifySigma(bmapData.Transaction, s, instances[s.TargetVout])
+		instances[s.TargetVout]++
+		sigmas = append(sigmas, sigmaRecord{Sig: *s, Verified: valid})
+		verified = verified && valid
+		if signer == "" && valid {
+			signer = s.Address
+		}
+	}
+	return aips, sigmas, signer, verified
+}
+
+// verifySigma checks the instance'th SIGMA signature of its output. It signs
+// the outpoint spent by its input and the script before the signature, so
+// it can only be checked with the whole tx.
+func verifySigma(tx *transaction.Transaction, s *sigma.Sig, instance int) bool {
+	if tx == nil || s.TargetVout < 0 || s.TargetVout >= len(tx.Outputs) {
+		return false
+	}
+	// an input of -1 is the one with the index of the output
+	vin := s.Vin
+	if vin == -1 {
+		vin = s.TargetVout
+	}
+	if vin < 0 || vin >= len(tx.Inputs) {
+		return false
+	}
+	check := sigma.NewSigma(*tx, s.TargetVout, instance, s.Vin)
+	check.SetHashes()
+	return bsm.VerifyMessage(s.Address, s.Signature, check.GetMessageHash()) == nil
+}
@@ -0,0 +1,104 @@
+package crawler
+
+import (
+	"fmt"
+	"testing"
+
+	ec "github.com/bitcoin-sv/go-sdk/primitives/ec"
+	"github.com/bitcoin-sv/go-sdk/transaction"
+	"github.com/bitcoinschema/go-aip"
+	"github.com/bitcoinschema/go-sigma"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/database"
+)
+
+// signedTx returns a tx with one input and an OP_RETURN output signed with
+// SIGMA by key
+func signedTx(t *testing.T, key *ec.PrivateKey) (*transaction.Transaction, *sigma.Sig) {
+	t.Helper()
+	tx := transaction.NewTransaction()
+	if err := tx.AddInputFrom("a3a1c7f3ba0a8f9c2e8f4b7a3c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d", 0, "", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.AddOpReturnPartsOutput([][]byte{[]byte("1PuQa7K62MiKCtssSLKy1kh56WWU7MtUR5"), []byte("SET")}); err != nil {
+		t.Fatal(err)
+	}
+	res := sigma.NewSigma(*tx, 0, 0, 0).Sign(key)
+	if res == nil {
+		t.Fatal("signing with SIGMA failed")
+	}
+	return res.SignedTx, &res.Sig
+}
+
+func TestVerifySignatures(t *testing.T) {
+	key, err := ec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := aip.Sign(key, aip.BitcoinECDSA, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aipOf := func(data ...string) *aip.Aip {
+		a := *signed
+		a.Data = data
+		return &a
+	}
+	tx, sig := signedTx(t, key)
+	otherTx, _ := signedTx(t, key)
+	otherTx.Inputs[0].SourceTxOutIndex = 1
+	address := signed.AlgorithmSigningComponent
+
+	tests := []struct {
+		name     string
+		aips     []*aip.Aip
+		sigmas   []*sigma.Sig
+		tx       *transaction.Transaction
+		signer   string
+		verified bool
+	}{
+		{"unsigned", nil, nil, tx, "", false},
+		{"AIP", []*aip.Aip{aipOf(signed.Data...)}, nil, tx, address, true},
+		{"AIP of other data", []*aip.Aip{aipOf(signed.Data[0], "bye")}, nil, tx, "", false},
+		{"SIGMA", nil, []*sigma.Sig{sig}, tx, sig.Address, true},
+		{"SIGMA of another input", nil, []*sigma.Sig{sig}, otherTx, "", false},
+		{"SIGMA without the tx", nil, []*sigma.Sig{sig}, nil, "", false},
+		{"one invalid signature", []*aip.Aip{aipOf(signed.Data...)}, []*sigma.Sig{sig}, otherTx, address, false},
+	}
+	for _, tt := range tests {
+		bmapData := &database.IndexerTx{Transaction: tt.tx}
+		bmapData.AIP, bmapData.Sigma = tt.aips, tt.sigmas
+		aips, sigmas, signer, verified := verifySignatures(bmapData)
+		if signer != tt.signer || verified != tt.verified {
+			t.Errorf("%s: signer %q, verified %v, want %q, %v", tt.name, signer, verified, tt.signer, tt.verified)
+		}
+		if len(aips) != len(tt.aips) || len(sigmas) != len(tt.sigmas) {
+			t.Errorf("%s: %d AIP and %d SIGMA records", tt.name, len(aips), len(sigmas))
+		}
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+	cfg := config.Default()
+	cfg.RequireSignature = []string{"post"}
+	doc := func(verified bool) map[string]interface{} {
+		d := line("tx", "post", 1)
+		d["MAP"] = []interface{}{
+			map[string]interface{}{"type": "post"},
+			map[string]interface{}{"type": "like"},
+		}
+		d["verified"] = verified
+		return d
+	}
+
+	for verified, want := range map[bool]string{true: "[post like]", false: "[like]"} {
+		collections, _, ok := prepareWrite(cfg, parsed(t, doc(verified)))
+		if got := fmt.Sprint(collections); !ok || got != want {
+			t.Errorf("verified %v: collections = %s, want %s", verified, got, want)
+		}
+	}
+	cfg.RequireSignature = []string{"post", "like"}
+	if _, _, ok := prepareWrite(cfg, parsed(t, doc(false))); ok {
+		t.Error("an unsigned tx was written")
+	}
+}
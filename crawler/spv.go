@@ -0,0 +1,128 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/database"
+	"github.com/rohenaz/go-bmap-indexer/spv"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// QuarantineCollection holds mined txs that failed SPV verification, when
+// config.SPVUnverified is quarantine
+const QuarantineCollection = "_quarantine"
+
+// errNoVerifier is returned when SPV is enabled but no verifier was given,
+// so no tx is written unchecked
+var errNoVerifier = errors.New("SPV is enabled but no verifier is open")
+
+// verifyTx checks the merkle proof of a mined tx, unless txs are trusted. It
+// returns false if the tx failed verification, in which case it has been
+// quarantined or rejected, and an error if it could not be checked.
+func verifyTx(d *Deps, cfg *config.Config, bmapData *database.IndexerTx, proof []byte) (bool, error) {
+	if cfg.SkipSPV {
+		return true, nil
+	}
+	v := d.Verifier
+	if v == nil {
+		return false, errNoVerifier
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	txid := bmapData.Tx.Tx.Tx.H
+	err := v.Verify(ctx, txid, bmapData.Blk.I, proof)
+	if err == nil {
+		bmapData.SPVVerified = true
+		return true, nil
+	} else if !errors.Is(err, spv.ErrUnverified) {
+		return false, err
+	}
+
+	log.Printf("%s[SPV]: %s tx %s in block %d: %v%s", chalk.Red, cfg.SPVUnverified, txid, bmapData.Blk.I, err, chalk.Reset)
+	if cfg.SPVUnverified != "quarantine" {
+		return false, nil
+	}
+
+	bsonData, prepErr := PrepareForIngestion(d, cfg, bmapData)
+	if prepErr != nil {
+		return false, prepErr
+	}
+	doc, prepErr := jsonDoc(bsonData)
+	if prepErr != nil {
+		return false, prepErr
+	}
+	return false, quarantine(ctx, d.Store, doc, txCollections(cfg, bmapData.MAP), err)
+}
+
+// verifyLine checks a mined doc read from a block file that was written
+// without SPV, fetching its merkle proof. Like verifyTx, it returns false if
+// the doc failed verification and was quarantined or rejected.
+func verifyLine(ctx context.Context, d *Deps, cfg *config.Config, doc bson.M) (bool, error) {
+	blk, _ := doc["blk"].(map[string]interface{})
+	height, _ := blk["i"].(float64)
+	if verified, _ := doc["spv_verified"].(bool); cfg.SkipSPV || verified || height == 0 {
+		return true, nil
+	}
+	v := d.Verifier
+	if v == nil {
+		return false, errNoVerifier
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	txid, _ := doc["_id"].(string)
+	err := v.Verify(ctx, txid, uint32(height), nil)
+	if err == nil {
+		doc["spv_verified"] = true
+		return true, nil
+	} else if !errors.Is(err, spv.ErrUnverified) {
+		return false, err
+	}
+
+	log.Printf("%s[SPV]: %s tx %s in block %.0f: %v%s", chalk.Red, cfg.SPVUnverified, txid, height, err, chalk.Reset)
+	if cfg.SPVUnverified != "quarantine" {
+		return false, nil
+	}
+	var collections []string
+	maps, _ := doc["MAP"].([]interface{})
+	for _, entry := range maps {
+		m, _ := entry.(map[string]interface{})
+		mapType, _ := m["type"].(string)
+		app, _ := m["app"].(string)
+		if collection, ok := cfg.Route(mapType, app); ok && !slices.Contains(collections, collection) {
+			collections = append(collections, collection)
+		}
+	}
+	return false, quarantine(ctx, d.Store, doc, collections, err)
+}
+
+// quarantine stores a doc that failed verification in s, with the reason
+func quarantine(ctx context.Context, s store.Store, doc bson.M, collections []string, reason error) error {
+	doc["spv_error"] = reason.Error()
+	doc["collections"] = collections
+	doc["quarantined_at"] = time.Now().Unix()
+	return s.UpsertTx(ctx, QuarantineCollection, doc)
+}
+
+// jsonDoc round trips a document through JSON, so it matches the documents
+// read back from block files
+func jsonDoc(bsonData bson.M) (bson.M, error) {
+	data, err := json.Marshal(bsonData)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = json.Unmarshal(data, &doc)
+	return doc, err
+}
@@ -0,0 +1,38 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+func TestVerifyLineWithoutVerifier(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	cfg.SkipSPV = false
+	ctx := context.Background()
+
+	// mempool txs and txs verified when they arrived need no proof
+	verified := parsed(t, line("v", "post", 5))
+	verified["spv_verified"] = true
+	for _, doc := range []map[string]interface{}{parsed(t, line("m", "post", 0)), verified} {
+		if ok, err := verifyLine(ctx, d, cfg, doc); !ok || err != nil {
+			t.Errorf("verifyLine(%s) = %v, %v", doc["_id"], ok, err)
+		}
+	}
+
+	// without a verifier a mined tx is not written unchecked
+	if ok, err := verifyLine(ctx, d, cfg, parsed(t, line("p", "post", 5))); ok || err != errNoVerifier {
+		t.Errorf("verifyLine = %v, %v, want errNoVerifier", ok, err)
+	}
+	data := inDataDir(t)
+	writeBlock(t, data, 5, line("p", "post", 5))
+	if err := commitBlock(ctx, d, cfg, &BlockState{Height: 5}); err == nil {
+		t.Error("a block was committed without a verifier")
+	}
+	if n := count(t, s, "post", store.Filter{}); n != 0 {
+		t.Errorf("%d posts written unchecked", n)
+	}
+}
@@ -2,29 +2,48 @@ package crawler
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/rohenaz/go-bmap-indexer/chat"
 	"github.com/rohenaz/go-bmap-indexer/config"
-	"github.com/rohenaz/go-bmap-indexer/database"
+	"github.com/rohenaz/go-bmap-indexer/feed"
+	"github.com/rohenaz/go-bmap-indexer/identity"
+	"github.com/rohenaz/go-bmap-indexer/reaction"
+	"github.com/rohenaz/go-bmap-indexer/store"
 	"github.com/ttacon/chalk"
 	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/exp/slices"
 )
 
-var CONCURRENT_INSERTS = 32
+// CONCURRENT_INSERTS caps the bulk writes in flight while ingesting a block
+var CONCURRENT_INSERTS = 8
+
+// BULK_BATCH_SIZE is the most documents sent in a single bulk write
+var BULK_BATCH_SIZE = 1000
 
 // Worker for processing files
-func Worker(readyFiles chan string) {
+func Worker(ctx context.Context, d *Deps, cfg *config.Config, readyFiles chan string) {
 	for filename := range readyFiles {
 		// Process the file
-		ingest(filename)
+		if err := ingest(ctx, d, cfg, filename); err != nil {
+			fmt.Printf("%sError ingesting %s: %v%s\n", chalk.Cyan, filename, err, chalk.Reset)
+			continue
+		}
 
 		// After successful import, delete the file
 		// in p2p mode, its deleted after saving to redis
-		if config.DeleteAfterIngest && !config.EnableP2P {
+		if cfg.DeleteAfterIngest && !cfg.EnableP2P {
 			fmt.Printf("%sDeleting file in crawler worker %s%s\n", chalk.Cyan, filename, chalk.Reset)
 			err := os.Remove(filename)
 			if err != nil {
@@ -34,13 +53,18 @@ func Worker(readyFiles chan string) {
 	}
 }
 
-// ingest JSONLD file and ingest each line as a mongo document
-func ingest(filepath string) {
+// readBlockFile parses each line of a JSONLD block file, calling fn with the
+// write of each document for every collection it is routed to. BAP records
+// are applied to ids in order, signed documents get the identity of their
+// signer and direct messages their conversation. Mined txs written without
+// SPV are verified when it is enabled. It stops early if ctx is cancelled.
+// Lines that cannot be parsed or verified are skipped and returned as errors
+// once the whole file is read, and txs that fail verification are dropped.
+func readBlockFile(ctx context.Context, d *Deps, cfg *config.Config, filepath string, ids *identity.Batch, fn func(collection string, w store.Write)) (docs int, err error) {
 	// Open the file
 	file, err := os.Open(filepath)
 	if err != nil {
-		log.Panicf("%s%s %s: %v%s\n", chalk.Cyan, "Error opening file", filepath, err, chalk.Reset)
-		return
+		return 0, fmt.Errorf("opening %s: %w", filepath, err)
 	}
 	defer file.Close()
 
@@ -49,127 +73,400 @@ func ingest(filepath string) {
 	buf := make([]byte, 0, 64*1024)
 	scanner.Buffer(buf, 10*1024*1024) // set the buffer to 10MB
 
-	var wg sync.WaitGroup
-	limiter := make(chan struct{}, CONCURRENT_INSERTS)
-	for scanner.Scan() {
-		// 1 - read each string line from the file path
-		line := scanner.Text()
-
-		// 2 - unmarshal into bmap
+	var errs []error
+	for lineNum := 1; ctx.Err() == nil && scanner.Scan(); lineNum++ {
 		var bsonData bson.M
-		byteLine := []byte(line)
-		err := json.Unmarshal(byteLine, &bsonData)
-		if err != nil {
-			log.Panicf("%s[Error]: %s%s\n", chalk.Cyan, err, chalk.Reset)
+		if err := json.Unmarshal(scanner.Bytes(), &bsonData); err != nil {
+			errs = append(errs, fmt.Errorf("%s line %d: %w", filepath, lineNum, err))
+			continue
 		}
+		if ok, err := verifyLine(ctx, d, cfg, bsonData); err != nil {
+			errs = append(errs, fmt.Errorf("%s line %d: %w", filepath, lineNum, err))
+			continue
+		} else if !ok {
+			continue
+		}
+		if err := ids.Add(ctx, bsonData, lineNum); err != nil {
+			errs = append(errs, fmt.Errorf("%s line %d: %w", filepath, lineNum, err))
+		}
+		if err := ids.Enrich(ctx, bsonData); err != nil {
+			errs = append(errs, fmt.Errorf("%s line %d: %w", filepath, lineNum, err))
+		}
+		chat.Enrich(bsonData)
+		if collections, w, ok := prepareWrite(cfg, bsonData); ok {
+			docs++
+			for _, collection := range collections {
+				fn(collection, w)
+			}
+		}
+	}
+
+	// Check for errors in the scanner
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("reading %s: %w", filepath, err))
+	}
+	return docs, errors.Join(errs...)
+}
+
+// ingest JSONLD file and upsert each line as a document. Lines are grouped
+// by collection and written in unordered bulk writes of up to
+// BULK_BATCH_SIZE, so re-ingesting a file is harmless. If ctx is cancelled
+// part way through, the writes in flight are finished and ctx.Err() is
+// returned.
+func ingest(ctx context.Context, d *Deps, cfg *config.Config, filepath string) error {
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var errs []error
+	fail := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		errs = append(errs, err)
+	}
 
+	limiter := make(chan struct{}, CONCURRENT_INSERTS)
+	flush := func(collection string, writes []store.Write) {
 		limiter <- struct{}{}
 		wg.Add(1)
-		go func(bsonData *bson.M) {
+		go func() {
 			defer func() {
 				<-limiter
 				wg.Done()
 			}()
-			saveTransaction(*bsonData)
-		}(&bsonData)
+			// the writes are not tied to ctx so a batch is never half sent
+			if err := recordCollections(context.Background(), d.Store, []string{collection}); err != nil {
+				fail(fmt.Errorf("recording collection %s: %w", collection, err))
+				return
+			}
+			if err := d.Store.UpsertTxs(context.Background(), collection, writes); err != nil {
+				fail(fmt.Errorf("writing %d documents to %s: %w", len(writes), collection, err))
+				return
+			}
+			publish(collection, writes)
+		}()
 	}
 
+	batches := map[string][]store.Write{}
+	ids := identity.NewBatch(d.Store)
+	reactions := reaction.NewBatch(d.Store)
+	index := newIndexers(d)
+	docs, err := readBlockFile(ctx, d, cfg, filepath, ids, func(collection string, w store.Write) {
+		reactions.Add(w.Doc)
+		index.Add(collection, w)
+		batches[collection] = append(batches[collection], w)
+		if len(batches[collection]) >= BULK_BATCH_SIZE {
+			flush(collection, batches[collection])
+			delete(batches, collection)
+		}
+	})
+	if err != nil {
+		fail(err)
+	}
+
+	// send the partial batches
+	if ctx.Err() == nil {
+		for collection, writes := range batches {
+			flush(collection, writes)
+		}
+	}
 	wg.Wait()
 
-	// Check for errors in the scanner
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("%sError reading file %s: %v%s\n", chalk.Cyan, filepath, err, chalk.Reset)
-		return
+	// identities and reactions are only written once the whole file was read
+	if ctx.Err() == nil && len(errs) == 0 {
+		derived, err := derivedWrites(context.Background(), ids, reactions)
+		if err != nil {
+			fail(err)
+		}
+		for collection, writes := range derived {
+			if err = d.Store.UpsertTxs(context.Background(), collection, writes); err != nil {
+				fail(fmt.Errorf("writing %d documents to %s: %w", len(writes), collection, err))
+				continue
+			}
+			publish(collection, writes)
+		}
+		if err := index.Index(context.Background()); err != nil {
+			fail(err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ingesting %s: %w", filepath, errors.Join(errs...))
 	}
+	logThroughput(docs, filepath, start)
+	return nil
 }
 
-func saveTransaction(bsonData bson.M) {
-	// 2.1 - get the collection name
-	// panic: interface conversion: interface {} is []interface {}, not primitive.M
-	// TODO: This only works if the metadata is in output idx 0
-	collectionName, ok := bsonData["MAP"].([]interface{})[0].(map[string]interface{})["type"].(string)
+// commitBlock writes the block file together with the block's hash, the
+// collections it writes to and the progress update, so the saved height
+// never disagrees with the data. Nothing is written if the file cannot be
+// read in full.
+func commitBlock(ctx context.Context, d *Deps, cfg *config.Config, block *BlockState) error {
+	start := time.Now()
+	height := block.Height
+	filepath := fmt.Sprintf("data/%d.json", height)
 
-	if !ok {
-		log.Printf("%s[Error]: %s%s\n", chalk.Cyan, "Could not get collection name", chalk.Reset)
-		return
+	writes := map[string][]store.Write{}
+	ids := identity.NewBatch(d.Store)
+	reactions := reaction.NewBatch(d.Store)
+	index := newIndexers(d)
+	docs, err := readBlockFile(ctx, d, cfg, filepath, ids, func(collection string, w store.Write) {
+		reactions.Add(w.Doc)
+		index.Add(collection, w)
+		writes[collection] = append(writes[collection], w)
+	})
+	// a block whose every tx failed has no file, and is committed empty
+	if errors.Is(err, fs.ErrNotExist) && len(block.FailedTxs) > 0 {
+		err = nil
+	}
+	if len(writes) > 0 {
+		routed := make([]string, 0, len(writes))
+		for collection := range writes {
+			routed = append(routed, collection)
+		}
+		writes[CollectionsCollection] = collectionWrites(routed)
+	}
+	if err == nil {
+		var derived map[string][]store.Write
+		derived, err = derivedWrites(ctx, ids, reactions)
+		for collection, w := range derived {
+			writes[collection] = append(writes[collection], w...)
+		}
+	}
+	if block.Hash != "" {
+		writes[BlocksCollection] = []store.Write{{Doc: store.Doc{
+			"_id":    height,
+			"height": height,
+			"hash":   block.Hash,
+			"txs":    docs,
+		}}}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-
-	log.Println("ingesting to collectionName", collectionName)
-	// 2.5 find existing record in the db
-	existing, err := GetExistingDoc(collectionName, bsonData["_id"].(string))
 	if err != nil {
-		log.Printf("%s[Error]: %s%s\n", chalk.Cyan, err, chalk.Reset)
+		return fmt.Errorf("reading block %d: %w", height, err)
 	}
-	if (existing == nil || existing.Timestamp == 0) && bsonData["timestamp"] == nil && bsonData["blk"] != nil {
-		// use the block time if theres no timestamp
-		bsonData["timestamp"] = bsonData["blk"].(map[string]interface{})["t"].(float64)
+
+	// the commit is not tied to ctx so a block is never half written
+	if err = d.Store.CommitBlock(context.Background(), height, writes); err != nil {
+		return fmt.Errorf("committing block %d: %w", height, err)
+	}
+	for collection, w := range writes {
+		publish(collection, w)
 	}
+	// the posts are in the store, so replies can be linked to them. The
+	// indexes are rebuilt from the stored docs, so a block that fails here
+	// is committed again by its retry.
+	if err = index.Index(context.Background()); err != nil {
+		return fmt.Errorf("block %d: %w", height, err)
+	}
+	logThroughput(docs, filepath, start)
+	return nil
+}
 
-	// 3 - insert into mongo
-	err = saveToMongo(&bsonData)
+// derivedWrites returns the writes of the identities and reaction
+// aggregates a block file changes, by collection
+func derivedWrites(ctx context.Context, ids *identity.Batch, reactions *reaction.Batch) (map[string][]store.Write, error) {
+	writes, err := ids.Writes()
 	if err != nil {
-		log.Panicf("%s[Error]: %s%s\n", chalk.Cyan, err, chalk.Reset)
+		return nil, err
 	}
+	reactionWrites, err := reactions.Writes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("aggregating reactions: %w", err)
+	}
+	for collection, w := range reactionWrites {
+		writes[collection] = append(writes[collection], w...)
+	}
+	return writes, nil
 }
 
-// GetExistingDoc returns a document from the txs collection
-func GetExistingDoc(collectionName string, txid string) (*database.IndexerTx, error) {
-	conn := database.GetConnection()
-	filter := bson.M{"_id": txid}
+func logThroughput(docs int, filepath string, start time.Time) {
+	elapsed := time.Since(start)
+	log.Printf("%sWrote %d docs from %s in %s (%.0f docs/s)%s", chalk.Cyan, docs, filepath,
+		elapsed.Round(time.Millisecond), float64(docs)/elapsed.Seconds(), chalk.Reset)
+}
 
-	bmapTx, err := conn.GetDocs(collectionName, 1, 0, filter)
-	if err != nil {
-		return nil, err
+// saveTransaction upserts a single document, as ingest does for a whole file
+func saveTransaction(d *Deps, cfg *config.Config, bsonData bson.M) error {
+	// mempool txs do not change identities, but are tied to them
+	if err := identity.NewBatch(d.Store).Enrich(context.Background(), bsonData); err != nil {
+		return err
+	}
+	chat.Enrich(bsonData)
+	collections, w, ok := prepareWrite(cfg, bsonData)
+	if !ok {
+		return nil
 	}
-	if len(bmapTx) == 0 {
-		return nil, nil
+	if err := recordCollections(context.Background(), d.Store, collections); err != nil {
+		return err
 	}
-	return &bmapTx[0], nil
+	writes := []store.Write{w}
+	index := newIndexers(d)
+	for _, collection := range collections {
+		if err := d.Store.UpsertTxs(context.Background(), collection, writes); err != nil {
+			return err
+		}
+		publish(collection, writes)
+		index.Add(collection, w)
+	}
+	return index.Index(context.Background())
 }
 
-func saveToMongo(bsonData *bson.M) (err error) {
-	conn := database.GetConnection()
-	// if len(bmapData.MAP) == 0 || len(bmapData.MAP[0]) == 0 {
-	// 	return fmt.Errorf("No MAP data")
-	// }
-	// _, ok := bmapData.MAP[0]["app"].(string)
-	// if !ok {
-	// 	return fmt.Errorf("MAP 'app' key does not exist")
-	// }
-
-	// I'm getting an error that this is nil not a string
-	// 	panic: interface conversion: interface {} is nil, not string
-
-	// goroutine 33 [running]:
-	// github.com/rohenaz/go-bmap-indexer/crawler.saveToMongo(0xc000560088)
-	//         /Users/satchmo/code/go-bmap-indexer/crawler/worker.go:99 +0x165
-
-	var collectionName string
-	var ok bool
-	if collectionName, ok = (*bsonData)["collection"].(string); !ok {
+// publish sends written documents to the live feed. Defaults are filled in
+// as if the documents were new, since the stored values are not read back.
+func publish(collection string, writes []store.Write) {
+	if strings.HasPrefix(collection, "_") {
+		// internal collections like _blocks are not part of the feed
 		return
 	}
-	delete(*bsonData, "collection")
+	for _, w := range writes {
+		doc := make(store.Doc, len(w.Doc)+len(w.Defaults))
+		for k, v := range w.Defaults {
+			doc[k] = v
+		}
+		for k, v := range w.Doc {
+			doc[k] = v
+		}
+		feed.Publish(collection, doc)
+	}
+}
 
-	filter := bson.M{"_id": (*bsonData)["_id"]}
+// prepareWrite returns the collections a document is routed to and the write
+// that stores it, with its lifecycle status. Every MAP entry is routed with
+// config.Route, so a tx with several MAP payloads can be written to several
+// collections. Times that must survive later writes, like when the tx was
+// first seen, are defaults so they are resolved without having to read the
+// existing document. Collections listed in require_signature are left out
+// unless the tx is verified.
+func prepareWrite(cfg *config.Config, bsonData bson.M) (collections []string, w store.Write, ok bool) {
+	typed := false
+	maps, _ := bsonData["MAP"].([]interface{})
+	for _, entry := range maps {
+		m, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		mapType, _ := m["type"].(string)
+		app, _ := m["app"].(string)
+		typed = typed || mapType != ""
+		if collection, ok := cfg.Route(mapType, app); ok && !slices.Contains(collections, collection) {
+			collections = append(collections, collection)
+		}
+	}
 
-	// bsonData := bson.M{
-	// 	"_id": filter["_id"],
-	// 	"tx":  bmapData.Tx,
-	// 	"blk": bmapData.Blk,
-	// 	"MAP": bmapData.MAP,
-	// }
+	// collections that require a signature only get validly signed txs
+	if verified, _ := bsonData["verified"].(bool); !verified {
+		collections = slices.DeleteFunc(collections, func(collection string) bool {
+			if slices.Contains(cfg.RequireSignature, collection) {
+				log.Printf("%s[INFO]: Skipping %s for %s, it is not validly signed%s", chalk.Yellow, bsonData["_id"], collection, chalk.Reset)
+				return true
+			}
+			return false
+		})
+	}
 
-	// if bmapData.AIP != nil {
-	// 	bsonData["AIP"] = bmapData.AIP
-	// }
+	if !typed {
+		log.Printf("%s[Error]: %s%s\n", chalk.Cyan, "Could not get collection name", chalk.Reset)
+	}
+	if len(collections) == 0 {
+		return nil, w, false
+	}
+	delete(bsonData, "collection")
 
-	// if bmapData.B != nil {
-	// 	bsonData["B"] = bmapData.B
-	// }
+	w.Doc = bsonData
+	blk, _ := bsonData["blk"].(map[string]interface{})
+	if height, _ := blk["i"].(float64); height == 0 {
+		// a mempool tx must not undo a confirmation, so it only fills in
+		// what the document does not have yet
+		seen, ok := bsonData["timestamp"].(float64)
+		if !ok {
+			seen = float64(time.Now().Unix())
+		}
+		delete(bsonData, "blk")
+		delete(bsonData, "timestamp")
+		w.Defaults = store.Doc{"status": StatusMempool, "first_seen": seen, "timestamp": seen}
+		return collections, w, true
+	}
 
-	// log.Println("Inserting into collection", collectionName)
-	_, err = conn.UpsertOne(collectionName, filter, *bsonData)
+	blockTime, _ := blk["t"].(float64)
+	bsonData["status"] = StatusConfirmed
+	bsonData["confirmed_at"] = blockTime
+	w.Defaults = store.Doc{"first_seen": blockTime}
+	if bsonData["timestamp"] == nil {
+		// use the block time if theres no timestamp
+		w.Defaults["timestamp"] = blockTime
+	}
+	return collections, w, true
+}
+
+// IngestPath ingests a single block file, or every block file in a directory
+// in block height order
+func IngestPath(ctx context.Context, d *Deps, cfg *config.Config, path string) (files int, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return 1, ingest(ctx, d, cfg, path)
+	}
+
+	heights, err := blockFiles(path)
+	if err != nil {
+		return 0, err
+	}
+	for _, height := range heights {
+		if err = ingest(ctx, d, cfg, filepath.Join(path, fmt.Sprintf("%d.json", height))); err != nil {
+			return files, err
+		}
+		files++
+	}
+	return files, nil
+}
 
-	return
+// Reindex re-ingests the local block files for every height in [from, to]
+func Reindex(ctx context.Context, d *Deps, cfg *config.Config, from uint32, to uint32) (blocks int, err error) {
+	if to < from {
+		return 0, fmt.Errorf("invalid range %d-%d", from, to)
+	}
+	heights, err := blockFiles("data")
+	if err != nil {
+		return 0, err
+	}
+	for _, height := range heights {
+		if height < from || height > to {
+			continue
+		}
+		log.Printf("%sReindexing block %d%s", chalk.Cyan, height, chalk.Reset)
+		if err = ingest(ctx, d, cfg, fmt.Sprintf("data/%d.json", height)); err != nil {
+			return blocks, err
+		}
+		blocks++
+	}
+	return blocks, nil
+}
+
+// blockFiles returns the heights of the <height>.json files in dir, sorted
+func blockFiles(dir string) (heights []uint32, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		height, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 32)
+		if err != nil {
+			continue
+		}
+		heights = append(heights, uint32(height))
+	}
+	slices.Sort(heights)
+	return heights, nil
 }
@@ -0,0 +1,146 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// line is a doc of a block file with one MAP entry, mined at height unless
+// it is 0
+func line(txid string, mapType string, height int) map[string]interface{} {
+	doc := map[string]interface{}{
+		"_id": txid,
+		"MAP": []interface{}{map[string]interface{}{"type": mapType, "app": "bsocial"}},
+	}
+	if height > 0 {
+		doc["blk"] = map[string]interface{}{"i": height, "t": 1000 + height}
+	}
+	return doc
+}
+
+// writeBlock writes the docs as the block file of height in dir. A string
+// is written as it is, for a line that does not parse.
+func writeBlock(t *testing.T, dir string, height uint32, lines ...interface{}) string {
+	t.Helper()
+	var data []byte
+	for _, l := range lines {
+		raw, ok := l.(string)
+		if !ok {
+			encoded, err := json.Marshal(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw = string(encoded)
+		}
+		data = append(data, raw+"\n"...)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d.json", height))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func count(t *testing.T, s store.Store, collection string, filter store.Filter) int64 {
+	t.Helper()
+	n, err := s.Count(context.Background(), collection, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestIngest(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	d := &Deps{Store: s}
+	ctx := context.Background()
+	defer func(size int) { BULK_BATCH_SIZE = size }(BULK_BATCH_SIZE)
+	BULK_BATCH_SIZE = 2
+
+	dir := t.TempDir()
+	lines := []interface{}{line("p1", "post", 1), line("p2", "post", 1), line("p3", "post", 1), line("l1", "like", 1), line("p4", "post", 1)}
+	path := writeBlock(t, dir, 1, append(lines, "{not json")...)
+
+	// the lines that parse are written, and the bad one is reported
+	if err := ingest(ctx, d, cfg, path); err == nil {
+		t.Error("ingesting a file with a bad line did not fail")
+	}
+	if n := count(t, s, "post", store.Filter{}); n != 4 {
+		t.Errorf("%d posts, want 4", n)
+	}
+
+	// ingesting again is harmless
+	writeBlock(t, dir, 1, lines...)
+	if err := ingest(ctx, d, cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	if posts, likes := count(t, s, "post", store.Filter{}), count(t, s, "like", store.Filter{}); posts != 4 || likes != 1 {
+		t.Errorf("%d posts and %d likes, want 4 and 1", posts, likes)
+	}
+
+	// a cancelled ingest stops
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := ingest(cancelled, d, cfg, path); err != context.Canceled {
+		t.Errorf("cancelled ingest = %v, want context.Canceled", err)
+	}
+}
+
+func TestIngestPath(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	dir := t.TempDir()
+	writeBlock(t, dir, 10, line("b", "post", 10))
+	writeBlock(t, dir, 9, line("a", "post", 9))
+	if err := os.WriteFile(filepath.Join(dir, "notes.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	heights, err := blockFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(heights) != "[9 10]" {
+		t.Errorf("block files = %v, want [9 10]", heights)
+	}
+	files, err := IngestPath(context.Background(), &Deps{Store: s}, cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 2 || count(t, s, "post", store.Filter{}) != 2 {
+		t.Errorf("ingested %d files, %d posts", files, count(t, s, "post", store.Filter{}))
+	}
+}
+
+func TestIngestRoutes(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	cfg.Routes = []config.Route{
+		{Type: "post", App: "treechat", Collection: "treechat_posts"},
+		{Type: "like", Ignore: true},
+	}
+
+	// a tx with several MAP entries is written to each of their collections
+	multi := line("m1", "post", 1)
+	multi["MAP"] = []interface{}{
+		map[string]interface{}{"type": "post", "app": "treechat"},
+		map[string]interface{}{"type": "post", "app": "bsocial"},
+		map[string]interface{}{"type": "like", "app": "bsocial"},
+	}
+	// a tx of a reserved type is not written over the indexer state
+	path := writeBlock(t, t.TempDir(), 1, multi, line("l1", "like", 1), line("h1", "_headers", 1))
+	if err := ingest(context.Background(), &Deps{Store: s}, cfg, path); err != nil {
+		t.Fatal(err)
+	}
+	for collection, want := range map[string]int64{"treechat_posts": 1, "post": 1, "like": 0, "_headers": 0} {
+		if n := count(t, s, collection, store.Filter{}); n != want {
+			t.Errorf("%d docs in %s, want %d", n, collection, want)
+		}
+	}
+}
@@ -4,10 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
+	"github.com/bitcoin-sv/go-sdk/transaction"
 	"github.com/bitcoinschema/go-bmap"
+	"github.com/rohenaz/go-bmap-indexer/config"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -15,11 +16,18 @@ import (
 
 type IndexerTx struct {
 	bmap.Tx
-	Timestamp int64 `json:"timestamp"`
+	Timestamp   int64  `json:"timestamp"`
+	BlockHash   string `json:"-" bson:"-"`
+	SPVVerified bool   `json:"-" bson:"-"` // the merkle proof of the tx was checked
+
+	Transaction *transaction.Transaction `json:"-" bson:"-"` // the parsed tx, needed to check SIGMA signatures
 }
 
 const databaseName = "bmap"
 
+// Name of the mongo database the indexer writes to
+const Name = databaseName
+
 // Connection is a mongo client
 type Connection struct {
 	*mongo.Client
@@ -28,10 +36,10 @@ type Connection struct {
 var globalClient *Connection
 
 // Connect establishes a connection to the mongo db
-func Connect() error {
-	bmapMongoURL := os.Getenv("MONGO_URL")
+func Connect(cfg *config.Config) error {
+	bmapMongoURL := cfg.MongoURL
 	if len(bmapMongoURL) == 0 {
-		return fmt.Errorf("set MONGO_URL before running %s", bmapMongoURL)
+		return fmt.Errorf("set MONGO_URL before running")
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -59,27 +67,36 @@ func Connect() error {
 	return nil
 }
 
+// Disconnect closes the connection established by Connect
+func Disconnect(ctx context.Context) error {
+	if globalClient == nil {
+		return nil
+	}
+	err := globalClient.Disconnect(ctx)
+	globalClient = nil
+	return err
+}
+
+// GetConnection returns the connection established by Connect
 func GetConnection() *Connection {
 	if globalClient == nil {
-		log.Println("Connecting to mongo")
-		err := Connect()
-		if err != nil {
-			log.Fatal(err)
-		}
+		log.Fatal("database.Connect must be called before using the database")
 	}
 	return globalClient
 }
 
 func (c *Connection) ClearState() error {
 	collection := c.Database(databaseName).Collection("c")
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	return collection.Drop(ctx)
 }
 
 // GetDocs gets a number of documents for a given collection
 func (c *Connection) GetDocs(collectionName string, limit int64, skip int64, filter bson.M) ([]IndexerTx, error) {
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	cur, err := collection.Find(ctx, filter, &options.FindOptions{
 		Skip:  &skip,
 		Limit: &limit,
@@ -108,7 +125,8 @@ func (c *Connection) GetDocs(collectionName string, limit int64, skip int64, fil
 // GetStateDocs gets a number of documents for a given state collection
 func (c *Connection) GetStateDocs(collectionName string, limit int64, skip int64, filter bson.M) ([]bson.M, error) {
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	cur, err := collection.Find(ctx, filter, &options.FindOptions{
 		Skip:  &skip,
 		Limit: &limit,
@@ -138,7 +156,8 @@ func (c *Connection) GetStateDocs(collectionName string, limit int64, skip int64
 func (c *Connection) InsertOne(collectionName string, data bson.M) (interface{}, error) {
 
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	res, err := collection.InsertOne(ctx, data)
 	if err != nil {
 		return 0, err
@@ -152,7 +171,8 @@ func (c *Connection) InsertOne(collectionName string, data bson.M) (interface{},
 func (c *Connection) Update(collectionName string, filter interface{}, update bson.M) (interface{}, error) {
 
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	res, err := collection.UpdateMany(ctx, filter, update)
 	if err != nil {
 		return 0, err
@@ -166,7 +186,8 @@ func (c *Connection) Update(collectionName string, filter interface{}, update bs
 func (c *Connection) UpsertOne(collectionName string, filter interface{}, data bson.M) (interface{}, error) {
 
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	opts := options.Update().SetUpsert(true)
 
 	update := bson.M{"$set": data}
@@ -183,7 +204,8 @@ func (c *Connection) UpsertOne(collectionName string, filter interface{}, data b
 func (c *Connection) Upsert(collectionName string, filter interface{}, update bson.M) (interface{}, error) {
 
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	opts := options.Update().SetUpsert(true)
 
 	res, err := collection.UpdateOne(ctx, filter, update, opts)
@@ -194,10 +216,20 @@ func (c *Connection) Upsert(collectionName string, filter interface{}, update bs
 	return res.UpsertedID, nil
 }
 
+// DeleteOne removes the first document matching filter from the provided collection
+func (c *Connection) DeleteOne(collectionName string, filter interface{}) error {
+	collection := c.Database(databaseName).Collection(collectionName)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := collection.DeleteOne(ctx, filter)
+	return err
+}
+
 // CountCollectionDocs returns the number of records in a given colletion
 func (c *Connection) CountCollectionDocs(collectionName string, filter bson.M) (int64, error) {
 	collection := c.Database(databaseName).Collection(collectionName)
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	count, err := collection.CountDocuments(ctx, filter)
 	if err != nil {
 		return 0, err
@@ -0,0 +1,89 @@
+// Package feed fans newly written documents out to live subscribers
+package feed
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Event is a document written to a collection
+type Event struct {
+	Collection string    `json:"collection"`
+	Doc        store.Doc `json:"doc"`
+}
+
+// ErrSlowSubscriber closes a subscription that fell a full buffer behind.
+// The subscriber can resume from the last event it received.
+var ErrSlowSubscriber = errors.New("subscriber too slow, resume from the last event received")
+
+// Subscription receives the published events its match function accepts
+type Subscription struct {
+	C <-chan Event
+
+	c     chan Event
+	match func(Event) bool
+	once  sync.Once
+	err   error
+}
+
+var (
+	mu            sync.Mutex
+	subscriptions = map[*Subscription]struct{}{}
+)
+
+// Subscribe returns a subscription buffering up to buffer events. Events
+// are never blocked on a subscriber: one whose buffer is full is closed with
+// ErrSlowSubscriber.
+func Subscribe(buffer int, match func(Event) bool) *Subscription {
+	c := make(chan Event, buffer)
+	sub := &Subscription{C: c, c: c, match: match}
+
+	mu.Lock()
+	defer mu.Unlock()
+	subscriptions[sub] = struct{}{}
+	return sub
+}
+
+// Publish sends an event to every matching subscriber
+func Publish(collection string, doc store.Doc) {
+	event := Event{Collection: collection, Doc: doc}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for sub := range subscriptions {
+		if sub.match != nil && !sub.match(event) {
+			continue
+		}
+		select {
+		case sub.c <- event:
+		default:
+			sub.close(ErrSlowSubscriber)
+		}
+	}
+}
+
+// Close stops the subscription. C is closed once the buffered events are
+// received.
+func (s *Subscription) Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	s.close(nil)
+}
+
+// Err returns why the subscription was closed, once C is closed
+func (s *Subscription) Err() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return s.err
+}
+
+// close must be called with mu held
+func (s *Subscription) close(err error) {
+	s.once.Do(func() {
+		delete(subscriptions, s)
+		s.err = err
+		close(s.c)
+	})
+}
@@ -0,0 +1,119 @@
+package headers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+)
+
+// Size is the size of a serialized block header
+const Size = 80
+
+// Header is a block header at a known height
+type Header struct {
+	Height     uint32
+	Hash       chainhash.Hash
+	Prev       chainhash.Hash
+	MerkleRoot chainhash.Hash
+	Version    uint32
+	Time       uint32
+	Bits       uint32
+	Nonce      uint32
+	Chainwork  *big.Int // work of the chain up to and including this header
+}
+
+// ParseHeader reads a serialized header, computing its hash
+func ParseHeader(height uint32, raw []byte) (*Header, error) {
+	if len(raw) != Size {
+		return nil, fmt.Errorf("header is %d bytes, not %d", len(raw), Size)
+	}
+	h := &Header{
+		Height:  height,
+		Version: binary.LittleEndian.Uint32(raw[0:4]),
+		Time:    binary.LittleEndian.Uint32(raw[68:72]),
+		Bits:    binary.LittleEndian.Uint32(raw[72:76]),
+		Nonce:   binary.LittleEndian.Uint32(raw[76:80]),
+	}
+	copy(h.Prev[:], raw[4:36])
+	copy(h.MerkleRoot[:], raw[36:68])
+	h.Hash = chainhash.DoubleHashH(raw)
+	return h, nil
+}
+
+// Bytes serializes the header
+func (h *Header) Bytes() []byte {
+	raw := make([]byte, Size)
+	binary.LittleEndian.PutUint32(raw[0:4], h.Version)
+	copy(raw[4:36], h.Prev[:])
+	copy(raw[36:68], h.MerkleRoot[:])
+	binary.LittleEndian.PutUint32(raw[68:72], h.Time)
+	binary.LittleEndian.PutUint32(raw[72:76], h.Bits)
+	binary.LittleEndian.PutUint32(raw[76:80], h.Nonce)
+	return raw
+}
+
+// check verifies the header hashes to its hash, and that the hash meets the
+// target of its bits
+func (h *Header) check() error {
+	if hash := chainhash.DoubleHashH(h.Bytes()); hash != h.Hash {
+		return fmt.Errorf("header %d hashes to %s, not %s", h.Height, hash, h.Hash)
+	}
+	return h.checkWork()
+}
+
+// checkWork verifies the hash meets the target of the header's bits
+func (h *Header) checkWork() error {
+	target := compactToBig(h.Bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("header %d has an invalid target", h.Height)
+	}
+	if hashToBig(h.Hash).Cmp(target) > 0 {
+		return fmt.Errorf("header %d does not meet its proof of work target", h.Height)
+	}
+	return nil
+}
+
+// work is the expected number of hashes needed to mine a block with bits,
+// 2^256 / (target + 1)
+func work(bits uint32) *big.Int {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// compactToBig expands the compact target of a header's bits
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	negative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var n *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		n = big.NewInt(int64(mantissa))
+	} else {
+		n = big.NewInt(int64(mantissa))
+		n.Lsh(n, 8*(exponent-3))
+	}
+	if negative {
+		n = n.Neg(n)
+	}
+	return n
+}
+
+// hashToBig reads a hash, stored little endian, as a number
+func hashToBig(hash chainhash.Hash) *big.Int {
+	var be [chainhash.HashSize]byte
+	for i := range hash {
+		be[i] = hash[chainhash.HashSize-1-i]
+	}
+	return new(big.Int).SetBytes(be[:])
+}
+
+var errUnlinked = errors.New("header does not link to the chain")
@@ -0,0 +1,335 @@
+// Package headers keeps the block headers of the main chain, checking that
+// they link together and meet their proof of work, so the indexer knows the
+// chain tip and which blocks are on the main chain
+package headers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+)
+
+// Collection holds the headers, keyed by height
+const Collection = "_headers"
+
+// ErrNotSynced is wrapped by the errors for heights past the tip, whose
+// headers have not been synced yet
+var ErrNotSynced = errors.New("header not synced yet")
+
+// Chain is a run of consecutive headers. The first header is trusted as a
+// checkpoint, every later one must link to the one before it.
+type Chain struct {
+	mu      sync.RWMutex
+	headers []*Header
+	byHash  map[chainhash.Hash]uint32
+	s       store.Store
+
+	refresh   chan struct{} // asks Sync to fetch now, nil if Sync is not running
+	fetched   chan struct{} // closed and replaced after every fetch
+	fetchedAt time.Time
+}
+
+// Open loads the headers saved in s, then adds the headers of
+// cfg.HeadersFile if there is one. The chain saves the headers it adds to s.
+func Open(ctx context.Context, cfg *config.Config, s store.Store) (*Chain, error) {
+	c := &Chain{byHash: map[chainhash.Hash]uint32{}, s: s, fetched: make(chan struct{})}
+
+	var saved []*Header
+	q := store.Query{SortBy: "_id"}
+	err := store.Each(ctx, s, Collection, q, func(doc store.Doc) error {
+		h, err := fromDoc(doc)
+		if err != nil {
+			return err
+		}
+		saved = append(saved, h)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("loading headers: %w", err)
+	}
+	if _, _, err = c.add(saved); err != nil {
+		return nil, fmt.Errorf("loading headers: %w", err)
+	}
+
+	if cfg.HeadersFile != "" {
+		file, err := ReadFile(cfg.HeadersFile, cfg.HeadersFileStart)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = c.Add(ctx, file); err != nil {
+			return nil, fmt.Errorf("adding %s: %w", cfg.HeadersFile, err)
+		}
+	}
+
+	return c, nil
+}
+
+// SavedTip returns the height of the last header saved in s, without
+// loading the chain
+func SavedTip(ctx context.Context, s store.Store) (height uint32, ok bool, err error) {
+	docs, err := s.Query(ctx, Collection, store.Query{SortBy: "_id", SortDesc: true, Limit: 1})
+	if err != nil || len(docs) == 0 {
+		return 0, false, err
+	}
+	return uint32(store.ToInt(docs[0]["_id"])), true, nil
+}
+
+// ReadFile reads a file of consecutive serialized headers, the first of which
+// is the block at height start
+func ReadFile(path string, start uint32) ([]*Header, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%Size != 0 {
+		return nil, fmt.Errorf("%s is not a file of %d byte headers", path, Size)
+	}
+	headers := make([]*Header, 0, len(data)/Size)
+	for i := 0; i < len(data); i += Size {
+		h, err := ParseHeader(start+uint32(i/Size), data[i:i+Size])
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+// Add checks the headers, which must be in height order, and adds them to the
+// chain, saving them to the store. A header that replaces one at the same
+// height orphans the headers from there up, as long as the new chain has at
+// least as much work. It returns the lowest height replaced, or 0.
+func (c *Chain) Add(ctx context.Context, headers []*Header) (reorgHeight uint32, err error) {
+	c.mu.Lock()
+	tip := c.tip()
+	c.mu.Unlock()
+
+	added, reorgHeight, err := c.add(headers)
+	if err != nil {
+		return 0, err
+	}
+	newTip := c.TipHeight()
+
+	for i := 0; i < len(added); i += 1000 {
+		writes := make([]store.Write, 0, 1000)
+		for _, h := range added[i:min(i+1000, len(added))] {
+			writes = append(writes, store.Write{Doc: toDoc(h)})
+		}
+		if err = c.s.UpsertTxs(ctx, Collection, writes); err != nil {
+			return reorgHeight, err
+		}
+	}
+	for height := newTip + 1; height <= tip; height++ {
+		if err = c.s.DeleteTx(ctx, Collection, int64(height)); err != nil {
+			return reorgHeight, err
+		}
+	}
+	if reorgHeight > 0 {
+		log.Printf("%s[HEADERS]: headers from %d replaced, tip is now %d%s", chalk.Yellow, reorgHeight, newTip, chalk.Reset)
+	}
+	return reorgHeight, nil
+}
+
+// add applies headers in memory, returning the ones that were new. The chain
+// is left unchanged on error.
+func (c *Chain) add(headers []*Header) (added []*Header, reorgHeight uint32, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chain := append([]*Header(nil), c.headers...)
+	oldWork := new(big.Int)
+	if len(chain) > 0 {
+		oldWork = chain[len(chain)-1].Chainwork
+	}
+
+	for _, h := range headers {
+		if len(chain) == 0 {
+			// the first header has nothing to link to, only its work is checked
+			if err = h.checkWork(); err != nil {
+				return nil, 0, err
+			}
+			h.Chainwork = work(h.Bits)
+			chain = append(chain, h)
+			added = append(added, h)
+			continue
+		}
+		start := chain[0].Height
+		if h.Height < start {
+			continue
+		}
+		i := int(h.Height - start)
+		if i > len(chain) {
+			return nil, 0, fmt.Errorf("header %d leaves a gap after %d", h.Height, chain[len(chain)-1].Height)
+		}
+		if i < len(chain) && chain[i].Hash == h.Hash {
+			continue
+		}
+		if i == 0 {
+			return nil, 0, fmt.Errorf("header %d conflicts with the first header", h.Height)
+		}
+
+		prev := chain[i-1]
+		if h.Prev == (chainhash.Hash{}) {
+			// a header without its previous hash must hash correctly when
+			// it follows the header before it
+			h.Prev = prev.Hash
+			if hash := chainhash.DoubleHashH(h.Bytes()); hash != h.Hash {
+				h.Prev = chainhash.Hash{}
+				return nil, 0, fmt.Errorf("%w: header %d does not follow %s", errUnlinked, h.Height, prev.Hash)
+			}
+		} else if h.Prev != prev.Hash {
+			return nil, 0, fmt.Errorf("%w: header %d does not follow %s", errUnlinked, h.Height, prev.Hash)
+		}
+		if err = h.check(); err != nil {
+			return nil, 0, err
+		}
+		if i < len(chain) && (reorgHeight == 0 || h.Height < reorgHeight) {
+			reorgHeight = h.Height
+		}
+		h.Chainwork = new(big.Int).Add(prev.Chainwork, work(h.Bits))
+		chain = append(chain[:i], h)
+		added = append(added, h)
+	}
+
+	if reorgHeight > 0 && chain[len(chain)-1].Chainwork.Cmp(oldWork) < 0 {
+		return nil, 0, fmt.Errorf("headers from %d have less work than the current chain", reorgHeight)
+	}
+
+	c.headers = chain
+	c.byHash = make(map[chainhash.Hash]uint32, len(chain))
+	for _, h := range chain {
+		c.byHash[h.Hash] = h.Height
+	}
+	return added, reorgHeight, nil
+}
+
+// at must be called with mu held
+func (c *Chain) at(height uint32) *Header {
+	if len(c.headers) == 0 || height < c.headers[0].Height {
+		return nil
+	}
+	i := int(height - c.headers[0].Height)
+	if i >= len(c.headers) {
+		return nil
+	}
+	return c.headers[i]
+}
+
+// tip must be called with mu held
+func (c *Chain) tip() uint32 {
+	if len(c.headers) == 0 {
+		return 0
+	}
+	return c.headers[len(c.headers)-1].Height
+}
+
+// start returns the height of the first header, or 0 if there are none
+func (c *Chain) start() uint32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.headers) == 0 {
+		return 0
+	}
+	return c.headers[0].Height
+}
+
+// TipHeight returns the height of the last header, or 0 if there are none
+func (c *Chain) TipHeight() uint32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tip()
+}
+
+// Header returns the header at height, if the chain has it
+func (c *Chain) Header(height uint32) (*Header, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := c.at(height)
+	return h, h != nil
+}
+
+// HashAt returns the hash of the main chain block at height
+func (c *Chain) HashAt(height uint32) (string, bool) {
+	if h, ok := c.Header(height); ok {
+		return h.Hash.String(), true
+	}
+	return "", false
+}
+
+// IsOnMainChain reports whether the block with the given hash is on the main
+// chain as far as the headers go
+func (c *Chain) IsOnMainChain(hash string) bool {
+	h, err := chainhash.NewHashFromHex(hash)
+	if err != nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.byHash[*h]
+	return ok
+}
+
+// IsValidRootForHeight implements chaintracker.ChainTracker, so SPV checks
+// are anchored to the headers
+func (c *Chain) IsValidRootForHeight(root *chainhash.Hash, height uint32) (bool, error) {
+	h, ok := c.Header(height)
+	if !ok && height > c.TipHeight() {
+		return false, fmt.Errorf("block %d: %w", height, ErrNotSynced)
+	} else if !ok {
+		return false, fmt.Errorf("no header for block %d", height)
+	}
+	return h.MerkleRoot.IsEqual(root), nil
+}
+
+func toDoc(h *Header) store.Doc {
+	return store.Doc{
+		"_id":         int64(h.Height),
+		"hash":        h.Hash.String(),
+		"prev":        h.Prev.String(),
+		"merkle_root": h.MerkleRoot.String(),
+		"version":     int64(h.Version),
+		"time":        int64(h.Time),
+		"bits":        strconv.FormatUint(uint64(h.Bits), 16),
+		"nonce":       int64(h.Nonce),
+		"chainwork":   h.Chainwork.Text(16),
+	}
+}
+
+func fromDoc(doc store.Doc) (*Header, error) {
+	h := &Header{}
+	var err error
+	for field, hash := range map[string]*chainhash.Hash{"hash": &h.Hash, "prev": &h.Prev, "merkle_root": &h.MerkleRoot} {
+		s, _ := doc[field].(string)
+		parsed, parseErr := chainhash.NewHashFromHex(s)
+		if parseErr != nil {
+			err = fmt.Errorf("header %v %s: %w", doc["_id"], field, parseErr)
+			continue
+		}
+		*hash = *parsed
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.Height = uint32(store.ToInt(doc["_id"]))
+	h.Version = uint32(store.ToInt(doc["version"]))
+	h.Time = uint32(store.ToInt(doc["time"]))
+	h.Nonce = uint32(store.ToInt(doc["nonce"]))
+	bits, _ := doc["bits"].(string)
+	b, err := strconv.ParseUint(bits, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("header %d bits: %w", h.Height, err)
+	}
+	h.Bits = uint32(b)
+	return h, nil
+}
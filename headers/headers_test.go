@@ -0,0 +1,212 @@
+package headers
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// easyBits is the regtest target, which about every other hash meets
+const easyBits = 0x207fffff
+
+// mine returns a header at height after prev, or the first header of a
+// chain if prev is nil. The fork byte makes a different header at the same
+// height.
+func mine(t *testing.T, prev *Header, height uint32, fork byte) *Header {
+	t.Helper()
+	h := &Header{Height: height, Version: 1, Time: 1000 + height, Bits: easyBits}
+	if prev != nil {
+		h.Prev = prev.Hash
+	}
+	h.MerkleRoot = chainhash.DoubleHashH([]byte{byte(height), fork})
+	for ; ; h.Nonce++ {
+		h.Hash = chainhash.DoubleHashH(h.Bytes())
+		if h.checkWork() == nil {
+			return h
+		}
+	}
+}
+
+// mineChain returns count headers from height after prev
+func mineChain(t *testing.T, prev *Header, height uint32, count int, fork byte) []*Header {
+	t.Helper()
+	var chain []*Header
+	for i := range count {
+		prev = mine(t, prev, height+uint32(i), fork)
+		chain = append(chain, prev)
+	}
+	return chain
+}
+
+func TestWork(t *testing.T) {
+	if got, want := compactToBig(0x1d00ffff), new(big.Int).Lsh(big.NewInt(0xffff), 208); got.Cmp(want) != 0 {
+		t.Errorf("compactToBig(0x1d00ffff) = %x, want %x", got, want)
+	}
+	if got := work(0x1d00ffff); got.Cmp(big.NewInt(0x100010001)) != 0 {
+		t.Errorf("work(0x1d00ffff) = %x, want 100010001", got)
+	}
+	if got := work(0x01800000); got.Sign() != 0 {
+		t.Errorf("work of a negative target = %v", got)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	chain := mineChain(t, nil, 50, 3, 0)
+	var data []byte
+	for _, h := range chain {
+		data = append(data, h.Bytes()...)
+	}
+	path := filepath.Join(t.TempDir(), "headers")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFile(path, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, h := range read {
+		if h.Height != chain[i].Height || h.Hash != chain[i].Hash || h.Prev != chain[i].Prev {
+			t.Errorf("header %d = %+v, want %+v", i, h, chain[i])
+		}
+	}
+	if err = os.WriteFile(path, data[:Size+1], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFile(path, 50); err == nil {
+		t.Error("read a file of partial headers")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+	c, err := Open(ctx, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	main := mineChain(t, nil, 100, 5, 0)
+	if _, err = c.Add(ctx, main); err != nil {
+		t.Fatal(err)
+	}
+	if c.TipHeight() != 104 {
+		t.Errorf("tip = %d, want 104", c.TipHeight())
+	}
+	if hash, ok := c.HashAt(102); !ok || hash != main[2].Hash.String() || !c.IsOnMainChain(hash) {
+		t.Errorf("HashAt(102) = %s, %v", hash, ok)
+	}
+	if ok, err := c.IsValidRootForHeight(&main[3].MerkleRoot, 103); !ok || err != nil {
+		t.Errorf("root of block 103 = %v, %v", ok, err)
+	}
+	if ok, err := c.IsValidRootForHeight(&main[3].MerkleRoot, 102); ok || err != nil {
+		t.Errorf("root of block 103 at 102 = %v, %v", ok, err)
+	}
+	if _, err := c.IsValidRootForHeight(&main[0].MerkleRoot, 105); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("root past the tip = %v, want ErrNotSynced", err)
+	}
+	if _, err := c.IsValidRootForHeight(&main[0].MerkleRoot, 99); err == nil || errors.Is(err, ErrNotSynced) {
+		t.Errorf("root before the first header = %v", err)
+	}
+
+	bad := []struct {
+		name    string
+		headers []*Header
+	}{
+		{"gap", mineChain(t, main[4], 106, 1, 0)},
+		{"unlinked", mineChain(t, mine(t, nil, 104, 9), 105, 1, 0)},
+		{"conflicting first header", mineChain(t, nil, 100, 1, 9)},
+		{"less work", mineChain(t, main[2], 103, 1, 9)},
+	}
+	for _, tt := range bad {
+		if _, err := c.Add(ctx, tt.headers); err == nil {
+			t.Errorf("%s: Add did not fail", tt.name)
+		}
+	}
+	unmined := mine(t, main[4], 105, 0)
+	unmined.Bits = 0x1d00ffff
+	unmined.Hash = chainhash.DoubleHashH(unmined.Bytes())
+	if _, err := c.Add(ctx, []*Header{unmined}); err == nil {
+		t.Error("added a header that does not meet its target")
+	}
+	if c.TipHeight() != 104 {
+		t.Errorf("tip after failed adds = %d, want 104", c.TipHeight())
+	}
+
+	// a fork with more work replaces the headers from where it starts
+	fork := mineChain(t, main[2], 103, 3, 1)
+	reorgHeight, err := c.Add(ctx, fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorgHeight != 103 || c.TipHeight() != 105 || c.IsOnMainChain(main[3].Hash.String()) {
+		t.Errorf("after the fork: reorg at %d, tip %d", reorgHeight, c.TipHeight())
+	}
+
+	// a header junglebus sent without its previous hash is linked
+	next := mine(t, fork[2], 106, 0)
+	next.Prev = chainhash.Hash{}
+	if _, err = c.Add(ctx, []*Header{next}); err != nil || next.Prev != fork[2].Hash {
+		t.Errorf("Add without the previous hash = %v, prev %s", err, next.Prev)
+	}
+
+	// the chain is loaded back from the store
+	reopened, err := Open(ctx, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := reopened.HashAt(105); reopened.TipHeight() != 106 || hash != fork[2].Hash.String() {
+		t.Errorf("reopened chain tip %d, block 105 %s", reopened.TipHeight(), hash)
+	}
+	if tip, ok, err := SavedTip(ctx, s); tip != 106 || !ok || err != nil {
+		t.Errorf("SavedTip = %d, %v, %v", tip, ok, err)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+	c, err := Open(ctx, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := mineChain(t, nil, 10, 3, 0)
+	if _, err = c.Add(ctx, chain[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.WaitFor(ctx, 11); err != nil {
+		t.Errorf("WaitFor a known header = %v", err)
+	}
+	// without Sync running, a header past the tip is not fetched
+	if err = c.WaitFor(ctx, 12); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("WaitFor without Sync = %v, want ErrNotSynced", err)
+	}
+
+	// a header past the tip is fetched straight away by Sync
+	refresh := make(chan struct{}, 1)
+	c.mu.Lock()
+	c.refresh = refresh
+	c.mu.Unlock()
+	go func() {
+		<-refresh
+		c.Add(ctx, chain[2:])
+		c.mu.Lock()
+		close(c.fetched)
+		c.fetched, c.fetchedAt = make(chan struct{}), time.Now()
+		c.mu.Unlock()
+	}()
+	if err = c.WaitFor(ctx, 12); err != nil {
+		t.Errorf("WaitFor a fetched header = %v", err)
+	}
+	// a fetch that just missed a header is not repeated
+	if err = c.WaitFor(ctx, 13); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("WaitFor right after a fetch = %v, want ErrNotSynced", err)
+	}
+}
@@ -0,0 +1,164 @@
+package headers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/GorillaPool/go-junglebus"
+	"github.com/GorillaPool/go-junglebus/models"
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/ttacon/chalk"
+)
+
+const (
+	syncInterval = time.Minute
+	syncBatch    = 1000
+	// headers below the tip fetched again on every sync, to notice reorgs
+	reorgDepth = 10
+	// how soon WaitFor fetches again after a fetch that missed its header
+	refetchInterval = 5 * time.Second
+)
+
+// Sync keeps the chain up to date with the junglebus headers until ctx is
+// cancelled, fetching every syncInterval or sooner when WaitFor asks. An
+// empty chain starts at cfg.FromBlock.
+func Sync(ctx context.Context, cfg *config.Config, c *Chain) {
+	client, err := junglebus.New(junglebus.WithHTTP(cfg.JunglebusEndpoint))
+	if err != nil {
+		log.Printf("[ERROR]: headers: %v", err)
+		return
+	}
+
+	refresh := make(chan struct{}, 1)
+	c.mu.Lock()
+	c.refresh = refresh
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.refresh = nil
+		c.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.fetch(ctx, cfg, client); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR]: syncing headers: %v", err)
+		}
+		c.mu.Lock()
+		close(c.fetched)
+		c.fetched, c.fetchedAt = make(chan struct{}), time.Now()
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-refresh:
+		}
+	}
+}
+
+// WaitFor returns once the chain has the header at height. A header past
+// the tip is fetched by Sync straight away rather than at its next interval,
+// and if it is still missing after that the error wraps ErrNotSynced.
+func (c *Chain) WaitFor(ctx context.Context, height uint32) error {
+	c.mu.RLock()
+	known := c.at(height) != nil
+	refresh, fetched := c.refresh, c.fetched
+	recent := time.Since(c.fetchedAt) < refetchInterval
+	c.mu.RUnlock()
+	if known {
+		return nil
+	}
+
+	// a fetch that just missed the header is not repeated for every tx
+	if refresh != nil && !recent {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-fetched:
+		}
+		if _, ok := c.Header(height); ok {
+			return nil
+		}
+	}
+	if height > c.TipHeight() {
+		return fmt.Errorf("block %d: %w", height, ErrNotSynced)
+	}
+	return fmt.Errorf("no header for block %d", height)
+}
+
+// fetch adds the headers junglebus has after the tip, from a few blocks
+// below it. Headers that do not link to the chain mean a deeper reorg, so
+// they are fetched again from further down.
+func (c *Chain) fetch(ctx context.Context, cfg *config.Config, client *junglebus.Client) error {
+	from := cfg.FromBlock
+	depth := uint32(reorgDepth)
+	if tip := c.TipHeight(); tip > 0 {
+		from = max(tip, depth) - depth
+	}
+
+	for {
+		list, err := client.GetBlockHeaders(ctx, strconv.FormatUint(uint64(from), 10), syncBatch)
+		if err != nil {
+			return err
+		}
+		headers := make([]*Header, 0, len(list))
+		for _, m := range list {
+			h, err := fromModel(m)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, h)
+		}
+		if _, err = c.Add(ctx, headers); errors.Is(err, errUnlinked) && from > c.start() {
+			depth *= 2
+			log.Printf("%s[HEADERS]: %v, refetching from %d blocks below the tip%s", chalk.Yellow, err, depth, chalk.Reset)
+			from = max(c.TipHeight(), depth) - depth
+			continue
+		} else if err != nil {
+			return err
+		}
+		if len(list) < syncBatch {
+			log.Printf("%s[HEADERS]: tip at block %d%s", chalk.Cyan, c.TipHeight(), chalk.Reset)
+			return nil
+		}
+		from = headers[len(headers)-1].Height + 1
+	}
+}
+
+// fromModel converts a junglebus header. Junglebus does not send the
+// previous hash, it is filled in from the chain when the header is added.
+func fromModel(m *models.BlockHeader) (*Header, error) {
+	hash, err := chainhash.NewHashFromHex(m.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("header %d hash: %w", m.Height, err)
+	}
+	root, err := chainhash.NewHashFromHex(m.MerkleRoot)
+	if err != nil {
+		return nil, fmt.Errorf("header %d merkle root: %w", m.Height, err)
+	}
+	bits, err := strconv.ParseUint(m.Bits, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("header %d bits: %w", m.Height, err)
+	}
+	return &Header{
+		Height:     m.Height,
+		Hash:       *hash,
+		MerkleRoot: *root,
+		Version:    m.Version,
+		Time:       m.Time,
+		Bits:       uint32(bits),
+		Nonce:      m.Nonce,
+	}, nil
+}
@@ -0,0 +1,160 @@
+package identity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/ttacon/chalk"
+)
+
+// Batch applies the BAP records of a block file in order, keeping the
+// identities it changes in memory until they are written with the block
+type Batch struct {
+	s       store.Store
+	pending map[string]*Identity
+	records []Record
+}
+
+// NewBatch returns an empty batch that reads identities from s
+func NewBatch(s store.Store) *Batch {
+	return &Batch{s: s, pending: map[string]*Identity{}}
+}
+
+// Add applies the BAP records of doc, the idx'th tx of its block, to the
+// identities. Only mined txs with valid signatures are applied, and records
+// that are not valid for their identity are skipped.
+func (b *Batch) Add(ctx context.Context, doc store.Doc, idx int) error {
+	list, _ := doc["BAP"].([]interface{})
+	blk, _ := doc["blk"].(map[string]interface{})
+	height, _ := blk["i"].(float64)
+	if len(list) == 0 || height == 0 {
+		return nil
+	}
+	txid, _ := doc["_id"].(string)
+	signer, _ := doc["signer"].(string)
+	if verified, _ := doc["verified"].(bool); !verified || signer == "" {
+		log.Printf("%s[BAP]: skipping %s, it is not validly signed%s", chalk.Yellow, txid, chalk.Reset)
+		return nil
+	}
+
+	for i, entry := range list {
+		m, _ := entry.(map[string]interface{})
+		r := Record{
+			Id:     fmt.Sprintf("%s_%d", txid, i),
+			Txid:   txid,
+			Height: uint32(height),
+			Idx:    idx,
+			Signer: signer,
+		}
+		r.Type, _ = m["type"].(string)
+		r.IDKey, _ = m["id_key"].(string)
+		r.Address, _ = m["address"].(string)
+		r.URNHash, _ = m["urn_hash"].(string)
+		r.Profile, _ = m["profile"].(string)
+		sequence, _ := m["sequence"].(float64)
+		r.Sequence = uint64(sequence)
+
+		if r.IDKey == "" {
+			// ATTEST and REVOKE are for the identity of their signer
+			key, err := b.owner(ctx, signer)
+			if err != nil {
+				return err
+			}
+			r.IDKey = key
+		}
+		var id *Identity
+		if r.IDKey != "" {
+			var err error
+			if id, err = b.load(ctx, r.IDKey); err != nil {
+				return err
+			}
+		}
+		next, err := apply(id, r)
+		if err != nil {
+			log.Printf("%s[BAP]: skipping %s record of %s: %v%s", chalk.Yellow, r.Type, txid, err, chalk.Reset)
+			continue
+		}
+		b.pending[next.IDKey] = next
+		b.records = append(b.records, r)
+	}
+	return nil
+}
+
+// Enrich sets bap_id on a signed doc to the identity of its signer
+func (b *Batch) Enrich(ctx context.Context, doc store.Doc) error {
+	signer, _ := doc["signer"].(string)
+	if signer == "" {
+		return nil
+	}
+	for _, id := range b.pending {
+		if slices.Contains(id.Addresses, signer) {
+			doc["bap_id"] = id.IDKey
+			return nil
+		}
+	}
+	idKey, ok, err := Resolve(ctx, b.s, signer)
+	if ok {
+		doc["bap_id"] = idKey
+	}
+	return err
+}
+
+// Writes returns the writes of the changed identities and the records that
+// changed them, by collection
+func (b *Batch) Writes() (map[string][]store.Write, error) {
+	writes := map[string][]store.Write{}
+	for _, id := range b.pending {
+		doc, err := store.ToDoc(id)
+		if err != nil {
+			return nil, err
+		}
+		writes[Collection] = append(writes[Collection], store.Write{Doc: doc})
+	}
+	for _, r := range b.records {
+		doc, err := store.ToDoc(r)
+		if err != nil {
+			return nil, err
+		}
+		writes[RecordsCollection] = append(writes[RecordsCollection], store.Write{Doc: doc})
+	}
+	return writes, nil
+}
+
+// load returns the identity with the given key as changed by the batch so
+// far, or nil if there is none
+func (b *Batch) load(ctx context.Context, idKey string) (*Identity, error) {
+	if id, ok := b.pending[idKey]; ok {
+		return id, nil
+	}
+	id, err := Get(ctx, b.s, idKey)
+	if err == store.ErrNotFound {
+		return nil, nil
+	}
+	return id, err
+}
+
+// owner returns the key of the identity whose current address is address,
+// or "" if there is none
+func (b *Batch) owner(ctx context.Context, address string) (string, error) {
+	for _, id := range b.pending {
+		if id.CurrentAddress == address {
+			return id.IDKey, nil
+		}
+	}
+	q := store.Query{Filter: store.Filter{"current_address": address}}
+	docs, err := b.s.Query(ctx, Collection, q)
+	if err != nil {
+		return "", err
+	}
+	for _, doc := range docs {
+		// an identity the batch changed may have moved on from address
+		idKey, _ := doc["_id"].(string)
+		if _, changed := b.pending[idKey]; !changed {
+			return idKey, nil
+		}
+	}
+	return "", nil
+}
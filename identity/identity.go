@@ -0,0 +1,276 @@
+// Package identity builds BAP identities from the ID, ATTEST, ALIAS and
+// REVOKE records of mined txs, applied in block order, so signed documents
+// can be tied to the identity of their signer
+package identity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+
+	base58 "github.com/bitcoin-sv/go-sdk/compat/base58"
+	hash "github.com/bitcoin-sv/go-sdk/primitives/hash"
+	"github.com/bitcoinschema/go-bap"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Collection holds the identities, keyed by identity key
+const Collection = "identities"
+
+// RecordsCollection logs the BAP records applied to the identities, so they
+// can be rebuilt when a reorg orphans some of them
+const RecordsCollection = "_bap"
+
+// Identity is a BAP identity and the addresses it has signed with
+type Identity struct {
+	IDKey          string        `bson:"_id"`
+	RootAddress    string        `bson:"root_address"`    // signed the first ID record, the identity key is derived from it
+	CurrentAddress string        `bson:"current_address"` // signs the identity's records now
+	Addresses      []string      `bson:"addresses"`       // every address the identity has signed with
+	History        []Address     `bson:"history"`
+	Profile        string        `bson:"profile,omitempty"` // the ALIAS profile, usually schema.org JSON
+	ProfileHeight  uint32        `bson:"profile_height,omitempty"`
+	Attestations   []Attestation `bson:"attestations,omitempty"`
+	FirstSeen      uint32        `bson:"first_seen"` // height of the first ID record
+	UpdatedAt      uint32        `bson:"updated_at"` // height of the last record applied
+}
+
+// Address is a signing address an ID record gave the identity
+type Address struct {
+	Address string `bson:"address"`
+	Txid    string `bson:"txid"`
+	From    uint32 `bson:"from"`            // height it became the current address
+	Until   uint32 `bson:"until,omitempty"` // height it was replaced, 0 while current
+}
+
+// Attestation is an attribute the identity attested to with an ATTEST record
+type Attestation struct {
+	URNHash  string `bson:"urn_hash"`
+	Sequence uint64 `bson:"sequence"`
+	Txid     string `bson:"txid"`
+	Height   uint32 `bson:"height"`
+	Revoked  bool   `bson:"revoked"`
+}
+
+// Record is a BAP record of a mined tx, as applied to an identity
+type Record struct {
+	Id       string `bson:"_id"` // txid and the index of the record in the tx
+	Txid     string `bson:"txid"`
+	Height   uint32 `bson:"height"`
+	Idx      int    `bson:"idx"` // position of the tx in its block
+	Type     string `bson:"type"`
+	IDKey    string `bson:"id_key"` // the identity, resolved from the signer for ATTEST and REVOKE
+	Address  string `bson:"address,omitempty"`
+	URNHash  string `bson:"urn_hash,omitempty"`
+	Sequence uint64 `bson:"sequence,omitempty"`
+	Profile  string `bson:"profile,omitempty"`
+	Signer   string `bson:"signer"`
+}
+
+// Key returns the identity key of an identity whose root address is
+// rootAddress, base58(ripemd160(sha256(rootAddress)))
+func Key(rootAddress string) string {
+	return base58.Encode(hash.Hash160([]byte(rootAddress)))
+}
+
+// apply applies r to id, the identity r is for or nil if there is none yet,
+// and returns the updated identity. Records that were applied before leave
+// the identity unchanged, so block files can be ingested again.
+func apply(id *Identity, r Record) (*Identity, error) {
+	switch bap.AttestationType(r.Type) {
+	case bap.ID:
+		if r.Address == "" {
+			return nil, errors.New("ID record has no address")
+		}
+		if id == nil {
+			if Key(r.Signer) != r.IDKey {
+				return nil, fmt.Errorf("ID record for %s is not signed by its root address", r.IDKey)
+			}
+			return &Identity{
+				IDKey:          r.IDKey,
+				RootAddress:    r.Signer,
+				CurrentAddress: r.Address,
+				Addresses:      unique(r.Signer, r.Address),
+				History:        []Address{{Address: r.Address, Txid: r.Txid, From: r.Height}},
+				FirstSeen:      r.Height,
+				UpdatedAt:      r.Height,
+			}, nil
+		}
+		if slices.ContainsFunc(id.History, func(a Address) bool { return a.Txid == r.Txid }) {
+			return id, nil
+		}
+		// the current address rotates to the next, the root address can
+		// always take the identity back
+		if r.Signer != id.CurrentAddress && r.Signer != id.RootAddress {
+			return nil, fmt.Errorf("ID record for %s is signed by %s, not its current address", r.IDKey, r.Signer)
+		}
+		id.History[len(id.History)-1].Until = r.Height
+		id.History = append(id.History, Address{Address: r.Address, Txid: r.Txid, From: r.Height})
+		id.CurrentAddress = r.Address
+		id.Addresses = unique(append(id.Addresses, r.Address)...)
+
+	case bap.ALIAS:
+		if err := signedByCurrent(id, r); err != nil {
+			return nil, err
+		}
+		if r.Height < id.ProfileHeight {
+			return id, nil
+		}
+		id.Profile, id.ProfileHeight = r.Profile, r.Height
+
+	case bap.ATTEST:
+		if err := signedByCurrent(id, r); err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(id.Attestations, func(a Attestation) bool { return a.URNHash == r.URNHash })
+		attestation := Attestation{URNHash: r.URNHash, Sequence: r.Sequence, Txid: r.Txid, Height: r.Height}
+		switch {
+		case i < 0:
+			id.Attestations = append(id.Attestations, attestation)
+		case r.Sequence > id.Attestations[i].Sequence:
+			id.Attestations[i] = attestation
+		default:
+			return id, nil
+		}
+
+	case bap.REVOKE:
+		if err := signedByCurrent(id, r); err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(id.Attestations, func(a Attestation) bool { return a.URNHash == r.URNHash })
+		if i < 0 {
+			return nil, fmt.Errorf("REVOKE of %s, which %s did not attest", r.URNHash, r.IDKey)
+		}
+		if r.Sequence <= id.Attestations[i].Sequence {
+			return id, nil
+		}
+		id.Attestations[i].Sequence = r.Sequence
+		id.Attestations[i].Txid = r.Txid
+		id.Attestations[i].Height = r.Height
+		id.Attestations[i].Revoked = true
+
+	default:
+		return nil, fmt.Errorf("unknown BAP record type %q", r.Type)
+	}
+	id.UpdatedAt = max(id.UpdatedAt, r.Height)
+	return id, nil
+}
+
+func signedByCurrent(id *Identity, r Record) error {
+	if id == nil {
+		return fmt.Errorf("%s record signed by %s, which is no identity's current address", r.Type, r.Signer)
+	}
+	if r.Signer != id.CurrentAddress {
+		return fmt.Errorf("%s record for %s is signed by %s, not its current address", r.Type, id.IDKey, r.Signer)
+	}
+	return nil
+}
+
+func unique(addresses ...string) []string {
+	slices.Sort(addresses)
+	return slices.Compact(addresses)
+}
+
+// Resolve returns the key of the identity that has signed with address
+func Resolve(ctx context.Context, s store.Store, address string) (idKey string, ok bool, err error) {
+	docs, err := s.Query(ctx, Collection, store.Query{Filter: store.Filter{"addresses": address}, Limit: 1})
+	if err != nil || len(docs) == 0 {
+		return "", false, err
+	}
+	idKey, ok = docs[0]["_id"].(string)
+	return idKey, ok, nil
+}
+
+// Get returns the identity with the given key, or store.ErrNotFound
+func Get(ctx context.Context, s store.Store, idKey string) (*Identity, error) {
+	doc, err := s.GetTx(ctx, Collection, idKey)
+	if err != nil {
+		return nil, err
+	}
+	id := &Identity{}
+	return id, store.FromDoc(doc, id)
+}
+
+// Rollback removes the records of the blocks from height up and rebuilds the
+// identities they were applied to from the records that are left
+func Rollback(ctx context.Context, s store.Store, height uint32) error {
+	affected := map[string]bool{}
+	var orphaned []interface{}
+	q := store.Query{Filter: store.Filter{"height": store.Filter{"$gte": height}}}
+	err := store.Each(ctx, s, RecordsCollection, q, func(doc store.Doc) error {
+		idKey, _ := doc["id_key"].(string)
+		affected[idKey] = true
+		orphaned = append(orphaned, doc["_id"])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, recordId := range orphaned {
+		if err = s.DeleteTx(ctx, RecordsCollection, recordId); err != nil {
+			return err
+		}
+	}
+
+	for idKey := range affected {
+		var records []Record
+		q := store.Query{Filter: store.Filter{"id_key": idKey}}
+		err = store.Each(ctx, s, RecordsCollection, q, func(doc store.Doc) error {
+			var r Record
+			if err := store.FromDoc(doc, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			if records[i].Height != records[j].Height {
+				return records[i].Height < records[j].Height
+			}
+			return records[i].Idx < records[j].Idx
+		})
+
+		var id *Identity
+		for _, r := range records {
+			if next, err := apply(id, r); err == nil {
+				id = next
+			}
+		}
+		// the identity is replaced, not updated, so nothing of the orphaned
+		// records is left
+		if err = s.DeleteTx(ctx, Collection, idKey); err != nil {
+			return err
+		}
+		if id == nil {
+			continue
+		}
+		doc, err := store.ToDoc(id)
+		if err != nil {
+			return err
+		}
+		if err = s.UpsertTx(ctx, Collection, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureIndexes creates the indexes identities are resolved by, and those
+// the rollback reads the records by
+func EnsureIndexes(ctx context.Context, s store.Store) error {
+	if err := store.EnsureIndex(ctx, s, Collection, "addresses"); err != nil {
+		return err
+	}
+	if err := store.EnsureIndex(ctx, s, Collection, "current_address"); err != nil {
+		return err
+	}
+	if err := store.EnsureIndex(ctx, s, RecordsCollection, "height"); err != nil {
+		return err
+	}
+	return store.EnsureIndex(ctx, s, RecordsCollection, "id_key")
+}
@@ -0,0 +1,241 @@
+package identity
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+const (
+	root   = "1RootAddress"
+	first  = "1FirstAddress"
+	second = "1SecondAddress"
+)
+
+func TestApply(t *testing.T) {
+	key := Key(root)
+	created := func() *Identity {
+		id, err := apply(nil, Record{Type: "ID", IDKey: key, Address: first, Signer: root, Txid: "id1", Height: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	tests := []struct {
+		name    string
+		r       Record
+		wantErr bool
+		check   func(t *testing.T, id *Identity)
+	}{
+		{"rotate by the current address", Record{Type: "ID", IDKey: key, Address: second, Signer: first, Txid: "id2", Height: 2}, false,
+			func(t *testing.T, id *Identity) {
+				if id.CurrentAddress != second || len(id.History) != 2 || id.History[0].Until != 2 {
+					t.Errorf("identity = %+v", id)
+				}
+			}},
+		{"rotate by the root address", Record{Type: "ID", IDKey: key, Address: second, Signer: root, Txid: "id2", Height: 2}, false,
+			func(t *testing.T, id *Identity) {
+				if id.CurrentAddress != second {
+					t.Errorf("current address = %s, want %s", id.CurrentAddress, second)
+				}
+			}},
+		{"rotate by another address", Record{Type: "ID", IDKey: key, Address: second, Signer: "1Other", Txid: "id2", Height: 2}, true, nil},
+		{"ID applied again", Record{Type: "ID", IDKey: key, Address: first, Signer: root, Txid: "id1", Height: 1}, false,
+			func(t *testing.T, id *Identity) {
+				if len(id.History) != 1 {
+					t.Errorf("history = %+v, want one address", id.History)
+				}
+			}},
+		{"ID without an address", Record{Type: "ID", IDKey: key, Signer: root, Txid: "id2", Height: 2}, true, nil},
+		{"alias", Record{Type: "ALIAS", IDKey: key, Profile: `{"name":"a"}`, Signer: first, Height: 3}, false,
+			func(t *testing.T, id *Identity) {
+				if id.Profile != `{"name":"a"}` || id.ProfileHeight != 3 || id.UpdatedAt != 3 {
+					t.Errorf("identity = %+v", id)
+				}
+			}},
+		{"alias by the root address", Record{Type: "ALIAS", IDKey: key, Signer: root, Height: 3}, true, nil},
+		{"attest", Record{Type: "ATTEST", IDKey: key, URNHash: "urn", Sequence: 1, Signer: first, Txid: "a1", Height: 3}, false,
+			func(t *testing.T, id *Identity) {
+				if len(id.Attestations) != 1 || id.Attestations[0].Txid != "a1" {
+					t.Errorf("attestations = %+v", id.Attestations)
+				}
+			}},
+		{"revoke what was not attested", Record{Type: "REVOKE", IDKey: key, URNHash: "urn", Sequence: 2, Signer: first, Height: 3}, true, nil},
+		{"unknown type", Record{Type: "SOMETHING", IDKey: key, Signer: first}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := apply(created(), tt.r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, id)
+			}
+		})
+	}
+
+	if _, err := apply(nil, Record{Type: "ID", IDKey: key, Address: first, Signer: "1Other"}); err == nil {
+		t.Error("created an identity from an ID record not signed by its root address")
+	}
+}
+
+func TestAttestations(t *testing.T) {
+	key := Key(root)
+	id, err := apply(nil, Record{Type: "ID", IDKey: key, Address: first, Signer: root, Txid: "id1", Height: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		r        Record
+		sequence uint64
+		revoked  bool
+	}{
+		{Record{Type: "ATTEST", URNHash: "urn", Sequence: 2, Txid: "a2", Height: 2}, 2, false},
+		{Record{Type: "ATTEST", URNHash: "urn", Sequence: 1, Txid: "a1", Height: 3}, 2, false},
+		{Record{Type: "REVOKE", URNHash: "urn", Sequence: 2, Txid: "r2", Height: 4}, 2, false},
+		{Record{Type: "REVOKE", URNHash: "urn", Sequence: 3, Txid: "r3", Height: 5}, 3, true},
+	}
+	for _, step := range steps {
+		step.r.IDKey, step.r.Signer = key, first
+		if id, err = apply(id, step.r); err != nil {
+			t.Fatal(err)
+		}
+		a := id.Attestations[0]
+		if len(id.Attestations) != 1 || a.Sequence != step.sequence || a.Revoked != step.revoked {
+			t.Errorf("after %s %d: attestation = %+v", step.r.Type, step.r.Sequence, a)
+		}
+	}
+}
+
+// bapDoc is a signed tx with BAP records, as read from a block file
+func bapDoc(txid string, height float64, signer string, records ...map[string]interface{}) store.Doc {
+	list := make([]interface{}, len(records))
+	for i, r := range records {
+		list[i] = r
+	}
+	return store.Doc{
+		"_id":      txid,
+		"blk":      map[string]interface{}{"i": height},
+		"signer":   signer,
+		"verified": true,
+		"BAP":      list,
+	}
+}
+
+// commit applies the docs as one block file and writes the identities
+func commit(t *testing.T, s store.Store, docs ...store.Doc) {
+	t.Helper()
+	ctx := context.Background()
+	b := NewBatch(s)
+	for i, doc := range docs {
+		if err := b.Add(ctx, doc, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writes, err := b.Writes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for collection, w := range writes {
+		if err = s.UpsertTxs(ctx, collection, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, _ := storetest.Open(t)
+	ctx := context.Background()
+	key := Key(root)
+
+	commit(t, s, bapDoc("id1", 1, root, map[string]interface{}{"type": "ID", "id_key": key, "address": first}))
+	// an ATTEST is for the identity of its signer
+	commit(t, s,
+		bapDoc("a1", 2, first, map[string]interface{}{"type": "ATTEST", "urn_hash": "urn", "sequence": 1.0}),
+		bapDoc("unsigned", 2, "", map[string]interface{}{"type": "ID", "id_key": key, "address": second}),
+	)
+	commit(t, s, bapDoc("id2", 3, first, map[string]interface{}{"type": "ID", "id_key": key, "address": second}))
+
+	id, err := Get(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.CurrentAddress != second || len(id.Attestations) != 1 || id.UpdatedAt != 3 {
+		t.Errorf("identity = %+v", id)
+	}
+	for _, address := range []string{root, first, second} {
+		if got, ok, err := Resolve(ctx, s, address); err != nil || !ok || got != key {
+			t.Errorf("Resolve(%s) = %s, %v, %v", address, got, ok, err)
+		}
+	}
+	if _, ok, err := Resolve(ctx, s, "1Other"); ok || err != nil {
+		t.Errorf("Resolve of an unknown address = %v, %v", ok, err)
+	}
+
+	doc := store.Doc{"signer": first}
+	if err = NewBatch(s).Enrich(ctx, doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["bap_id"] != key {
+		t.Errorf("bap_id = %v, want %s", doc["bap_id"], key)
+	}
+
+	// rolling back block 3 takes the identity back to its first address
+	if err = Rollback(ctx, s, 3); err != nil {
+		t.Fatal(err)
+	}
+	if id, err = Get(ctx, s, key); err != nil {
+		t.Fatal(err)
+	}
+	if id.CurrentAddress != first || len(id.History) != 1 || id.History[0].Until != 0 || len(id.Attestations) != 1 {
+		t.Errorf("identity after rollback = %+v", id)
+	}
+	if _, ok, _ := Resolve(ctx, s, second); ok {
+		t.Error("the rolled back address still resolves")
+	}
+
+	// rolling back every record removes the identity
+	if err = Rollback(ctx, s, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Get(ctx, s, key); err != store.ErrNotFound {
+		t.Errorf("Get after rolling back everything = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBatchPending(t *testing.T) {
+	s, _ := storetest.Open(t)
+	ctx := context.Background()
+	key := Key(root)
+
+	// records of one block file see the identities changed before them
+	b := NewBatch(s)
+	docs := []store.Doc{
+		bapDoc("id1", 1, root, map[string]interface{}{"type": "ID", "id_key": key, "address": first}),
+		bapDoc("alias", 1, first, map[string]interface{}{"type": "ALIAS", "id_key": key, "profile": "p"}),
+	}
+	for i, doc := range docs {
+		if err := b.Add(ctx, doc, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signed := store.Doc{"signer": first}
+	if err := b.Enrich(ctx, signed); err != nil {
+		t.Fatal(err)
+	}
+	if signed["bap_id"] != key {
+		t.Errorf("bap_id = %v, want %s", signed["bap_id"], key)
+	}
+
+	writes, err := b.Writes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writes[Collection]) != 1 || len(writes[RecordsCollection]) != 2 {
+		t.Errorf("writes = %v", writes)
+	}
+}
@@ -1,13 +1,46 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/rohenaz/go-bmap-indexer/blob"
+	"github.com/rohenaz/go-bmap-indexer/cache"
+	"github.com/rohenaz/go-bmap-indexer/config"
 	"github.com/rohenaz/go-bmap-indexer/crawler"
-	"github.com/rohenaz/go-bmap-indexer/state"
+	"github.com/rohenaz/go-bmap-indexer/search"
+	"github.com/rohenaz/go-bmap-indexer/store"
 )
 
+// command is a subcommand of the indexer binary
+type command struct {
+	usage       string
+	description string
+	run         func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"sync":    {"sync", "crawl junglebus and ingest blocks as they complete (default)", runSync},
+	"ingest":  {"ingest <file|dir>", "ingest existing block files into the database", runIngest},
+	"reindex": {"reindex -from <height> -to <height>", "re-ingest the local block files in a height range", runReindex},
+	"status":  {"status", "print sync progress and document counts per collection", runStatus},
+	"p2p":     {"p2p serve", "build the p2p content cache and serve it to peers", runP2P},
+	"export":  {"export -collection <name> [-out <file>]", "export a collection as newline delimited json", runExport},
+	"failed":  {"failed list | failed retry [-height <height>]", "list or re-drive blocks parked after failing to sync", runFailed},
+	"serve":   {"serve [-api-addr <addr>]", "serve the query api without syncing", runServe},
+	"reorgs":  {"reorgs [-limit <n>]", "list the chain reorganizations that orphaned indexed blocks", runReorgs},
+	"state":   {"state sync | state rebuild", "build the social graph up to the indexed height, or from height 0", runState},
+}
+
 func init() {
 	err := godotenv.Load()
 	if err != nil {
@@ -17,10 +50,99 @@ func init() {
 
 func main() {
 
-	currentBlock := state.LoadProgress()
+	name, args := parseCommand(os.Args[1:])
+	if name == "help" {
+		usage()
+		return
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n\n%s\n\nFlags:\n", os.Args[0], cmd.usage, cmd.description)
+		fs.PrintDefaults()
+	}
+	if err := cmd.run(fs, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseCommand splits the command name from its arguments. Without a name,
+// as when the arguments start with a flag, the command is sync.
+func parseCommand(args []string) (name string, rest []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "sync", args
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-45s %s\n", commands[name].usage, commands[name].description)
+	}
+}
 
-	go crawler.ProcessDone()
-	crawler.SyncBlocks(int(currentBlock))
+// setup loads the configuration and opens the store, the blob store if one
+// is configured and the search index if search is enabled. They are closed
+// by teardown.
+func setup(fs *flag.FlagSet, args []string) (*config.Config, *crawler.Deps, error) {
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &crawler.Deps{}
+	if d.Store, err = store.Open(cfg); err != nil {
+		return nil, nil, err
+	}
+	if cfg.BlobStore != "" {
+		if d.Blobs, err = blob.Open(cfg); err != nil {
+			return nil, nil, err
+		}
+	}
+	if d.Search, err = search.Open(context.Background(), cfg, d.Store); err != nil {
+		return nil, nil, err
+	}
+	return cfg, d, nil
+}
+
+// teardown closes the connections opened by the command
+func teardown(d *crawler.Deps) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if d.Search != nil {
+		if err := d.Search.Close(); err != nil {
+			log.Printf("[ERROR]: closing search index: %v", err)
+		}
+	}
+	if err := d.Store.Close(ctx); err != nil {
+		log.Printf("[ERROR]: closing store: %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		log.Printf("[ERROR]: closing redis: %v", err)
+	}
+}
 
-	<-make(chan struct{})
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+// A second signal kills the process without waiting for shutdown.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down, interrupt again to force quit")
+		stop()
+	}()
+	return ctx, stop
 }
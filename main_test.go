@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		name string
+		rest []string
+	}{
+		{nil, "sync", nil},
+		{[]string{"-store", "bolt"}, "sync", []string{"-store", "bolt"}},
+		{[]string{"sync", "-store", "bolt"}, "sync", []string{"-store", "bolt"}},
+		{[]string{"status"}, "status", []string{}},
+		{[]string{"failed", "retry", "-height", "5"}, "failed", []string{"retry", "-height", "5"}},
+		{[]string{"help"}, "help", []string{}},
+		{[]string{"nope", "-store", "bolt"}, "nope", []string{"-store", "bolt"}},
+	}
+	for _, tt := range tests {
+		name, rest := parseCommand(tt.args)
+		if name != tt.name || !slices.Equal(rest, tt.rest) {
+			t.Errorf("parseCommand(%q) = %q, %q, want %q, %q", tt.args, name, rest, tt.name, tt.rest)
+		}
+	}
+	if _, ok := commands["nope"]; ok {
+		t.Error("unknown command found")
+	}
+	for _, name := range []string{"sync", "ingest", "reindex", "status", "export", "failed", "reorgs", "state"} {
+		if _, ok := commands[name]; !ok {
+			t.Errorf("command %s missing", name)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "post.jsonl")
+	// every command runs on an empty bolt store, without a search index
+	store := []string{"-store", "bolt", "-store-path", filepath.Join(dir, "bmap.db"), "-search-path", ""}
+
+	tests := []struct {
+		name string
+		sub  string // subcommand of failed and state
+		args []string
+		want string // part of the error, "" for none
+	}{
+		{"sync", "", []string{"-nope"}, "flag provided but not defined"},
+		{"sync", "", []string{"-from-block", "x"}, "invalid -from-block"},
+		{"ingest", "", nil, "exactly one file or directory"},
+		{"ingest", "", []string{dir, dir}, "exactly one file or directory"},
+		{"ingest", "", []string{t.TempDir()}, ""},
+		{"reindex", "", []string{"-from", "x"}, "invalid value"},
+		{"reindex", "", []string{"-from", "10", "-to", "12"}, ""},
+		{"status", "", nil, ""},
+		{"status", "", []string{"-store", "sqlite"}, "store must be mongo or bolt"},
+		{"export", "", nil, "export requires -collection"},
+		{"export", "", []string{"-collection", "post", "-status", "lost"}, `unknown status "lost"`},
+		{"export", "", []string{"-collection", "post", "-out", out, "-from", "1", "-to", "2"}, ""},
+		{"failed", "", nil, "unknown failed command"},
+		{"failed", "drop", nil, "unknown failed command"},
+		{"failed", "list", nil, ""},
+		{"failed", "retry", []string{"-height", "x"}, "invalid value"},
+		{"failed", "retry", []string{"-height", "5"}, ""},
+		{"reorgs", "", []string{"-limit", "x"}, "invalid value"},
+		{"reorgs", "", []string{"-limit", "5"}, ""},
+		{"state", "", nil, "unknown state command"},
+		{"state", "build", nil, "unknown state command"},
+		{"state", "sync", nil, ""},
+		{"state", "rebuild", nil, ""},
+	}
+	for _, tt := range tests {
+		args := slices.Concat(store, tt.args)
+		if tt.sub != "" {
+			args = append([]string{tt.sub}, args...)
+		}
+		fs := flag.NewFlagSet(tt.name, flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		err := commands[tt.name].run(fs, args)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s %s %q: %v", tt.name, tt.sub, tt.args, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s %s %q = %v, want an error containing %q", tt.name, tt.sub, tt.args, err, tt.want)
+		}
+	}
+
+	if _, err := os.Stat(out); err != nil {
+		t.Errorf("export did not write its file: %v", err)
+	}
+}
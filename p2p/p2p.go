@@ -124,11 +124,10 @@ func handleStream(stream network.Stream) {
 	// 'stream' will stay open until you close it (or the other side closes it).
 }
 
-// Start initializes the P2P node and connects it to the network
-func Start() {
-	ctx := context.Background()
-
-	privKey, err := getPrivateKeyFromEnv("BMAP_P2P_PK")
+// Start initializes the P2P node and connects it to the network. It runs
+// until ctx is cancelled and then closes the libp2p host.
+func Start(ctx context.Context, cfg *config.Config) {
+	privKey, err := getPrivateKey(cfg.P2PPrivateKey)
 	if err != nil {
 		log.Fatalf("Error getting private key: %s", err)
 	}
@@ -140,9 +139,14 @@ func Start() {
 	if err != nil {
 		log.Fatalf("Error creating libp2p host: %s", err)
 	}
+	defer func() {
+		if err := h.Close(); err != nil {
+			log.Println("Error closing libp2p host:", err)
+		}
+	}()
 
-	// loop over config.OutputTypes and subscribe to each topic
-	for _, topicName := range strings.Split(config.OutputTypes, ",") {
+	// loop over cfg.OutputTypes and subscribe to each topic
+	for _, topicName := range cfg.OutputTypes {
 		go discoverPeers(ctx, h, &topicName)
 
 		ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithPeerExchange(true), pubsub.WithFloodPublish(true))
@@ -158,8 +162,9 @@ func Start() {
 		sub, err := topic.Subscribe()
 		if err != nil {
 			fmt.Printf("%s%s %s: %v%s\n", p2pChalk, "Error subscribing to topic", topic, err, chalk.Reset)
+			continue
 		}
-		printMessagesFrom(ctx, sub)
+		go printMessagesFrom(ctx, sub)
 		go func(topic *pubsub.Topic, topicName string) {
 			time.Sleep(5 * time.Second)
 			topic.Publish(ctx, []byte("Hello "+topicName))
@@ -169,7 +174,7 @@ func Start() {
 	// define protocol
 	h.SetStreamHandler("/bmap/1.0.0", handleStream)
 
-	bootstrapPeerID := os.Getenv("BOOTSTRAP_PEER_ID")
+	bootstrapPeerID := cfg.BootstrapPeerID
 	if bootstrapPeerID != "" {
 		// Attempt to connect to the bootstrap node
 		bootstrapPeers, err := resolveBootstrapPeers("viaduct.proxy.rlwy.net", 49648, bootstrapPeerID)
@@ -184,7 +189,7 @@ func Start() {
 				log.Println("Error creating AddrInfo:", err)
 				continue
 			}
-			if err := h.Connect(context.Background(), *peerInfo); err != nil {
+			if err := h.Connect(ctx, *peerInfo); err != nil {
 				log.Println("Error connecting to bootstrap peer:", err)
 			}
 
@@ -193,7 +198,7 @@ func Start() {
 
 			log.Println("Connected to bootstrap peer:", peerInfo.ID)
 			// now that we're connected, we can open a stream to this peer
-			stream, err := h.NewStream(context.Background(), peerInfo.ID, "/bmap/1.0.0")
+			stream, err := h.NewStream(ctx, peerInfo.ID, "/bmap/1.0.0")
 			if err != nil {
 				log.Println("Error opening stream to bootstrap peer:", err)
 				continue
@@ -204,17 +209,17 @@ func Start() {
 			// client because we want each peer to maintain its own local copy of the
 			// DHT, so that the bootstrapping node of the DHT can go down without
 			// inhibiting future peer discovery.
-			ctx := context.Background()
 			kademliaDHT, err := dht.New(ctx, h)
 			if err != nil {
 				panic(err)
 			}
+			defer kademliaDHT.Close()
 
 			routingDiscovery := drouting.NewRoutingDiscovery(kademliaDHT)
 			dutil.Advertise(ctx, routingDiscovery, namespace)
 			log.Println("Successfully announced!")
 
-			// Lets subscribe to topics via pubsub - based on csv list config.OutputTypes
+			// Lets subscribe to topics via pubsub - based on cfg.OutputTypes
 
 			// Now, look for others who have announced
 			// This is like your friend telling you the location to meet you.
@@ -251,7 +256,9 @@ func Start() {
 			// create a cid from these bytes
 			//		kademliaDHT.Provide(context.Background(), *cid, true)
 
-			select {}
+			<-ctx.Done()
+			log.Println("Shutting down p2p node")
+			return
 		}
 	} else {
 		log.Println("No bootstrap peer ID provided")
@@ -259,8 +266,8 @@ func Start() {
 
 	log.Println("Node started with ID:", h.ID(), "and addresses: ", h.Addrs())
 
-	// empty channel
-	<-make(chan struct{})
+	<-ctx.Done()
+	log.Println("Shutting down p2p node")
 }
 
 func initDHT(ctx context.Context, h host.Host) *dht.IpfsDHT {
@@ -298,7 +305,7 @@ func discoverPeers(ctx context.Context, h host.Host, topicName *string) {
 
 	// Look for others who have announced and attempt to connect to them
 	anyConnected := false
-	for !anyConnected {
+	for !anyConnected && ctx.Err() == nil {
 		fmt.Println("Searching for peers on topic:", *topicName)
 		peerChan, err := routingDiscovery.FindPeers(ctx, *topicName)
 		if err != nil {
@@ -321,13 +328,13 @@ func discoverPeers(ctx context.Context, h host.Host, topicName *string) {
 }
 
 // CreateContentCache will import the jsonld files in the data folder and create individual cbor encoded files for every line (parsed bmap tx)
-func CreateContentCache() {
+func CreateContentCache(cfg *config.Config) {
 	// mutex prevents race conditions
 	// mu.Lock()
 	// defer mu.Unlock()
 
 	Started = true
-	cache.Connect()
+	cache.Connect(cfg.RedisURL)
 
 	// Get files from ./data directory
 	files, err := os.ReadDir("./data")
@@ -342,12 +349,12 @@ func CreateContentCache() {
 			fmt.Printf("%sImporting file in p2p worker %s%s\n", p2pChalk, file.Name(), chalk.Reset)
 
 			height := strings.Split(file.Name(), ".")[0]
-			importFile("./data/"+file.Name(), height)
+			importFile(cfg, "./data/"+file.Name(), height)
 		}
 	}
 }
 
-func importFile(file string, height string) {
+func importFile(cfg *config.Config, file string, height string) {
 	// mutex
 	mu.Lock()
 	defer mu.Unlock()
@@ -390,7 +397,7 @@ func importFile(file string, height string) {
 	// wait for the workers to finish
 	wg.Wait()
 
-	if config.DeleteAfterIngest {
+	if cfg.DeleteAfterIngest {
 
 		// delete the json file ONLY IF it is not the "highest" file
 		// convert height to uint32
@@ -476,11 +483,10 @@ func ProcessLine(line []byte, height string) (txid *string, cid *cid.Cid, err er
 	return txid, cid, nil
 }
 
-// getPrivateKeyFromEnv loads the WIF-encoded private key from the environment variable and converts it to a libp2p private key
-func getPrivateKeyFromEnv(envVar string) (crypto.PrivKey, error) {
-	wifStr := os.Getenv(envVar)
+// getPrivateKey converts the WIF-encoded private key to a libp2p private key
+func getPrivateKey(wifStr string) (crypto.PrivKey, error) {
 	if wifStr == "" {
-		return nil, fmt.Errorf("%s environment variable is not set", envVar)
+		return nil, fmt.Errorf("p2p private key is not set (BMAP_P2P_PK)")
 	}
 
 	pk, err := ec.PrivateKeyFromWif(wifStr)
@@ -560,6 +566,9 @@ func printMessagesFrom(ctx context.Context, sub *pubsub.Subscription) {
 	for {
 		m, err := sub.Next(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			panic(err)
 		}
 		fmt.Println(m.ReceivedFrom, ": ", string(m.Message.Data))
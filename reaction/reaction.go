@@ -0,0 +1,262 @@
+// Package reaction aggregates the likes of confirmed txs per target tx, by
+// emoji. A like is MAP type=like with tx=<target> and an optional emoji, and
+// an unlike, MAP type=unlike, takes back the likes its signer made before it.
+package reaction
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Collections of the reactions
+const (
+	Collection       = "reactions"        // the aggregate of every target, keyed by its txid
+	eventsCollection = "_reaction_events" // every like and unlike, keyed by txid_<MAP index>
+)
+
+// Reactions is the aggregate of the reactions to a tx
+type Reactions struct {
+	Tx          string       `bson:"_id" json:"tx"`
+	Total       int          `bson:"total" json:"total"`
+	Emojis      []EmojiCount `bson:"emojis" json:"emojis"` // most used first
+	Signers     []string     `bson:"signers" json:"signers"`
+	SignerCount int          `bson:"signer_count" json:"signer_count"`
+	Addresses   []string     `bson:"addresses" json:"addresses"` // signing addresses of the signers
+}
+
+// EmojiCount is how many signers reacted with an emoji. A like without an
+// emoji is counted under "".
+type EmojiCount struct {
+	Emoji string `bson:"emoji" json:"emoji"`
+	Count int    `bson:"count" json:"count"`
+}
+
+// Reacted reports whether the BAP identity or address reacted
+func (r *Reactions) Reacted(signer string) bool {
+	return slices.Contains(r.Signers, signer) || slices.Contains(r.Addresses, signer)
+}
+
+// event is a like or unlike, in the order it was mined
+type event struct {
+	Id      string `bson:"_id"`
+	Tx      string `bson:"tx"`
+	By      string `bson:"by"`      // BAP identity of the signer, or the signing address when it has none
+	Address string `bson:"address"` // signing address
+	Emoji   string `bson:"emoji"`
+	Unlike  bool   `bson:"unlike"`
+	Height  uint32 `bson:"height"`
+	Idx     int    `bson:"idx"` // position in the block
+}
+
+// Batch collects the likes and unlikes of a block file, to write with the
+// block
+type Batch struct {
+	s      store.Store
+	events []event
+	seen   map[string]bool
+}
+
+// NewBatch returns an empty batch that reads the stored events from s
+func NewBatch(s store.Store) *Batch {
+	return &Batch{s: s, seen: map[string]bool{}}
+}
+
+// Add notes the likes and unlikes of a confirmed, signed doc. A doc written
+// to several collections is added once.
+func (b *Batch) Add(doc store.Doc) {
+	txid, _ := doc["_id"].(string)
+	address, _ := doc["signer"].(string)
+	by, _ := doc["bap_id"].(string)
+	if by == "" {
+		by = address
+	}
+	blk, _ := store.Lookup(doc, "blk.i")
+	height := store.ToInt(blk)
+	if txid == "" || by == "" || height == 0 || b.seen[txid] {
+		return
+	}
+	b.seen[txid] = true
+	idx := len(b.seen)
+
+	for i, m := range store.Entries(doc["MAP"]) {
+		mapType, _ := m["type"].(string)
+		target, _ := m["tx"].(string)
+		if (mapType != "like" && mapType != "unlike") || target == "" {
+			continue
+		}
+		e := event{
+			Id:      fmt.Sprintf("%s_%d", txid, i),
+			Tx:      target,
+			By:      by,
+			Address: address,
+			Unlike:  mapType == "unlike",
+			Height:  uint32(height),
+			Idx:     idx,
+		}
+		e.Emoji, _ = m["emoji"].(string)
+		b.events = append(b.events, e)
+	}
+}
+
+// Writes returns the writes of the batch's events and of the aggregates of
+// the txs they target, so both are written with the block
+func (b *Batch) Writes(ctx context.Context) (map[string][]store.Write, error) {
+	writes := map[string][]store.Write{}
+	var targets []string
+	for _, e := range b.events {
+		doc, err := store.ToDoc(e)
+		if err != nil {
+			return nil, err
+		}
+		writes[eventsCollection] = append(writes[eventsCollection], store.Write{Doc: doc})
+		if !slices.Contains(targets, e.Tx) {
+			targets = append(targets, e.Tx)
+		}
+	}
+	aggregates, err := aggregate(ctx, b.s, targets, b.events)
+	if err != nil {
+		return nil, err
+	}
+	if len(aggregates) > 0 {
+		writes[Collection] = aggregates
+	}
+	return writes, nil
+}
+
+// aggregate returns the aggregates of the targets, replaying their stored
+// events and the pending ones in the order they were mined. Blocks can be
+// committed again or out of order and still give the same aggregate. An
+// unlike with an emoji takes back that emoji, and one without takes back
+// every like of its signer.
+func aggregate(ctx context.Context, s store.Store, targets []string, pending []event) ([]store.Write, error) {
+	var writes []store.Write
+	for _, target := range targets {
+		byId := map[string]event{}
+		q := store.Query{Filter: store.Filter{"tx": target}}
+		err := store.Each(ctx, s, eventsCollection, q, func(doc store.Doc) error {
+			var e event
+			if err := store.FromDoc(doc, &e); err != nil {
+				return err
+			}
+			byId[e.Id] = e
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range pending {
+			if e.Tx == target {
+				byId[e.Id] = e
+			}
+		}
+		events := make([]event, 0, len(byId))
+		for _, e := range byId {
+			events = append(events, e)
+		}
+		slices.SortFunc(events, func(a, b event) int {
+			return cmp.Or(cmp.Compare(a.Height, b.Height), cmp.Compare(a.Idx, b.Idx), cmp.Compare(a.Id, b.Id))
+		})
+
+		active := map[string]map[string]string{} // signer to emoji to address
+		for _, e := range events {
+			switch {
+			case !e.Unlike:
+				if active[e.By] == nil {
+					active[e.By] = map[string]string{}
+				}
+				active[e.By][e.Emoji] = e.Address
+			case e.Emoji != "":
+				delete(active[e.By], e.Emoji)
+				if len(active[e.By]) == 0 {
+					delete(active, e.By)
+				}
+			default:
+				delete(active, e.By)
+			}
+		}
+
+		// a target whose likes were all taken back keeps a zeroed aggregate
+		doc, err := store.ToDoc(summarize(target, active))
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, store.Write{Doc: doc})
+	}
+	return writes, nil
+}
+
+func summarize(target string, active map[string]map[string]string) *Reactions {
+	r := &Reactions{Tx: target, Emojis: []EmojiCount{}, Signers: []string{}, Addresses: []string{}}
+	counts := map[string]int{}
+	for signer, emojis := range active {
+		r.Signers = append(r.Signers, signer)
+		for emoji, address := range emojis {
+			counts[emoji]++
+			r.Total++
+			if !slices.Contains(r.Addresses, address) {
+				r.Addresses = append(r.Addresses, address)
+			}
+		}
+	}
+	for emoji, count := range counts {
+		r.Emojis = append(r.Emojis, EmojiCount{Emoji: emoji, Count: count})
+	}
+	slices.SortFunc(r.Emojis, func(a, b EmojiCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Emoji, b.Emoji))
+	})
+	slices.Sort(r.Signers)
+	slices.Sort(r.Addresses)
+	r.SignerCount = len(r.Signers)
+	return r
+}
+
+// Get returns the reactions to a tx. A tx nobody reacted to has none.
+func Get(ctx context.Context, s store.Store, txid string) (*Reactions, error) {
+	doc, err := s.GetTx(ctx, Collection, txid)
+	if err == store.ErrNotFound {
+		return summarize(txid, nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+	r := &Reactions{}
+	return r, store.FromDoc(doc, r)
+}
+
+// Rollback removes the likes and unlikes of the blocks from height up and
+// updates the aggregates of the txs they targeted, which it returns
+func Rollback(ctx context.Context, s store.Store, height uint32) (targets []string, err error) {
+	var ids []interface{}
+	q := store.Query{Filter: store.Filter{"height": store.Filter{"$gte": height}}}
+	err = store.Each(ctx, s, eventsCollection, q, func(doc store.Doc) error {
+		ids = append(ids, doc["_id"])
+		if target, ok := doc["tx"].(string); ok && !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if err = s.DeleteTx(ctx, eventsCollection, id); err != nil {
+			return nil, err
+		}
+	}
+	writes, err := aggregate(ctx, s, targets, nil)
+	if err != nil || len(writes) == 0 {
+		return targets, err
+	}
+	return targets, s.UpsertTxs(ctx, Collection, writes)
+}
+
+// EnsureIndexes creates the indexes the aggregation and rollback read by
+func EnsureIndexes(ctx context.Context, s store.Store) error {
+	if err := store.EnsureIndex(ctx, s, eventsCollection, "tx"); err != nil {
+		return err
+	}
+	return store.EnsureIndex(ctx, s, eventsCollection, "height")
+}
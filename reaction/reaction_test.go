@@ -0,0 +1,182 @@
+package reaction
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// like is a confirmed like, or an unlike when mapType says so, of the post
+// tx by signer
+func like(txid string, mapType string, signer string, emoji string, height int) store.Doc {
+	entry := map[string]interface{}{"type": mapType, "tx": "post"}
+	if emoji != "" {
+		entry["emoji"] = emoji
+	}
+	return store.Doc{
+		"_id":    txid,
+		"signer": "1" + signer,
+		"bap_id": signer,
+		"blk":    map[string]interface{}{"i": height},
+		"MAP":    []interface{}{entry},
+	}
+}
+
+// commit writes the reactions of the docs as one block file
+func commit(t *testing.T, s store.Store, docs ...store.Doc) {
+	t.Helper()
+	ctx := context.Background()
+	b := NewBatch(s)
+	for _, doc := range docs {
+		b.Add(doc)
+	}
+	writes, err := b.Writes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for collection, w := range writes {
+		if err = s.UpsertTxs(ctx, collection, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// summary is the total, signer count and emojis of the reactions to post
+func summary(t *testing.T, s store.Store) string {
+	t.Helper()
+	r, err := Get(context.Background(), s, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%d %d %v", r.Total, r.SignerCount, r.Emojis)
+}
+
+func TestAdd(t *testing.T) {
+	// adding does not read the store
+	b := NewBatch(nil)
+	b.Add(like("l1", "like", "alice", "", 1))
+	b.Add(like("l1", "like", "alice", "", 1)) // written to another collection
+	unsigned := like("l2", "like", "bob", "", 1)
+	delete(unsigned, "signer")
+	delete(unsigned, "bap_id")
+	b.Add(unsigned)
+	b.Add(like("l3", "like", "bob", "", 0)) // not mined
+	b.Add(like("p1", "post", "bob", "", 1))
+	b.Add(store.Doc{"_id": "l4", "bap_id": "bob", "blk": map[string]interface{}{"i": 1},
+		"MAP": []interface{}{map[string]interface{}{"type": "like"}}})
+	if len(b.events) != 1 || b.events[0].Id != "l1_0" || b.events[0].By != "alice" {
+		t.Errorf("events = %+v", b.events)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name string
+		docs []store.Doc
+		want string
+	}{
+		{"likes", []store.Doc{
+			like("a", "like", "alice", "", 1),
+			like("b", "like", "alice", "🔥", 1),
+			like("c", "like", "bob", "🔥", 1),
+		}, "3 2 [{🔥 2} { 1}]"},
+		{"a like made again counts once", []store.Doc{
+			like("a", "like", "alice", "🔥", 1),
+			like("b", "like", "alice", "🔥", 2),
+		}, "1 1 [{🔥 1}]"},
+		{"unlike with an emoji", []store.Doc{
+			like("a", "like", "alice", "", 1),
+			like("b", "like", "alice", "🔥", 1),
+			like("c", "unlike", "alice", "🔥", 2),
+		}, "1 1 [{ 1}]"},
+		{"unlike without an emoji", []store.Doc{
+			like("a", "like", "alice", "", 1),
+			like("b", "like", "alice", "🔥", 1),
+			like("c", "like", "bob", "", 1),
+			like("d", "unlike", "alice", "", 2),
+		}, "1 1 [{ 1}]"},
+		{"like after an unlike", []store.Doc{
+			like("a", "like", "alice", "", 1),
+			like("b", "unlike", "alice", "", 2),
+			like("c", "like", "alice", "", 3),
+		}, "1 1 [{ 1}]"},
+		{"every like taken back", []store.Doc{
+			like("a", "like", "alice", "", 1),
+			like("b", "unlike", "alice", "", 2),
+		}, "0 0 []"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := storetest.Open(t)
+			for _, doc := range tt.docs {
+				commit(t, s, doc)
+			}
+			if got := summary(t, s); got != tt.want {
+				t.Errorf("reactions = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateOrder(t *testing.T) {
+	s, _ := storetest.Open(t)
+	// the unlike of block 2 is committed before the like of block 1
+	commit(t, s, like("b", "unlike", "alice", "", 2))
+	commit(t, s, like("a", "like", "alice", "", 1))
+	if got := summary(t, s); got != "0 0 []" {
+		t.Errorf("reactions = %s, want none", got)
+	}
+	// a block committed again gives the same aggregate
+	commit(t, s, like("a", "like", "alice", "", 1), like("c", "like", "bob", "", 1))
+	commit(t, s, like("a", "like", "alice", "", 1), like("c", "like", "bob", "", 1))
+	if got := summary(t, s); got != "1 1 [{ 1}]" {
+		t.Errorf("reactions = %s, want 1 1 [{ 1}]", got)
+	}
+
+	// a tx nobody reacted to has no aggregate but reads as empty lists
+	doc, err := s.GetTx(context.Background(), Collection, "nothing")
+	if err != store.ErrNotFound {
+		t.Errorf("aggregate of a tx nobody reacted to = %v, %v", doc, err)
+	}
+	if r, err := Get(context.Background(), s, "nothing"); err != nil || r.Signers == nil || r.Emojis == nil {
+		t.Errorf("Get of a tx nobody reacted to = %+v, %v", r, err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, _ := storetest.Open(t)
+	ctx := context.Background()
+	commit(t, s, like("a", "like", "alice", "", 1))
+	commit(t, s, like("b", "like", "bob", "🔥", 2), like("c", "unlike", "alice", "", 2))
+	if got := summary(t, s); got != "1 1 [{🔥 1}]" {
+		t.Fatalf("reactions = %s", got)
+	}
+
+	targets, err := Rollback(ctx, s, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0] != "post" {
+		t.Errorf("targets = %v, want [post]", targets)
+	}
+	if got := summary(t, s); got != "1 1 [{ 1}]" {
+		t.Errorf("reactions after rollback = %s, want 1 1 [{ 1}]", got)
+	}
+	if n, _ := s.Count(ctx, eventsCollection, store.Filter{}); n != 1 {
+		t.Errorf("%d events after rollback, want 1", n)
+	}
+
+	// every like rolled back leaves the aggregate zeroed
+	if _, err = Rollback(ctx, s, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := summary(t, s); got != "0 0 []" {
+		t.Errorf("reactions after rolling back everything = %s", got)
+	}
+	if _, err = s.GetTx(ctx, Collection, "post"); err != nil {
+		t.Errorf("zeroed aggregate: %v", err)
+	}
+}
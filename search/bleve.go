@@ -0,0 +1,178 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/token/unicodenorm"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// textAnalyzer splits text into words on Unicode boundaries and folds their
+// case and width, with no stemming or stop words, so every language is
+// matched the same way
+const textAnalyzer = "text"
+
+// bleveIndex is an embedded full-text index, keyed by txid. The docs it
+// matches are read from s.
+type bleveIndex struct {
+	index bleve.Index
+	s     store.Store
+}
+
+func openBleve(path string, s store.Store) (*bleveIndex, error) {
+	index, err := bleve.Open(path)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		var m mapping.IndexMapping
+		if m, err = indexMapping(); err != nil {
+			return nil, err
+		}
+		index, err = bleve.New(path, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening search index %s: %w", path, err)
+	}
+	return &bleveIndex{index: index, s: s}, nil
+}
+
+func indexMapping() (mapping.IndexMapping, error) {
+	m := bleve.NewIndexMapping()
+	err := m.AddCustomTokenFilter("nfkc", map[string]interface{}{
+		"type": unicodenorm.Name,
+		"form": unicodenorm.NFKC,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = m.AddCustomAnalyzer(textAnalyzer, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     unicode.Name,
+		"token_filters": []string{"nfkc", lowercase.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = textAnalyzer
+	text.Store = false
+	keywordField := func(stored bool) *mapping.FieldMapping {
+		f := bleve.NewKeywordFieldMapping()
+		f.Store = stored
+		return f
+	}
+	timestamp := bleve.NewNumericFieldMapping()
+	timestamp.Store = false
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("text", text)
+	doc.AddFieldMappingsAt("type", keywordField(false))
+	doc.AddFieldMappingsAt("app", keywordField(false))
+	doc.AddFieldMappingsAt("channel", keywordField(false))
+	doc.AddFieldMappingsAt("collections", keywordField(true))
+	doc.AddFieldMappingsAt("timestamp", timestamp)
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = textAnalyzer
+	return m, nil
+}
+
+func (b *bleveIndex) Add(ctx context.Context, docs []*Doc) error {
+	batch := b.index.NewBatch()
+	for _, d := range docs {
+		err := batch.Index(d.Id, map[string]interface{}{
+			"text":        d.Text,
+			"type":        d.Type,
+			"app":         d.App,
+			"channel":     d.Channel,
+			"collections": d.Collections,
+			"timestamp":   d.Timestamp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *bleveIndex) Delete(ctx context.Context, ids []string) error {
+	batch := b.index.NewBatch()
+	for _, id := range ids {
+		batch.Delete(id)
+	}
+	return b.index.Batch(batch)
+}
+
+// Search ranks the hits with Bleve's scoring and reads their docs from the
+// store
+func (b *bleveIndex) Search(ctx context.Context, cfg *config.Config, q Query) (*Results, error) {
+	text := bleve.NewMatchQuery(q.Text)
+	text.SetField("text")
+	conj := bleve.NewConjunctionQuery(text)
+	term := func(field string, value string) {
+		if value != "" {
+			t := bleve.NewTermQuery(value)
+			t.SetField(field)
+			conj.AddQuery(t)
+		}
+	}
+	term("type", q.Type)
+	term("app", q.App)
+	term("channel", q.Channel)
+	if q.Since > 0 || q.Until > 0 {
+		var since, until *float64
+		if q.Since > 0 {
+			since = &q.Since
+		}
+		if q.Until > 0 {
+			until = &q.Until
+		}
+		inclusive := true
+		span := bleve.NewNumericRangeInclusiveQuery(since, until, &inclusive, &inclusive)
+		span.SetField("timestamp")
+		conj.AddQuery(span)
+	}
+
+	req := bleve.NewSearchRequestOptions(conj, int(q.Limit), int(q.Skip), false)
+	req.Fields = []string{"collections"}
+	found, err := b.index.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Results{Hits: []Hit{}, Total: int64(found.Total)}
+	for _, match := range found.Hits {
+		var collections []string
+		switch c := match.Fields["collections"].(type) {
+		case string:
+			collections = []string{c}
+		case []interface{}:
+			for _, item := range c {
+				if s, ok := item.(string); ok {
+					collections = append(collections, s)
+				}
+			}
+		}
+		for _, collection := range collections {
+			doc, err := b.s.GetTx(ctx, collection, match.ID)
+			if err == store.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			res.Hits = append(res.Hits, Hit{Collection: collection, Score: match.Score, Doc: doc})
+			break
+		}
+	}
+	return res, nil
+}
+
+func (b *bleveIndex) Close() error {
+	return b.index.Close()
+}
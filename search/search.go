@@ -0,0 +1,190 @@
+// Package search indexes the text content of posts and messages, the UTF8
+// data of their B records, for full-text search. Stores with a native text
+// search, like MongoDB, are searched directly. Otherwise an embedded Bleve
+// index at search_path is kept up to date as blocks are written.
+package search
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Types are the MAP types whose content is searchable
+var Types = []string{"post", "message"}
+
+// textField is the path of the searchable content in a stored doc
+const textField = "B.Data.utf8"
+
+// Query is a full-text search. Empty filters match everything.
+type Query struct {
+	Text    string
+	Type    string  // MAP type, one of Types
+	App     string  // MAP app
+	Channel string  // MAP channel of a message
+	Since   float64 // earliest timestamp, 0 for no bound
+	Until   float64 // latest timestamp, 0 for no bound
+	Skip    int64
+	Limit   int64
+}
+
+// Hit is a matching document and its relevance
+type Hit struct {
+	Collection string    `json:"collection"`
+	Score      float64   `json:"score"`
+	Doc        store.Doc `json:"doc"`
+}
+
+// Results are the hits of a query, the most relevant first
+type Results struct {
+	Hits  []Hit `json:"hits"`
+	Total int64 `json:"total"` // matches of the query, not only the hits returned
+}
+
+// Doc is the searchable part of a post or message
+type Doc struct {
+	Id          string
+	Collections []string
+	Type        string
+	App         string
+	Channel     string
+	Text        string
+	Timestamp   float64
+}
+
+// Index searches the content of posts and messages
+type Index interface {
+	// Add indexes docs, replacing those with the same id
+	Add(ctx context.Context, docs []*Doc) error
+	// Delete removes the docs with the given ids
+	Delete(ctx context.Context, ids []string) error
+	Search(ctx context.Context, cfg *config.Config, q Query) (*Results, error)
+	Close() error
+}
+
+// Open opens the search index of the docs in s. Search is disabled, and Open
+// returns nil, if the store cannot search text and no search_path is set.
+func Open(ctx context.Context, cfg *config.Config, s store.Store) (Index, error) {
+	var idx Index
+	if searcher, ok := s.(store.TextSearcher); ok {
+		for _, collection := range cfg.Collections() {
+			if err := searcher.EnsureTextIndex(ctx, collection, textField); err != nil {
+				return nil, err
+			}
+		}
+		idx = &textIndex{s: searcher}
+	} else if cfg.SearchPath != "" {
+		b, err := openBleve(cfg.SearchPath, s)
+		if err != nil {
+			return nil, err
+		}
+		idx = b
+	}
+	return idx, nil
+}
+
+// Batch collects the posts and messages written with a block file, to index
+// once they are stored
+type Batch struct {
+	idx  Index
+	docs []*Doc
+	byId map[string]*Doc
+}
+
+// NewBatch returns an empty batch that adds to idx, which is nil if search
+// is disabled
+func NewBatch(idx Index) *Batch {
+	return &Batch{idx: idx, byId: map[string]*Doc{}}
+}
+
+// Add notes a write to collection, if it is a post or message with text
+func (b *Batch) Add(collection string, w store.Write) {
+	if d, ok := b.byId[idOf(w.Doc)]; ok {
+		if !slices.Contains(d.Collections, collection) {
+			d.Collections = append(d.Collections, collection)
+		}
+		return
+	}
+	d, ok := extract(w)
+	if !ok {
+		return
+	}
+	d.Collections = []string{collection}
+	b.docs = append(b.docs, d)
+	b.byId[d.Id] = d
+}
+
+// Index adds the batch to its index, if search is enabled
+func (b *Batch) Index(ctx context.Context) error {
+	if b.idx == nil || len(b.docs) == 0 {
+		return nil
+	}
+	return b.idx.Add(ctx, b.docs)
+}
+
+// Rollback removes the posts and messages of the blocks from height up,
+// which a reorg orphaned, from idx. The posts and messages are looked up in
+// collections of s. It does nothing if idx is nil.
+func Rollback(ctx context.Context, s store.Store, idx Index, collections []string, height uint32) error {
+	if idx == nil {
+		return nil
+	}
+	var ids []string
+	q := store.Query{Filter: store.Filter{"blk.i": store.Filter{"$gte": height}, "MAP.type": store.Filter{"$in": Types}}}
+	for _, collection := range collections {
+		err := store.Each(ctx, s, collection, q, func(doc store.Doc) error {
+			if id := idOf(doc); id != "" && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return idx.Delete(ctx, ids)
+}
+
+// extract returns the searchable part of a write. A mempool doc has its
+// time as a default.
+func extract(w store.Write) (*Doc, bool) {
+	d := &Doc{Id: idOf(w.Doc)}
+	for _, m := range store.Entries(w.Doc["MAP"]) {
+		mapType, _ := m["type"].(string)
+		if slices.Contains(Types, mapType) {
+			d.Type = mapType
+			d.App, _ = m["app"].(string)
+			d.Channel, _ = m["channel"].(string)
+			break
+		}
+	}
+
+	var texts []string
+	for _, record := range store.Entries(w.Doc["B"]) {
+		v, _ := store.Lookup(record, "Data.utf8")
+		if text, _ := v.(string); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	d.Text = strings.Join(texts, "\n")
+	if d.Id == "" || d.Type == "" || d.Text == "" {
+		return nil, false
+	}
+
+	var ok bool
+	if d.Timestamp, ok = store.ToFloat(w.Doc["timestamp"]); !ok {
+		d.Timestamp, _ = store.ToFloat(w.Defaults["timestamp"])
+	}
+	return d, true
+}
+
+func idOf(doc store.Doc) string {
+	id, _ := doc["_id"].(string)
+	return id
+}
@@ -0,0 +1,129 @@
+package search
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// bmapDoc is a doc of the given MAP type with B text, mined at height
+// unless it is 0
+func bmapDoc(txid string, mapType string, channel string, text string, height int, timestamp int64) store.Doc {
+	entry := map[string]interface{}{"type": mapType, "app": "bsocial"}
+	if channel != "" {
+		entry["context"], entry["channel"] = "channel", channel
+	}
+	doc := store.Doc{
+		"_id":       txid,
+		"timestamp": timestamp,
+		"MAP":       []interface{}{entry},
+		"B":         []interface{}{map[string]interface{}{"Data": map[string]interface{}{"utf8": text}}},
+	}
+	if height > 0 {
+		doc["blk"] = map[string]interface{}{"i": height}
+	}
+	return doc
+}
+
+func TestExtract(t *testing.T) {
+	mempool := store.Write{Doc: bmapDoc("m", "message", "general", "hi", 0, 0), Defaults: store.Doc{"timestamp": int64(7)}}
+	delete(mempool.Doc, "timestamp")
+	twoRecords := bmapDoc("p", "post", "", "first", 1, 1)
+	twoRecords["B"] = append(twoRecords["B"].([]interface{}), map[string]interface{}{"Data": map[string]interface{}{"utf8": "second"}})
+
+	tests := []struct {
+		name string
+		w    store.Write
+		want *Doc
+	}{
+		{"post", store.Write{Doc: bmapDoc("p", "post", "", "hello", 1, 5)}, &Doc{Id: "p", Type: "post", App: "bsocial", Text: "hello", Timestamp: 5}},
+		{"mempool message", mempool, &Doc{Id: "m", Type: "message", App: "bsocial", Channel: "general", Text: "hi", Timestamp: 7}},
+		{"B records joined", store.Write{Doc: twoRecords}, &Doc{Id: "p", Type: "post", App: "bsocial", Text: "first\nsecond", Timestamp: 1}},
+		{"like", store.Write{Doc: bmapDoc("l", "like", "", "hello", 1, 5)}, nil},
+		{"no text", store.Write{Doc: bmapDoc("p", "post", "", "", 1, 5)}, nil},
+	}
+	for _, tt := range tests {
+		d, ok := extract(tt.w)
+		if ok != (tt.want != nil) {
+			t.Errorf("%s: extract = %+v, %v", tt.name, d, ok)
+			continue
+		}
+		if ok && (d.Id != tt.want.Id || d.Type != tt.want.Type || d.App != tt.want.App ||
+			d.Channel != tt.want.Channel || d.Text != tt.want.Text || d.Timestamp != tt.want.Timestamp) {
+			t.Errorf("%s: extract = %+v, want %+v", tt.name, d, tt.want)
+		}
+	}
+}
+
+func TestBleve(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	cfg.SearchPath = filepath.Join(t.TempDir(), "search")
+	ctx := context.Background()
+	idx, err := Open(ctx, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+
+	docs := map[string]store.Doc{
+		"p1": bmapDoc("p1", "post", "", "Hello World", 1, 10),
+		"p2": bmapDoc("p2", "post", "", "ＨＥＬＬＯ again", 2, 20),
+		"m1": bmapDoc("m1", "message", "general", "hello there", 2, 30),
+	}
+	b := NewBatch(idx)
+	for _, id := range []string{"p1", "p2", "m1"} {
+		doc := docs[id]
+		collection := doc["MAP"].([]interface{})[0].(map[string]interface{})["type"].(string)
+		if err := s.UpsertTx(ctx, collection, doc); err != nil {
+			t.Fatal(err)
+		}
+		b.Add(collection, store.Write{Doc: doc})
+	}
+	if err := b.Index(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want int64
+	}{
+		{"folded case and width", Query{Text: "hello"}, 3},
+		{"type", Query{Text: "hello", Type: "post"}, 2},
+		{"channel", Query{Text: "hello", Channel: "general"}, 1},
+		{"since", Query{Text: "hello", Since: 15}, 2},
+		{"until", Query{Text: "hello", Until: 15}, 1},
+		{"no match", Query{Text: "goodbye"}, 0},
+	}
+	for _, tt := range tests {
+		tt.q.Limit = 10
+		res, err := idx.Search(ctx, cfg, tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Total != tt.want || int64(len(res.Hits)) != tt.want {
+			t.Errorf("%s: %d hits of %d, want %d", tt.name, len(res.Hits), res.Total, tt.want)
+		}
+	}
+	res, err := idx.Search(ctx, cfg, Query{Text: "there", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 1 || res.Hits[0].Collection != "message" || res.Hits[0].Doc["_id"] != "m1" {
+		t.Errorf("hits = %+v", res.Hits)
+	}
+
+	// the posts and messages of the rolled back blocks leave the index
+	if err = Rollback(ctx, s, idx, cfg.Collections(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = idx.Search(ctx, cfg, Query{Text: "hello", Limit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 1 || res.Hits[0].Doc["_id"] != "p1" {
+		t.Errorf("hits after rollback = %+v", res.Hits)
+	}
+}
@@ -0,0 +1,91 @@
+package search
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// textIndex searches with the text indexes of the store, which index docs as
+// they are written
+type textIndex struct {
+	s store.TextSearcher
+}
+
+func (t *textIndex) Add(ctx context.Context, docs []*Doc) error {
+	return nil
+}
+
+// Delete does nothing, as orphaned docs are filtered out of the searches
+func (t *textIndex) Delete(ctx context.Context, ids []string) error {
+	return nil
+}
+
+// Search queries every collection and merges the hits by score. A doc
+// written to several collections is returned once, but counted in Total for
+// each of them.
+func (t *textIndex) Search(ctx context.Context, cfg *config.Config, q Query) (*Results, error) {
+	filter := store.Filter{
+		"MAP.type": store.Filter{"$in": Types},
+		"status":   store.Filter{"$ne": "orphaned"}, // crawler.StatusOrphaned
+	}
+	if q.Type != "" {
+		filter["MAP.type"] = q.Type
+	}
+	if q.App != "" {
+		filter["MAP.app"] = q.App
+	}
+	if q.Channel != "" {
+		filter["MAP.channel"] = q.Channel
+	}
+	if q.Since > 0 || q.Until > 0 {
+		span := store.Filter{}
+		if q.Since > 0 {
+			span["$gte"] = q.Since
+		}
+		if q.Until > 0 {
+			span["$lte"] = q.Until
+		}
+		filter["timestamp"] = span
+	}
+
+	res := &Results{Hits: []Hit{}}
+	seen := map[interface{}]bool{}
+	for _, collection := range cfg.Collections() {
+		count, err := t.s.CountText(ctx, collection, q.Text, filter)
+		if err != nil {
+			return nil, fmt.Errorf("searching %s: %w", collection, err)
+		}
+		if res.Total += count; count == 0 {
+			continue
+		}
+		docs, err := t.s.SearchText(ctx, collection, q.Text, filter, q.Skip+q.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("searching %s: %w", collection, err)
+		}
+		for _, doc := range docs {
+			if seen[doc["_id"]] {
+				continue
+			}
+			seen[doc["_id"]] = true
+			score, _ := store.ToFloat(doc["score"])
+			delete(doc, "score")
+			res.Hits = append(res.Hits, Hit{Collection: collection, Score: score, Doc: doc})
+		}
+	}
+
+	slices.SortStableFunc(res.Hits, func(a, b Hit) int {
+		return cmp.Compare(b.Score, a.Score)
+	})
+	res.Hits = res.Hits[min(q.Skip, int64(len(res.Hits))):]
+	res.Hits = res.Hits[:min(q.Limit, int64(len(res.Hits)))]
+	return res, nil
+}
+
+func (t *textIndex) Close() error {
+	return nil
+}
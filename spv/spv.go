@@ -0,0 +1,151 @@
+// Package spv checks that mined txs are in their block, by verifying their
+// merkle proofs against block headers
+package spv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/GorillaPool/go-junglebus"
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/bitcoin-sv/go-sdk/transaction"
+	"github.com/bitcoin-sv/go-sdk/transaction/chaintracker"
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/headers"
+)
+
+// ErrUnverified is wrapped by the errors of a tx that failed verification,
+// as opposed to a verification that could not be done
+var ErrUnverified = errors.New("tx not verified")
+
+// Verifier checks merkle proofs, fetching them from junglebus when a tx
+// comes without one
+type Verifier struct {
+	Headers chaintracker.ChainTracker
+	Fetch   func(ctx context.Context, txid string) ([]byte, error) // returns the BUMP of a tx, or nil if it has none
+
+	mu    sync.Mutex
+	roots map[uint32]chainhash.Hash // merkle roots the headers confirmed
+}
+
+// waiter is a chain tracker that can fetch a header it does not have yet
+type waiter interface {
+	WaitFor(ctx context.Context, height uint32) error
+}
+
+// Open builds a verifier that checks proofs against chain, fetching the
+// proofs txs come without from junglebus
+func Open(cfg *config.Config, chain *headers.Chain) (*Verifier, error) {
+	client, err := junglebus.New(junglebus.WithHTTP(cfg.JunglebusEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		Headers: chain,
+		Fetch: func(ctx context.Context, txid string) ([]byte, error) {
+			tx, err := client.GetTransaction(ctx, txid)
+			if err != nil {
+				return nil, err
+			}
+			return tx.MerkleProof, nil
+		},
+	}, nil
+}
+
+// Verify checks txid is mined in the block at height. The proof may be a BUMP
+// or a BEEF containing the tx, and is fetched if it is empty. An invalid or
+// missing proof returns an error wrapping ErrUnverified, other errors mean
+// the tx could not be checked and may be retried. A block whose header is
+// not synced yet returns an error wrapping headers.ErrNotSynced.
+func (v *Verifier) Verify(ctx context.Context, txid string, height uint32, proof []byte) error {
+	hash, err := chainhash.NewHashFromHex(txid)
+	if err != nil {
+		return err
+	}
+	if len(proof) == 0 && v.Fetch != nil {
+		if proof, err = v.Fetch(ctx, txid); err != nil {
+			return fmt.Errorf("fetching merkle proof: %w", err)
+		}
+	}
+	if len(proof) == 0 {
+		return fmt.Errorf("%w: no merkle proof", ErrUnverified)
+	}
+
+	path, err := parseProof(txid, proof)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnverified, err)
+	}
+	if path.BlockHeight != height {
+		return fmt.Errorf("%w: proof is for block %d, not %d", ErrUnverified, path.BlockHeight, height)
+	}
+	root, err := path.ComputeRoot(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnverified, err)
+	}
+
+	v.mu.Lock()
+	known, ok := v.roots[height]
+	v.mu.Unlock()
+	if ok {
+		if !known.IsEqual(root) {
+			return fmt.Errorf("%w: merkle root %s is not block %d's", ErrUnverified, root, height)
+		}
+		return nil
+	}
+
+	valid, err := v.Headers.IsValidRootForHeight(root, height)
+	if w, ok := v.Headers.(waiter); ok && errors.Is(err, headers.ErrNotSynced) {
+		// the txs of a new block can arrive before its header
+		if err = w.WaitFor(ctx, height); err == nil {
+			valid, err = v.Headers.IsValidRootForHeight(root, height)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("checking merkle root of block %d: %w", height, err)
+	}
+	if !valid {
+		return fmt.Errorf("%w: merkle root %s is not block %d's", ErrUnverified, root, height)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.roots == nil {
+		v.roots = map[uint32]chainhash.Hash{}
+	}
+	v.roots[height] = *root
+	return nil
+}
+
+// Forget drops the merkle root remembered for height, after a reorg
+func (v *Verifier) Forget(height uint32) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.roots, height)
+}
+
+// parseProof reads a BUMP, or the BUMP of txid from a BEEF
+func parseProof(txid string, proof []byte) (*transaction.MerklePath, error) {
+	if len(proof) >= 4 {
+		switch binary.LittleEndian.Uint32(proof) {
+		case transaction.BEEF_V1, transaction.BEEF_V2:
+			beef, err := transaction.NewBeefFromBytes(proof)
+			if err != nil {
+				return nil, fmt.Errorf("invalid BEEF: %w", err)
+			}
+			path := beef.FindBump(txid)
+			if path == nil {
+				return nil, errors.New("BEEF has no merkle path for the tx")
+			}
+			return path, nil
+		}
+	}
+	path, err := transaction.NewMerklePathFromReader(bytes.NewReader(proof))
+	if err != nil {
+		return nil, fmt.Errorf("invalid BUMP: %w", err)
+	}
+	return path, nil
+}
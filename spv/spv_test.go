@@ -0,0 +1,123 @@
+package spv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bitcoin-sv/go-sdk/chainhash"
+	"github.com/bitcoin-sv/go-sdk/transaction"
+	"github.com/rohenaz/go-bmap-indexer/headers"
+)
+
+// chain is a chain tracker with the headers up to synced, which WaitFor
+// syncs up to the height asked for
+type chain struct {
+	roots  map[uint32]*chainhash.Hash
+	synced uint32
+	checks int
+}
+
+func (c *chain) IsValidRootForHeight(root *chainhash.Hash, height uint32) (bool, error) {
+	c.checks++
+	if height > c.synced {
+		return false, headers.ErrNotSynced
+	}
+	return c.roots[height] != nil && c.roots[height].IsEqual(root), nil
+}
+
+func (c *chain) WaitFor(ctx context.Context, height uint32) error {
+	c.synced = height
+	return nil
+}
+
+// block returns the txid of a tx in a block of two, its BUMP and the
+// merkle root of the block
+func block(t *testing.T, height uint32) (txid string, proof []byte, root *chainhash.Hash) {
+	t.Helper()
+	a, b := chainhash.DoubleHashH([]byte("a")), chainhash.DoubleHashH([]byte("b"))
+	isTxid := true
+	path := transaction.NewMerklePath(height, [][]*transaction.PathElement{{
+		{Offset: 0, Hash: &a, Txid: &isTxid},
+		{Offset: 1, Hash: &b},
+	}})
+	root, err := path.ComputeRoot(&a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.String(), path.Bytes(), root
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	txid, proof, root := block(t, 10)
+	other := chainhash.DoubleHashH([]byte("c")).String()
+	c := &chain{roots: map[uint32]*chainhash.Hash{10: root}, synced: 10}
+	v := &Verifier{Headers: c}
+
+	if err := v.Verify(ctx, txid, 10, proof); err != nil {
+		t.Fatal(err)
+	}
+	// the root of a checked block is remembered
+	if err := v.Verify(ctx, txid, 10, proof); err != nil || c.checks != 1 {
+		t.Errorf("second Verify = %v, after %d header checks", err, c.checks)
+	}
+
+	tests := []struct {
+		name   string
+		txid   string
+		height uint32
+		proof  []byte
+	}{
+		{"no proof", txid, 10, nil},
+		{"another block", txid, 11, proof},
+		{"tx not in the proof", other, 10, proof},
+		{"garbage proof", txid, 10, []byte{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		if err := v.Verify(ctx, tt.txid, tt.height, tt.proof); !errors.Is(err, ErrUnverified) {
+			t.Errorf("%s: Verify = %v, want ErrUnverified", tt.name, err)
+		}
+	}
+
+	// a root the headers do not confirm
+	v.Forget(10)
+	c.roots[10] = &chainhash.Hash{}
+	if err := v.Verify(ctx, txid, 10, proof); !errors.Is(err, ErrUnverified) {
+		t.Errorf("Verify against another root = %v, want ErrUnverified", err)
+	}
+	if err := v.Verify(ctx, "not a txid", 10, proof); err == nil || errors.Is(err, ErrUnverified) {
+		t.Errorf("Verify of a bad txid = %v", err)
+	}
+}
+
+func TestVerifyFetch(t *testing.T) {
+	ctx := context.Background()
+	txid, proof, root := block(t, 20)
+	c := &chain{roots: map[uint32]*chainhash.Hash{20: root}, synced: 19}
+	fetchErr := errors.New("junglebus is down")
+	var fetched []byte
+	var err error
+	v := &Verifier{Headers: c, Fetch: func(ctx context.Context, txid string) ([]byte, error) {
+		return fetched, err
+	}}
+
+	// a fetch that fails can be retried, a tx without a proof cannot
+	err = fetchErr
+	if got := v.Verify(ctx, txid, 20, nil); !errors.Is(got, fetchErr) || errors.Is(got, ErrUnverified) {
+		t.Errorf("Verify with a failing fetch = %v", got)
+	}
+	err = nil
+	if got := v.Verify(ctx, txid, 20, nil); !errors.Is(got, ErrUnverified) {
+		t.Errorf("Verify without a proof = %v, want ErrUnverified", got)
+	}
+
+	// the proof is fetched, and the header waited for
+	fetched = proof
+	if got := v.Verify(ctx, txid, 20, nil); got != nil {
+		t.Errorf("Verify with a fetched proof = %v", got)
+	}
+	if c.synced != 20 {
+		t.Errorf("headers synced to %d, want 20", c.synced)
+	}
+}
@@ -0,0 +1,284 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/reaction"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Collections of the social graph derived from the friend and repost MAP
+// entries of confirmed txs. Likes are counted from the reaction aggregates,
+// which apply unlikes.
+const (
+	FollowsCollection = "follows"  // follower to followed edges, keyed by follower_followed
+	CountsCollection  = "counts"   // like and repost counts, keyed by the target txid
+	repostsCollection = "_reposts" // every repost, keyed by its txid
+)
+
+// graphProgress is the id of the state document holding the last block the
+// graph was built to
+const graphProgress = "graph"
+
+// edge is a follow or repost from one identity to another or to a tx
+type edge struct {
+	collection string
+	id         string
+	doc        store.Doc
+}
+
+// edges returns the graph edges of a confirmed doc. The actor is the BAP
+// identity of the signer, or the signing address when it has none, so
+// unsigned txs add nothing.
+func edges(doc store.Doc) (found []edge) {
+	txid, _ := doc["_id"].(string)
+	from, _ := doc["bap_id"].(string)
+	if from == "" {
+		from, _ = doc["signer"].(string)
+	}
+	if from == "" || txid == "" {
+		return nil
+	}
+	blk, _ := store.Lookup(doc, "blk.i")
+	height := store.ToInt(blk)
+
+	for _, m := range store.Entries(doc["MAP"]) {
+		mapType, _ := m["type"].(string)
+		switch mapType {
+		case "friend":
+			to, _ := m["bapID"].(string)
+			if to == "" || to == from {
+				continue
+			}
+			found = append(found, edge{FollowsCollection, from + "_" + to, store.Doc{
+				"_id": from + "_" + to, "from": from, "to": to, "txid": txid, "height": height,
+			}})
+		case "repost":
+			target, _ := m["tx"].(string)
+			if target == "" {
+				continue
+			}
+			found = append(found, edge{repostsCollection, txid, store.Doc{
+				"_id": txid, "from": from, "tx": target, "txid": txid, "height": height,
+			}})
+		}
+	}
+	return found
+}
+
+// liked returns the txs a confirmed doc likes or unlikes
+func liked(doc store.Doc) (targets []string) {
+	for _, m := range store.Entries(doc["MAP"]) {
+		mapType, _ := m["type"].(string)
+		target, _ := m["tx"].(string)
+		if (mapType == "like" || mapType == "unlike") && target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// graphBatchSize is the most edges looked up and written at once
+const graphBatchSize = 1000
+
+// buildGraph adds the edges of the confirmed docs of the blocks from..to to
+// the graph and recounts the txs they target. Docs are read in block order,
+// and an edge that already exists is kept as first seen, so the graph is the
+// same however the blocks are split between builds.
+func buildGraph(ctx context.Context, s store.Store, cfg *config.Config, from uint32, to uint32) (added int, err error) {
+	seen := map[string]bool{}
+	var targets []string
+	target := func(txid string) {
+		if !seen["tx/"+txid] {
+			seen["tx/"+txid] = true
+			targets = append(targets, txid)
+		}
+	}
+
+	var pending []edge
+	flush := func() error {
+		created, err := addEdges(ctx, s, pending)
+		if err != nil {
+			return err
+		}
+		added += len(created)
+		for _, e := range created {
+			if txid, ok := e.doc["tx"].(string); ok {
+				target(txid)
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	q := store.Query{
+		Filter: store.Filter{
+			"blk.i":  store.Filter{"$gte": from, "$lte": to},
+			"status": "confirmed", // crawler.StatusConfirmed
+		},
+		SortBy: "blk.i",
+	}
+	for _, collection := range cfg.Collections() {
+		err = store.Each(ctx, s, collection, q, func(doc store.Doc) error {
+			for _, txid := range liked(doc) {
+				target(txid)
+			}
+			for _, e := range edges(doc) {
+				key := e.collection + "/" + e.id
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				if pending = append(pending, e); len(pending) >= graphBatchSize {
+					return flush()
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return added, fmt.Errorf("building graph from %s: %w", collection, err)
+		}
+	}
+	return added, recount(ctx, s, targets)
+}
+
+// addEdges writes the edges that are not in the graph yet and returns them
+func addEdges(ctx context.Context, s store.Store, edges []edge) (created []edge, err error) {
+	ids := map[string][]interface{}{}
+	for _, e := range edges {
+		ids[e.collection] = append(ids[e.collection], e.id)
+	}
+	exists := map[string]bool{}
+	for collection, list := range ids {
+		q := store.Query{Filter: store.Filter{"_id": store.Filter{"$in": list}}}
+		err = store.Each(ctx, s, collection, q, func(doc store.Doc) error {
+			exists[collection+"/"+fmt.Sprint(doc["_id"])] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writes := map[string][]store.Write{}
+	for _, e := range edges {
+		if !exists[e.collection+"/"+e.id] {
+			writes[e.collection] = append(writes[e.collection], store.Write{Doc: e.doc})
+			created = append(created, e)
+		}
+	}
+	for collection, w := range writes {
+		if err = s.UpsertTxs(ctx, collection, w); err != nil {
+			return nil, err
+		}
+	}
+	return created, nil
+}
+
+// recount sets the like and repost counts of the target txs, from their
+// reaction aggregate and their repost edges. A liker counts once per target.
+func recount(ctx context.Context, s store.Store, targets []string) error {
+	for _, target := range targets {
+		r, err := reaction.Get(ctx, s, target)
+		if err != nil {
+			return err
+		}
+		likes := int64(r.SignerCount)
+		reposts, err := s.Count(ctx, repostsCollection, store.Filter{"tx": target})
+		if err != nil {
+			return err
+		}
+		if likes == 0 && reposts == 0 {
+			if err = s.DeleteTx(ctx, CountsCollection, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = s.UpsertTx(ctx, CountsCollection, store.Doc{"_id": target, "likes": likes, "reposts": reposts}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback removes the graph edges and reactions of the blocks from height
+// up, recounting the txs they targeted, so the graph can be built again on
+// the new chain
+func Rollback(ctx context.Context, s store.Store, height uint32) error {
+	// the like counts are read from the rolled back aggregates
+	targets, err := reaction.Rollback(ctx, s, height)
+	if err != nil {
+		return fmt.Errorf("rolling back reactions: %w", err)
+	}
+	for _, collection := range []string{FollowsCollection, repostsCollection} {
+		var ids []interface{}
+		q := store.Query{Filter: store.Filter{"height": store.Filter{"$gte": height}}}
+		err := store.Each(ctx, s, collection, q, func(doc store.Doc) error {
+			ids = append(ids, doc["_id"])
+			if target, ok := doc["tx"].(string); ok && !slices.Contains(targets, target) {
+				targets = append(targets, target)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err = s.DeleteTx(ctx, collection, id); err != nil {
+				return err
+			}
+		}
+	}
+	if err = recount(ctx, s, targets); err != nil {
+		return err
+	}
+
+	built, ok, err := graphHeight(ctx, s)
+	if err != nil || !ok || built < height {
+		return err
+	}
+	return saveGraphHeight(ctx, s, height-1)
+}
+
+// ClearState drops the social graph, so the next SyncState rebuilds it from
+// height 0
+func ClearState(ctx context.Context, s store.Store) error {
+	for _, collection := range []string{FollowsCollection, CountsCollection, repostsCollection} {
+		if err := s.DropCollection(ctx, collection); err != nil {
+			return err
+		}
+	}
+	return s.DeleteTx(ctx, store.StateCollection, graphProgress)
+}
+
+// graphHeight returns the last block the graph was built to
+func graphHeight(ctx context.Context, s store.Store) (height uint32, ok bool, err error) {
+	doc, err := s.GetTx(ctx, store.StateCollection, graphProgress)
+	if err == store.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return uint32(store.ToInt(doc["height"])), true, nil
+}
+
+func saveGraphHeight(ctx context.Context, s store.Store, height uint32) error {
+	return s.UpsertTx(ctx, store.StateCollection, store.Doc{"_id": graphProgress, "height": int64(height)})
+}
+
+// EnsureIndexes creates the indexes the graph is counted and rolled back by
+func EnsureIndexes(ctx context.Context, s store.Store) error {
+	if err := store.EnsureIndex(ctx, s, repostsCollection, "tx"); err != nil {
+		return err
+	}
+	if err := store.EnsureIndex(ctx, s, repostsCollection, "height"); err != nil {
+		return err
+	}
+	return store.EnsureIndex(ctx, s, FollowsCollection, "height")
+}
@@ -0,0 +1,216 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/reaction"
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// mined writes a confirmed doc with one MAP entry to the collection of its
+// type, with its reactions, as a block commit does
+func mined(t *testing.T, s store.Store, txid string, height int, from string, entry map[string]interface{}) {
+	t.Helper()
+	ctx := context.Background()
+	doc := store.Doc{
+		"_id":    txid,
+		"bap_id": from,
+		"status": "confirmed",
+		"blk":    map[string]interface{}{"i": height},
+		"MAP":    []interface{}{entry},
+	}
+	if err := s.UpsertTx(ctx, entry["type"].(string), doc); err != nil {
+		t.Fatal(err)
+	}
+	reactions := reaction.NewBatch(s)
+	reactions.Add(doc)
+	writes, err := reactions.Writes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for collection, w := range writes {
+		if err = s.UpsertTxs(ctx, collection, w); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func counts(t *testing.T, s store.Store, target string) (likes int64, reposts int64) {
+	t.Helper()
+	doc, err := s.GetTx(context.Background(), CountsCollection, target)
+	if err == store.ErrNotFound {
+		return 0, 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return store.ToInt(doc["likes"]), store.ToInt(doc["reposts"])
+}
+
+func TestEdges(t *testing.T) {
+	doc := store.Doc{
+		"_id":    "tx",
+		"signer": "1Address",
+		"blk":    map[string]interface{}{"i": 5.0},
+		"MAP": []interface{}{
+			map[string]interface{}{"type": "friend", "bapID": "bob"},
+			map[string]interface{}{"type": "friend", "bapID": "1Address"},
+			map[string]interface{}{"type": "repost", "tx": "post"},
+			map[string]interface{}{"type": "like", "tx": "post"},
+			map[string]interface{}{"type": "repost"},
+		},
+	}
+	found := edges(doc)
+	want := []string{FollowsCollection + "/1Address_bob", repostsCollection + "/tx"}
+	if len(found) != len(want) {
+		t.Fatalf("edges = %v, want %v", found, want)
+	}
+	for i, e := range found {
+		if got := e.collection + "/" + e.id; got != want[i] {
+			t.Errorf("edge %d = %s, want %s", i, got, want[i])
+		}
+		if store.ToInt(e.doc["height"]) != 5 {
+			t.Errorf("edge %d height = %v, want 5", i, e.doc["height"])
+		}
+	}
+	if targets := liked(doc); len(targets) != 1 || targets[0] != "post" {
+		t.Errorf("liked = %v, want [post]", targets)
+	}
+
+	delete(doc, "signer")
+	if found = edges(doc); found != nil {
+		t.Errorf("edges of an unsigned doc = %v", found)
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+
+	mined(t, s, "f1", 1, "alice", map[string]interface{}{"type": "friend", "bapID": "bob"})
+	mined(t, s, "f2", 2, "alice", map[string]interface{}{"type": "friend", "bapID": "bob"})
+	mined(t, s, "l1", 1, "alice", map[string]interface{}{"type": "like", "tx": "post"})
+	mined(t, s, "l2", 2, "alice", map[string]interface{}{"type": "like", "tx": "post", "emoji": "🔥"})
+	mined(t, s, "l3", 2, "bob", map[string]interface{}{"type": "like", "tx": "post"})
+	mined(t, s, "r1", 2, "bob", map[string]interface{}{"type": "repost", "tx": "post"})
+
+	added, err := buildGraph(ctx, s, cfg, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 2 {
+		t.Errorf("added %d edges, want 2", added)
+	}
+	follow, err := s.GetTx(ctx, FollowsCollection, "alice_bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first follow is kept
+	if follow["txid"] != "f1" {
+		t.Errorf("follow txid = %v, want f1", follow["txid"])
+	}
+	// a liker counts once, whatever emojis they used
+	if likes, reposts := counts(t, s, "post"); likes != 2 || reposts != 1 {
+		t.Errorf("counts = %d likes, %d reposts, want 2, 1", likes, reposts)
+	}
+
+	// an unlike takes the like back from the count
+	mined(t, s, "u1", 3, "bob", map[string]interface{}{"type": "unlike", "tx": "post"})
+	if added, err = buildGraph(ctx, s, cfg, 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Errorf("added %d edges, want 0", added)
+	}
+	if likes, reposts := counts(t, s, "post"); likes != 1 || reposts != 1 {
+		t.Errorf("counts after the unlike = %d likes, %d reposts, want 1, 1", likes, reposts)
+	}
+	r, err := reaction.Get(ctx, s, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(r.SignerCount) != 1 {
+		t.Errorf("reaction signers = %d, want the like count", r.SignerCount)
+	}
+
+	// building the same blocks again changes nothing
+	if added, err = buildGraph(ctx, s, cfg, 1, 3); err != nil || added != 0 {
+		t.Errorf("building again added %d edges, %v", added, err)
+	}
+}
+
+func TestBuildGraphBatches(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+	n := graphBatchSize + 10
+	writes := make([]store.Write, n)
+	for i := range writes {
+		writes[i] = store.Write{Doc: store.Doc{
+			"_id":    fmt.Sprintf("f%d", i),
+			"bap_id": fmt.Sprintf("user%d", i),
+			"status": "confirmed",
+			"blk":    map[string]interface{}{"i": 1},
+			"MAP":    []interface{}{map[string]interface{}{"type": "friend", "bapID": "bob"}},
+		}}
+	}
+	if err := s.UpsertTxs(ctx, "friend", writes); err != nil {
+		t.Fatal(err)
+	}
+	added, err := buildGraph(ctx, s, cfg, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != n {
+		t.Errorf("added %d edges, want %d", added, n)
+	}
+	if count, _ := s.Count(ctx, FollowsCollection, store.Filter{"to": "bob"}); count != int64(n) {
+		t.Errorf("%d follows, want %d", count, n)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, cfg := storetest.Open(t)
+	ctx := context.Background()
+
+	mined(t, s, "f1", 1, "alice", map[string]interface{}{"type": "friend", "bapID": "bob"})
+	mined(t, s, "l1", 1, "alice", map[string]interface{}{"type": "like", "tx": "post"})
+	mined(t, s, "f2", 2, "bob", map[string]interface{}{"type": "friend", "bapID": "alice"})
+	mined(t, s, "l2", 2, "bob", map[string]interface{}{"type": "like", "tx": "post"})
+	mined(t, s, "u1", 2, "alice", map[string]interface{}{"type": "unlike", "tx": "post"})
+	mined(t, s, "r1", 2, "bob", map[string]interface{}{"type": "repost", "tx": "post"})
+	if err := s.SaveProgress(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if height, err := SyncState(ctx, s, cfg); err != nil || height != 2 {
+		t.Fatalf("SyncState = %d, %v", height, err)
+	}
+	if likes, reposts := counts(t, s, "post"); likes != 1 || reposts != 1 {
+		t.Errorf("counts = %d likes, %d reposts, want 1, 1", likes, reposts)
+	}
+
+	if err := Rollback(ctx, s, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetTx(ctx, FollowsCollection, "bob_alice"); err != store.ErrNotFound {
+		t.Errorf("follow of block 2 after rollback = %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetTx(ctx, FollowsCollection, "alice_bob"); err != nil {
+		t.Errorf("follow of block 1 after rollback: %v", err)
+	}
+	// the unlike of block 2 is rolled back with the like
+	if likes, reposts := counts(t, s, "post"); likes != 1 || reposts != 0 {
+		t.Errorf("counts after rollback = %d likes, %d reposts, want 1, 0", likes, reposts)
+	}
+	if height, ok, err := graphHeight(ctx, s); err != nil || !ok || height != 1 {
+		t.Errorf("graph height after rollback = %d, %v, %v, want 1", height, ok, err)
+	}
+
+	if err := ClearState(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := graphHeight(ctx, s); ok || err != nil {
+		t.Errorf("graph height after ClearState = %v, %v", ok, err)
+	}
+}
@@ -1,27 +1,24 @@
 package state
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/rohenaz/go-bmap-indexer/config"
-	"github.com/rohenaz/go-bmap-indexer/database"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/rohenaz/go-bmap-indexer/store"
 )
 
 // TODO: This should use redis instead of mongo
 
-// SaveProgress persists the block height to the database
-func SaveProgress(height uint32) {
+// SaveProgress persists the block height to the store
+func SaveProgress(s store.Store, height uint32) {
 	if height > 0 {
 
-		// persist our progress to the database
-		// TODO save height to _state collection
-		// { _id: 'height', value: height }
-		conn := database.GetConnection()
-
-		_, err := conn.UpsertOne("_state", bson.M{"_id": "_state"}, bson.M{"height": height})
+		// persist our progress to the _state collection
+		// { _id: '_state', height: height }
+		err := s.SaveProgress(context.Background(), height)
 		if err != nil {
 			log.Printf("[ERROR]: %v", err)
 			return
@@ -30,70 +27,76 @@ func SaveProgress(height uint32) {
 
 }
 
-// LoadProgress loads the block height from the database
-func LoadProgress() (height uint32) {
+// LoadProgress loads the block height from the store
+func LoadProgress(s store.Store, cfg *config.Config) (height uint32) {
 
 	// load height from _state collection
-
-	conn := database.GetConnection()
-
-	doc, err := conn.GetStateDocs("_state", 1, 0, bson.M{"_id": "_state"})
+	height, ok, err := s.LoadProgress(context.Background())
 	if err != nil {
 		log.Printf("[ERROR]: %v", err)
 		return
 	}
 
-	if len(doc) == 0 {
+	if !ok {
 		log.Printf("[ERROR]: No state found")
 
 		// create initial state document
-		conn.UpsertOne("_state", bson.M{"_id": "_state"}, bson.M{"height": uint32(config.FromBlock)})
+		if err = s.SaveProgress(context.Background(), cfg.FromBlock); err != nil {
+			log.Printf("[ERROR]: %v", err)
+		}
 
-		height = config.FromBlock
+		height = cfg.FromBlock
 		return
 	}
 
-	// use the []primitive.M to get the height value
-	height = uint32(doc[0]["height"].(int64))
-
 	return
 }
 
-func build(fromBlock int, trust bool) (stateBlock int) {
-	// if there are no txs to process, return the same thing we sent in
-	stateBlock = fromBlock
-
-	// var numPerPass int = 100
-
-	// Query x records at a time in a loop
-	// ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-
-	conn := database.GetConnection()
-
-	// defer conn.Disconnect(ctx)
-
-	// Clear old state
+// build adds the blocks after the graph's height up to toBlock to the
+// social graph, starting from height 0 when there is no graph yet, and
+// returns the height the graph is built to
+func build(ctx context.Context, s store.Store, cfg *config.Config, toBlock uint32) (stateBlock uint32, err error) {
+	built, ok, err := graphHeight(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	fromBlock := uint32(0)
+	if ok {
+		fromBlock = built + 1
+	}
+	// if there are no blocks to process, return the height we have
+	if fromBlock > toBlock {
+		return built, nil
+	}
 	if fromBlock == 0 {
-		log.Println("Clearing state")
-		conn.ClearState()
+		log.Println("Building state from block 0")
 	}
 
-	// TODO: Implement state sync
-	return stateBlock
+	added, err := buildGraph(ctx, s, cfg, fromBlock, toBlock)
+	if err != nil {
+		return built, err
+	}
+	if added > 0 {
+		log.Printf("Added %d graph edges from blocks %d to %d", added, fromBlock, toBlock)
+	}
+	return toBlock, saveGraphHeight(ctx, s, toBlock)
 }
 
-func SyncState(fromBlock int) (newBlock int) {
+// SyncState brings the social graph up to the indexed height. It is built
+// incrementally after each block, and from height 0 after ClearState.
+func SyncState(ctx context.Context, s store.Store, cfg *config.Config) (newBlock uint32, err error) {
 	// Set up timer for state sync
 	stateStart := time.Now()
 
-	// set skipSpv to true to trust every tx exists on the blockchain,
-	// false to verify every tx with a miner
-	newBlock = build(fromBlock, config.SkipSPV)
+	indexed, ok, err := s.LoadProgress(ctx)
+	if err != nil || !ok {
+		return 0, err
+	}
+	newBlock, err = build(ctx, s, cfg, indexed)
+	if err != nil {
+		return newBlock, err
+	}
 	diff := time.Since(stateStart).Seconds()
 	fmt.Printf("State sync complete to block height %d in %fs\n", newBlock, diff)
-
-	// update the state block clounter
-	SaveProgress(uint32(newBlock))
-
-	return
+	return newBlock, nil
 }
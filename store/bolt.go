@@ -0,0 +1,417 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Bolt is an embedded Store kept in a single bbolt file. Each collection is a
+// bucket of BSON encoded documents keyed by _id. Queries scan the bucket, so
+// it suits small deployments and tests rather than a full chain index.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens or creates the bolt store at path
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt store %s: %w", path, err)
+	}
+	return &Bolt{db}, nil
+}
+
+func boltKey(id interface{}) []byte {
+	if s, ok := id.(string); ok {
+		return []byte(s)
+	}
+	// numeric ids are normalised so 5, int64(5) and 5.0 are the same key
+	if f, ok := ToFloat(id); ok {
+		return []byte(fmt.Sprintf("%020.0f", f))
+	}
+	return []byte(fmt.Sprint(id))
+}
+
+// decodeDoc decodes a stored document. The bytes are copied first as bolt
+// values are only valid for the life of the transaction.
+func decodeDoc(v []byte) (Doc, error) {
+	var doc bson.M
+	if err := bson.Unmarshal(append([]byte(nil), v...), &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (b *Bolt) UpsertTx(ctx context.Context, collection string, doc Doc) error {
+	return b.UpsertTxs(ctx, collection, []Write{{Doc: doc}})
+}
+
+func (b *Bolt) UpsertTxs(ctx context.Context, collection string, writes []Write) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		for _, w := range writes {
+			if err = upsert(bucket, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func upsert(bucket *bolt.Bucket, w Write) (err error) {
+	id, ok := w.Doc["_id"]
+	if !ok {
+		return fmt.Errorf("document has no _id")
+	}
+
+	key := boltKey(id)
+	merged := bson.M{}
+	if existing := bucket.Get(key); existing != nil {
+		if merged, err = decodeDoc(existing); err != nil {
+			return err
+		}
+	}
+	for k, v := range w.Doc {
+		merged[k] = v
+	}
+	for k, v := range w.Defaults {
+		if current, ok := merged[k]; !ok || unset(current) {
+			merged[k] = v
+		}
+	}
+
+	data, err := bson.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+// unset reports whether a stored value is one Defaults replace: null or a
+// numeric 0, as the update of the Mongo store checks
+func unset(v interface{}) bool {
+	switch v.(type) {
+	case nil:
+		return true
+	case primitive.DateTime, time.Time:
+		return false
+	}
+	n, ok := ToFloat(v)
+	return ok && n == 0
+}
+
+func (b *Bolt) UpdateMany(ctx context.Context, collection string, f Filter, fields Doc) (count int64, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+
+		// bolt does not allow writes while iterating, so collect the
+		// updated documents first
+		updated := map[string][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			doc, err := decodeDoc(v)
+			if err != nil {
+				return err
+			}
+			if match, err := Matches(doc, f); err != nil || !match {
+				return err
+			}
+			for path, value := range fields {
+				setPath(doc, path, value)
+			}
+			data, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			updated[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for k, data := range updated {
+			if err = bucket.Put([]byte(k), data); err != nil {
+				return err
+			}
+		}
+		count = int64(len(updated))
+		return nil
+	})
+	return
+}
+
+// setPath sets a dotted path in doc, creating or replacing the documents
+// along the way
+func setPath(doc Doc, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := asMap(doc[part])
+		if !ok {
+			next = Doc{}
+		}
+		doc[part] = next
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+}
+
+func (b *Bolt) GetTx(ctx context.Context, collection string, id interface{}) (doc Doc, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return ErrNotFound
+		}
+		v := bucket.Get(boltKey(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		doc, err = decodeDoc(v)
+		return err
+	})
+	return
+}
+
+func (b *Bolt) DeleteTx(ctx context.Context, collection string, id interface{}) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(boltKey(id))
+	})
+}
+
+// scan calls fn for every document in collection matching f
+func (b *Bolt) scan(ctx context.Context, collection string, f Filter, fn func(doc Doc) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			doc, err := decodeDoc(v)
+			if err != nil {
+				return err
+			}
+			if match, err := Matches(doc, f); err != nil || !match {
+				return err
+			}
+			return fn(doc)
+		})
+	})
+}
+
+func (b *Bolt) Query(ctx context.Context, collection string, q Query) ([]Doc, error) {
+	if from, ok := seekable(q); ok {
+		return b.seek(ctx, collection, q, from)
+	}
+
+	var docs []Doc
+	err := b.scan(ctx, collection, q.Filter, func(doc Doc) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if q.SortBy != "" {
+		sort.SliceStable(docs, func(i, j int) bool {
+			x, _ := Lookup(docs[i], q.SortBy)
+			y, _ := Lookup(docs[j], q.SortBy)
+			c := compare(x, y)
+			if c == 0 {
+				c = compare(docs[i]["_id"], docs[j]["_id"])
+			}
+			if q.SortDesc {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+
+	if q.Skip >= int64(len(docs)) {
+		return nil, nil
+	}
+	docs = docs[q.Skip:]
+	if q.Limit > 0 && q.Limit < int64(len(docs)) {
+		docs = docs[:q.Limit]
+	}
+	return docs, nil
+}
+
+// seekable reports whether a query can be read in key order instead of
+// scanning and sorting the bucket: a limited query in _id order, starting
+// after the _id it returns, or at the start if it is nil. Keys sort like the
+// _ids they encode when the _ids of a collection are all strings or all
+// whole numbers, as the ones the indexer writes are.
+func seekable(q Query) (from interface{}, ok bool) {
+	if q.SortBy != "_id" || q.Limit == 0 {
+		return nil, false
+	}
+	cond, found := q.Filter["_id"]
+	if !found {
+		return nil, true
+	}
+	ops, isMap := asMap(cond)
+	op := "$gt"
+	if q.SortDesc {
+		op = "$lt"
+	}
+	from, ok = ops[op]
+	if !isMap || len(ops) != 1 || !ok {
+		return nil, false
+	}
+	if _, isString := from.(string); isString {
+		return from, true
+	}
+	n, isNumber := ToFloat(from)
+	return from, isNumber && n >= 0 && n == float64(int64(n))
+}
+
+// seek reads a seekable query from the key after from, stopping once it has
+// the documents asked for
+func (b *Bolt) seek(ctx context.Context, collection string, q Query, from interface{}) ([]Doc, error) {
+	var docs []Doc
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(collection))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		var k, v []byte
+		next := c.Next
+		switch {
+		case q.SortDesc:
+			next = c.Prev
+			if from == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(boltKey(from)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		case from == nil:
+			k, v = c.First()
+		default:
+			k, v = c.Seek(boltKey(from))
+		}
+
+		for ; k != nil && int64(len(docs)) < q.Skip+q.Limit; k, v = next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			doc, err := decodeDoc(v)
+			if err != nil {
+				return err
+			}
+			// the filter leaves out the key from itself
+			if match, err := Matches(doc, q.Filter); err != nil {
+				return err
+			} else if match {
+				docs = append(docs, doc)
+			}
+		}
+		return nil
+	})
+	if err != nil || q.Skip >= int64(len(docs)) {
+		return nil, err
+	}
+	return docs[q.Skip:], nil
+}
+
+func (b *Bolt) Count(ctx context.Context, collection string, f Filter) (count int64, err error) {
+	err = b.scan(ctx, collection, f, func(Doc) error {
+		count++
+		return nil
+	})
+	return
+}
+
+// CommitBlock writes the block and the progress in a single bolt transaction
+func (b *Bolt) CommitBlock(ctx context.Context, height uint32, writes map[string][]Write) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for collection, w := range writes {
+			bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+			if err != nil {
+				return err
+			}
+			for _, write := range w {
+				if err = upsert(bucket, write); err != nil {
+					return err
+				}
+			}
+		}
+		return saveProgress(tx, height)
+	})
+}
+
+// saveProgress advances the saved progress to height, unless it is
+// already past it
+func saveProgress(tx *bolt.Tx, height uint32) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(StateCollection))
+	if err != nil {
+		return err
+	}
+	if v := bucket.Get(boltKey(StateCollection)); v != nil {
+		doc, err := decodeDoc(v)
+		if err != nil {
+			return err
+		}
+		if saved, ok := ToFloat(doc["height"]); ok && saved > float64(height) {
+			return nil
+		}
+	}
+	return upsert(bucket, Write{Doc: Doc{"_id": StateCollection, "height": height}})
+}
+
+func (b *Bolt) SaveProgress(ctx context.Context, height uint32) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return saveProgress(tx, height)
+	})
+}
+
+func (b *Bolt) RewindProgress(ctx context.Context, height uint32) error {
+	return b.UpsertTx(ctx, StateCollection, Doc{"_id": StateCollection, "height": height})
+}
+
+func (b *Bolt) LoadProgress(ctx context.Context) (uint32, bool, error) {
+	doc, err := b.GetTx(ctx, StateCollection, StateCollection)
+	if err == ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	height, ok := progress(doc)
+	return height, ok, nil
+}
+
+func (b *Bolt) DropCollection(ctx context.Context, collection string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(collection))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *Bolt) Close(ctx context.Context) error {
+	return b.db.Close()
+}
@@ -0,0 +1,321 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func openTestBolt(t *testing.T) *Bolt {
+	t.Helper()
+	b, err := OpenBolt(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close(context.Background()) })
+	return b
+}
+
+func TestBoltDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored interface{} // nil for no stored doc, missing for a doc without the field
+		want   interface{}
+	}{
+		{"new doc", nil, int64(100)},
+		{"missing field", "missing", int64(100)},
+		{"null", primitive.Null{}, int64(100)},
+		{"zero", int64(0), int64(100)},
+		{"zero float", 0.0, int64(100)},
+		{"set", int64(5), int64(5)},
+		{"string zero", "0", "0"},
+		{"empty string", "", ""},
+		{"false", false, false},
+		{"epoch date", primitive.DateTime(0), primitive.DateTime(0)},
+	}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := openTestBolt(t)
+			switch tt.stored {
+			case nil:
+			case "missing":
+				if err := b.UpsertTx(ctx, "docs", Doc{"_id": "tx"}); err != nil {
+					t.Fatal(err)
+				}
+			default:
+				stored := tt.stored
+				if _, ok := stored.(primitive.Null); ok {
+					stored = nil
+				}
+				if err := b.UpsertTx(ctx, "docs", Doc{"_id": "tx", "timestamp": stored}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := Write{Doc: Doc{"_id": "tx", "status": "mempool"}, Defaults: Doc{"timestamp": int64(100)}}
+			if err := b.UpsertTxs(ctx, "docs", []Write{w}); err != nil {
+				t.Fatal(err)
+			}
+			doc, err := b.GetTx(ctx, "docs", "tx")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(doc["timestamp"], tt.want) {
+				t.Errorf("timestamp = %#v, want %#v", doc["timestamp"], tt.want)
+			}
+			if doc["status"] != "mempool" {
+				t.Errorf("status = %v, want mempool", doc["status"])
+			}
+		})
+	}
+}
+
+func TestBoltUpsertMerges(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	if err := b.UpsertTx(ctx, "docs", Doc{"_id": "tx", "a": "1", "b": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.UpsertTx(ctx, "docs", Doc{"_id": "tx", "b": "2", "c": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := b.GetTx(ctx, "docs", "tx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Doc{"_id": "tx", "a": "1", "b": "2", "c": "2"}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("doc = %v, want %v", doc, want)
+	}
+	if err = b.UpsertTx(ctx, "docs", Doc{"a": "1"}); err == nil {
+		t.Error("upserted a doc without an _id")
+	}
+}
+
+func TestBoltKeys(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	if err := b.UpsertTx(ctx, "blocks", Doc{"_id": uint32(5), "hash": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	// numeric ids of any type are the same key
+	for _, id := range []interface{}{5, int32(5), int64(5), 5.0} {
+		if _, err := b.GetTx(ctx, "blocks", id); err != nil {
+			t.Errorf("GetTx(%T %v): %v", id, id, err)
+		}
+	}
+	if _, err := b.GetTx(ctx, "blocks", "5"); err != ErrNotFound {
+		t.Errorf("GetTx(\"5\") = %v, want ErrNotFound", err)
+	}
+	if _, err := b.GetTx(ctx, "missing", 5); err != ErrNotFound {
+		t.Errorf("GetTx of a missing collection = %v, want ErrNotFound", err)
+	}
+
+	if err := b.DeleteTx(ctx, "blocks", int64(5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetTx(ctx, "blocks", 5); err != ErrNotFound {
+		t.Errorf("GetTx after DeleteTx = %v, want ErrNotFound", err)
+	}
+	if err := b.DeleteTx(ctx, "missing", 5); err != nil {
+		t.Errorf("DeleteTx of a missing collection: %v", err)
+	}
+}
+
+func TestBoltQuery(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	writes := []Write{
+		{Doc: Doc{"_id": "a", "n": 3, "type": "post"}},
+		{Doc: Doc{"_id": "b", "n": 1, "type": "post"}},
+		{Doc: Doc{"_id": "c", "n": 2, "type": "like"}},
+		{Doc: Doc{"_id": "d", "n": 2, "type": "post"}},
+		{Doc: Doc{"_id": "e", "type": "post"}},
+	}
+	if err := b.UpsertTxs(ctx, "docs", writes); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"natural order", Query{}, []string{"a", "b", "c", "d", "e"}},
+		{"sorted, missing first", Query{SortBy: "n"}, []string{"e", "b", "c", "d", "a"}},
+		{"sorted desc, ties by _id", Query{SortBy: "n", SortDesc: true}, []string{"a", "d", "c", "b", "e"}},
+		{"filtered", Query{Filter: Filter{"type": "post"}, SortBy: "n"}, []string{"e", "b", "d", "a"}},
+		{"skip and limit", Query{SortBy: "n", Skip: 1, Limit: 2}, []string{"b", "c"}},
+		{"skip past the end", Query{Skip: 10}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := b.Query(ctx, "docs", tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, doc := range docs {
+				got = append(got, doc["_id"].(string))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query = %v, want %v", got, tt.want)
+			}
+			count, err := b.Count(ctx, "docs", tt.q.Filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.q.Skip == 0 && tt.q.Limit == 0 && count != int64(len(tt.want)) {
+				t.Errorf("Count = %d, want %d", count, len(tt.want))
+			}
+		})
+	}
+
+	if docs, err := b.Query(ctx, "missing", Query{}); err != nil || len(docs) != 0 {
+		t.Errorf("Query of a missing collection = %v, %v", docs, err)
+	}
+	if _, err := b.Query(ctx, "docs", Query{Filter: Filter{"n": Filter{"$regex": "1"}}}); err == nil {
+		t.Error("Query with an unsupported operator did not fail")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.Query(cancelled, "docs", Query{}); err != context.Canceled {
+		t.Errorf("Query with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestBoltUpdateMany(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	writes := []Write{
+		{Doc: Doc{"_id": "a", "blk": Doc{"i": 10}}},
+		{Doc: Doc{"_id": "b", "blk": Doc{"i": 11}}},
+		{Doc: Doc{"_id": "c", "blk": Doc{"i": 12}}},
+	}
+	if err := b.UpsertTxs(ctx, "docs", writes); err != nil {
+		t.Fatal(err)
+	}
+	count, err := b.UpdateMany(ctx, "docs", Filter{"blk.i": Filter{"$gte": 11}}, Doc{"status": "orphaned", "blk.hash": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("UpdateMany updated %d docs, want 2", count)
+	}
+	for id, want := range map[string]interface{}{"a": nil, "b": "orphaned", "c": "orphaned"} {
+		doc, err := b.GetTx(ctx, "docs", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc["status"] != want {
+			t.Errorf("%s status = %v, want %v", id, doc["status"], want)
+		}
+		if want != nil {
+			// the rest of the nested doc is kept
+			if i, _ := Lookup(doc, "blk.i"); i == nil {
+				t.Errorf("%s lost blk.i", id)
+			}
+			if hash, _ := Lookup(doc, "blk.hash"); hash != "x" {
+				t.Errorf("%s blk.hash = %v, want x", id, hash)
+			}
+		}
+	}
+	if count, err = b.UpdateMany(ctx, "missing", Filter{}, Doc{"a": 1}); err != nil || count != 0 {
+		t.Errorf("UpdateMany of a missing collection = %d, %v", count, err)
+	}
+}
+
+func TestBoltProgress(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	load := func() uint32 {
+		t.Helper()
+		height, ok, err := b.LoadProgress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("no progress saved")
+		}
+		return height
+	}
+
+	if _, ok, err := b.LoadProgress(ctx); ok || err != nil {
+		t.Fatalf("LoadProgress of an empty store = %v, %v", ok, err)
+	}
+	steps := []struct {
+		name string
+		do   func() error
+		want uint32
+	}{
+		{"save", func() error { return b.SaveProgress(ctx, 10) }, 10},
+		{"save forward", func() error { return b.SaveProgress(ctx, 12) }, 12},
+		{"save backward is ignored", func() error { return b.SaveProgress(ctx, 11) }, 12},
+		{"commit forward", func() error { return b.CommitBlock(ctx, 13, nil) }, 13},
+		{"commit backward keeps the progress", func() error { return b.CommitBlock(ctx, 5, nil) }, 13},
+		{"rewind", func() error { return b.RewindProgress(ctx, 9) }, 9},
+		{"commit after a rewind", func() error { return b.CommitBlock(ctx, 10, nil) }, 10},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := load(); got != step.want {
+			t.Errorf("%s: progress = %d, want %d", step.name, got, step.want)
+		}
+	}
+}
+
+func TestBoltCommitBlock(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	writes := map[string][]Write{
+		"post":    {{Doc: Doc{"_id": "tx1", "blk": Doc{"i": 7}}}},
+		"_blocks": {{Doc: Doc{"_id": 7, "hash": "h7"}}},
+	}
+	if err := b.CommitBlock(ctx, 7, writes); err != nil {
+		t.Fatal(err)
+	}
+	for collection, id := range map[string]interface{}{"post": "tx1", "_blocks": 7} {
+		if _, err := b.GetTx(ctx, collection, id); err != nil {
+			t.Errorf("GetTx(%s, %v): %v", collection, id, err)
+		}
+	}
+
+	// a commit that fails writes nothing, not even the progress
+	bad := map[string][]Write{
+		"post":    {{Doc: Doc{"_id": "tx2"}}},
+		"_blocks": {{Doc: Doc{"hash": "h8"}}},
+	}
+	if err := b.CommitBlock(ctx, 8, bad); err == nil {
+		t.Fatal("committed a doc without an _id")
+	}
+	if _, err := b.GetTx(ctx, "post", "tx2"); err != ErrNotFound {
+		t.Errorf("GetTx of a failed commit = %v, want ErrNotFound", err)
+	}
+	if height, _, _ := b.LoadProgress(ctx); height != 7 {
+		t.Errorf("progress after a failed commit = %d, want 7", height)
+	}
+}
+
+func TestBoltDropCollection(t *testing.T) {
+	b := openTestBolt(t)
+	ctx := context.Background()
+	if err := b.UpsertTx(ctx, "docs", Doc{"_id": "a", "at": time.Unix(1, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DropCollection(ctx, "docs"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := b.Count(ctx, "docs", nil); err != nil || count != 0 {
+		t.Errorf("Count after DropCollection = %d, %v", count, err)
+	}
+	if err := b.DropCollection(ctx, "docs"); err != nil {
+		t.Errorf("DropCollection of a missing collection: %v", err)
+	}
+}
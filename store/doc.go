@@ -0,0 +1,149 @@
+package store
+
+import (
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The helpers below read documents however they were decoded: from JSON
+// block files, from bolt or from MongoDB.
+
+// Lookup resolves a dotted path. Arrays along the way are flattened so the
+// result may be a list of candidate values, as in MongoDB.
+func Lookup(doc Doc, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch c := current.(type) {
+		case map[string]interface{}, bson.M, primitive.D:
+			m, _ := asMap(c)
+			v, ok := m[part]
+			if !ok {
+				return nil, false
+			}
+			current = v
+		default:
+			list, ok := asList(c)
+			if !ok {
+				return nil, false
+			}
+			var values []interface{}
+			for _, item := range list {
+				if m, ok := asMap(item); ok {
+					if v, ok := Lookup(m, part); ok {
+						values = append(values, v)
+					}
+				}
+			}
+			if len(values) == 0 {
+				return nil, false
+			}
+			current = values
+		}
+	}
+	return current, true
+}
+
+// Entries returns the documents of a list field, like the MAP entries of a
+// tx, skipping anything that is not a document
+func Entries(v interface{}) (found []map[string]interface{}) {
+	list, _ := asList(v)
+	for _, item := range list {
+		if m, ok := asMap(item); ok {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// ToInt returns a number as an int64, or 0 if v is not a number
+func ToInt(v interface{}) int64 {
+	if n, ok := v.(int64); ok {
+		return n
+	}
+	f, _ := ToFloat(v)
+	return int64(f)
+}
+
+// ToFloat returns a number of any type as a float64
+func ToFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case primitive.DateTime:
+		return float64(n), true
+	case time.Time:
+		return float64(n.UnixMilli()), true
+	}
+	return 0, false
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case bson.M:
+		return m, true
+	case primitive.D:
+		return m.Map(), true
+	}
+	return nil, false
+}
+
+func asList(v interface{}) ([]interface{}, bool) {
+	switch l := v.(type) {
+	case []interface{}:
+		return l, true
+	case bson.A:
+		return l, true
+	case []string:
+		list := make([]interface{}, len(l))
+		for i, s := range l {
+			list[i] = s
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// ToDoc converts v to a document whose nested documents are maps, so it
+// encodes to JSON as it is stored
+func ToDoc(v interface{}) (Doc, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	dec.DefaultDocumentM()
+	var doc Doc
+	return doc, dec.Decode(&doc)
+}
+
+// FromDoc decodes a document into v, following its bson tags
+func FromDoc(doc Doc, v interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
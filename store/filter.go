@@ -0,0 +1,219 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Matches reports whether doc satisfies f, following MongoDB semantics for
+// the operators listed on Filter. Stores without a native query language
+// use it to evaluate filters.
+func Matches(doc Doc, f Filter) (bool, error) {
+	for key, cond := range f {
+		switch key {
+		case "$and", "$or":
+			clauses, err := clauseList(key, cond)
+			if err != nil {
+				return false, err
+			}
+			any := false
+			for _, clause := range clauses {
+				ok, err := Matches(doc, clause)
+				if err != nil {
+					return false, err
+				}
+				if key == "$and" && !ok {
+					return false, nil
+				}
+				any = any || ok
+			}
+			if key == "$or" && !any {
+				return false, nil
+			}
+			continue
+		}
+
+		value, found := Lookup(doc, key)
+		ok, err := matchField(value, found, cond)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func clauseList(op string, cond interface{}) ([]Filter, error) {
+	var clauses []Filter
+	switch c := cond.(type) {
+	case []Filter:
+		clauses = c
+	case []bson.M:
+		for _, m := range c {
+			clauses = append(clauses, m)
+		}
+	case []interface{}:
+		for _, item := range c {
+			m, ok := asMap(item)
+			if !ok {
+				return nil, fmt.Errorf("%s takes a list of filters", op)
+			}
+			clauses = append(clauses, m)
+		}
+	case bson.A:
+		return clauseList(op, []interface{}(c))
+	default:
+		return nil, fmt.Errorf("%s takes a list of filters", op)
+	}
+	return clauses, nil
+}
+
+// matchField matches a field value against either a literal or an operator
+// document
+func matchField(value interface{}, found bool, cond interface{}) (bool, error) {
+	ops, isMap := asMap(cond)
+	if !isMap || !isOperatorDoc(ops) {
+		return equals(value, cond), nil
+	}
+
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = equals(value, arg)
+		case "$ne":
+			ok = !equals(value, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = found && compareAny(value, arg, op)
+		case "$in", "$nin":
+			list, isList := asList(arg)
+			if !isList {
+				return false, fmt.Errorf("%s takes a list", op)
+			}
+			for _, item := range list {
+				if equals(value, item) {
+					ok = true
+					break
+				}
+			}
+			if op == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			want, _ := arg.(bool)
+			ok = found == want
+		default:
+			return false, fmt.Errorf("unsupported operator %s", op)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func isOperatorDoc(m map[string]interface{}) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) > 0
+}
+
+// equals compares a stored value against a filter value. A stored array
+// matches if any of its elements does.
+func equals(value interface{}, want interface{}) bool {
+	if list, ok := asList(value); ok {
+		if wantList, ok := asList(want); ok {
+			return reflect.DeepEqual(list, wantList)
+		}
+		for _, item := range list {
+			if equals(item, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return compare(value, want) == 0 && comparable(value, want)
+}
+
+func compareAny(value interface{}, arg interface{}, op string) bool {
+	if list, ok := asList(value); ok {
+		for _, item := range list {
+			if compareAny(item, arg, op) {
+				return true
+			}
+		}
+		return false
+	}
+	if !comparable(value, arg) {
+		return false
+	}
+	c := compare(value, arg)
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	default:
+		return c <= 0
+	}
+}
+
+// comparable reports whether two values are of kinds compare can order
+func comparable(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	_, aNum := ToFloat(a)
+	_, bNum := ToFloat(b)
+	if aNum || bNum {
+		return aNum && bNum
+	}
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	if aStr || bStr {
+		return aStr && bStr
+	}
+	return true
+}
+
+// compare orders two values: numbers numerically, strings lexically and
+// anything else by its printed form. nil sorts first.
+func compare(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if af, ok := ToFloat(a); ok {
+		if bf, ok := ToFloat(b); ok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs)
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
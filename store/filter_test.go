@@ -0,0 +1,137 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatches(t *testing.T) {
+	doc := Doc{
+		"_id":    "tx1",
+		"height": int32(10),
+		"score":  2.5,
+		"name":   "alice",
+		"tags":   []interface{}{"a", "b"},
+		"blk":    bson.M{"i": int64(800000)},
+		"MAP": primitive.A{
+			bson.M{"type": "post", "app": "bsocial"},
+			map[string]interface{}{"type": "like", "tx": "tx0"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"equal", Filter{"name": "alice"}, true},
+		{"not equal", Filter{"name": "bob"}, false},
+		{"number across types", Filter{"height": 10.0}, true},
+		{"string is not a number", Filter{"height": "10"}, false},
+		{"nested", Filter{"blk.i": 800000}, true},
+		{"array element", Filter{"tags": "b"}, true},
+		{"whole array", Filter{"tags": []interface{}{"a", "b"}}, true},
+		{"array in order only", Filter{"tags": []interface{}{"b", "a"}}, false},
+		{"flattened array of docs", Filter{"MAP.type": "like"}, true},
+		{"flattened array of docs, no match", Filter{"MAP.type": "message"}, false},
+		{"flattened field missing in some", Filter{"MAP.tx": "tx0"}, true},
+		{"null matches missing", Filter{"missing": nil}, true},
+		{"null does not match a value", Filter{"name": nil}, false},
+
+		{"$eq", Filter{"name": Filter{"$eq": "alice"}}, true},
+		{"$ne", Filter{"name": Filter{"$ne": "alice"}}, false},
+		{"$ne on a missing field", Filter{"missing": Filter{"$ne": "x"}}, true},
+		{"$ne null on a missing field", Filter{"missing": Filter{"$ne": nil}}, false},
+		{"$ne on an array", Filter{"tags": Filter{"$ne": "a"}}, false},
+		{"$ne on a flattened array", Filter{"MAP.type": Filter{"$ne": "message"}}, true},
+
+		{"$in", Filter{"name": Filter{"$in": []interface{}{"bob", "alice"}}}, true},
+		{"$in strings", Filter{"name": Filter{"$in": []string{"bob"}}}, false},
+		{"$in on an array", Filter{"tags": Filter{"$in": bson.A{"x", "b"}}}, true},
+		{"$in on a flattened array", Filter{"MAP.type": Filter{"$in": []string{"post", "message"}}}, true},
+		{"$in null on a missing field", Filter{"missing": Filter{"$in": []interface{}{nil, 0}}}, true},
+		{"$nin", Filter{"name": Filter{"$nin": []string{"alice"}}}, false},
+		{"$nin on a missing field", Filter{"missing": Filter{"$nin": []string{"alice"}}}, true},
+
+		{"$gt", Filter{"height": Filter{"$gt": 9}}, true},
+		{"$gt equal", Filter{"height": Filter{"$gt": 10}}, false},
+		{"$gte", Filter{"height": Filter{"$gte": uint32(10)}}, true},
+		{"$lt float", Filter{"score": Filter{"$lt": 3}}, true},
+		{"$lte", Filter{"score": Filter{"$lte": 2}}, false},
+		{"range", Filter{"blk.i": Filter{"$gte": 799999, "$lte": 800000}}, true},
+		{"range miss", Filter{"blk.i": Filter{"$gte": 800001, "$lte": 800002}}, false},
+		{"compare across types", Filter{"height": Filter{"$gt": "1"}}, false},
+		{"compare string to number", Filter{"name": Filter{"$lt": 100}}, false},
+		{"compare strings", Filter{"name": Filter{"$gt": "aaron"}}, true},
+		{"compare a missing field", Filter{"missing": Filter{"$lt": 1}}, false},
+		{"compare an array", Filter{"tags": Filter{"$gt": "a"}}, true},
+
+		{"$exists", Filter{"name": Filter{"$exists": true}}, true},
+		{"$exists false", Filter{"missing": Filter{"$exists": false}}, true},
+		{"$exists on a flattened array", Filter{"MAP.app": Filter{"$exists": true}}, true},
+
+		{"$and", Filter{"$and": []interface{}{Filter{"name": "alice"}, Filter{"height": 10}}}, true},
+		{"$and miss", Filter{"$and": []Filter{{"name": "alice"}, {"height": 11}}}, false},
+		{"$or", Filter{"$or": []interface{}{Filter{"name": "bob"}, Filter{"height": 10}}}, true},
+		{"$or miss", Filter{"$or": []bson.M{{"name": "bob"}, {"height": 11}}}, false},
+		{"literal doc", Filter{"blk": bson.M{"i": int64(800000)}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Matches(doc, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Matches(%v) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesErrors(t *testing.T) {
+	for _, f := range []Filter{
+		{"name": Filter{"$regex": "a"}},
+		{"name": Filter{"$in": "alice"}},
+		{"$or": "name"},
+		{"$and": []interface{}{"name"}},
+	} {
+		if _, err := Matches(Doc{"name": "alice"}, f); err == nil {
+			t.Errorf("Matches(%v) did not fail", f)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	doc := Doc{
+		"a": map[string]interface{}{"b": primitive.D{{Key: "c", Value: 1}}},
+		"list": []interface{}{
+			bson.M{"x": 1},
+			bson.M{"y": 2},
+			bson.M{"x": []interface{}{3, 4}},
+		},
+	}
+	tests := []struct {
+		path  string
+		want  interface{}
+		found bool
+	}{
+		{"a.b.c", 1, true},
+		{"a.b.d", nil, false},
+		{"a.z", nil, false},
+		{"list.x", []interface{}{1, []interface{}{3, 4}}, true},
+		{"list.y", []interface{}{2}, true},
+		{"list.z", nil, false},
+		{"missing", nil, false},
+	}
+	for _, tt := range tests {
+		got, found := Lookup(doc, tt.path)
+		if found != tt.found || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %v, %v, want %v, %v", tt.path, got, found, tt.want, tt.found)
+		}
+	}
+}
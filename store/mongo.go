@@ -0,0 +1,328 @@
+package store
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/rohenaz/go-bmap-indexer/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mongo is a Store backed by the MongoDB connection in the database package
+type Mongo struct {
+	*database.Connection
+
+	txnOnce sync.Once
+	txns    bool
+}
+
+func (m *Mongo) collection(name string) *mongo.Collection {
+	return m.Database(database.Name).Collection(name)
+}
+
+func (m *Mongo) UpsertTx(ctx context.Context, collection string, doc Doc) error {
+	_, err := m.collection(collection).UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": bson.M(doc)}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *Mongo) UpsertTxs(ctx context.Context, collection string, writes []Write) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, 0, len(writes))
+	for _, w := range writes {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": w.Doc["_id"]}).
+			SetUpdate(upsertUpdate(w)).
+			SetUpsert(true))
+	}
+
+	_, err := m.collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// upsertUpdate returns the update of a Write. With defaults it is a pipeline,
+// so a default fills in a missing, null or 0 field of an existing document
+// in the same update that sets the doc.
+func upsertUpdate(w Write) interface{} {
+	if len(w.Defaults) == 0 {
+		return bson.M{"$set": bson.M(w.Doc)}
+	}
+	set := bson.M{}
+	for k, v := range w.Doc {
+		// pipeline values are expressions, a string may be a field path
+		set[k] = bson.M{"$literal": v}
+	}
+	for k, v := range w.Defaults {
+		if current, ok := w.Doc[k]; ok {
+			if unset(current) {
+				set[k] = bson.M{"$literal": v}
+			}
+			continue
+		}
+		set[k] = bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$" + k, 0}}, 0}},
+			bson.M{"$literal": v},
+			"$" + k,
+		}}
+	}
+	return mongo.Pipeline{{{Key: "$set", Value: set}}}
+}
+
+func (m *Mongo) UpdateMany(ctx context.Context, collection string, f Filter, fields Doc) (int64, error) {
+	res, err := m.collection(collection).UpdateMany(ctx, filter(f), bson.M{"$set": bson.M(fields)})
+	if err != nil {
+		return 0, err
+	}
+	return res.MatchedCount, nil
+}
+
+func (m *Mongo) GetTx(ctx context.Context, collection string, id interface{}) (Doc, error) {
+	var doc bson.M
+	err := m.collection(collection).FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	return doc, err
+}
+
+func (m *Mongo) DeleteTx(ctx context.Context, collection string, id interface{}) error {
+	_, err := m.collection(collection).DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (m *Mongo) Query(ctx context.Context, collection string, q Query) ([]Doc, error) {
+	opts := options.Find().SetSkip(q.Skip)
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	if q.SortBy != "" {
+		dir := 1
+		if q.SortDesc {
+			dir = -1
+		}
+		sort := bson.D{{Key: q.SortBy, Value: dir}}
+		if q.SortBy != "_id" {
+			sort = append(sort, bson.E{Key: "_id", Value: dir})
+		}
+		opts.SetSort(sort)
+	}
+
+	cur, err := m.collection(collection).Find(ctx, filter(q.Filter), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var docs []Doc
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, cur.Err()
+}
+
+func (m *Mongo) Count(ctx context.Context, collection string, f Filter) (int64, error) {
+	return m.collection(collection).CountDocuments(ctx, filter(f))
+}
+
+// supportsTransactions reports whether the server is a replica set member or
+// mongos, the deployments with multi-document transactions
+func (m *Mongo) supportsTransactions(ctx context.Context) bool {
+	m.txnOnce.Do(func() {
+		var hello bson.M
+		err := m.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+		if err != nil {
+			log.Printf("[ERROR]: checking for transaction support: %v", err)
+			return
+		}
+		_, replicaSet := hello["setName"]
+		m.txns = replicaSet || hello["msg"] == "isdbgrid"
+		if !m.txns {
+			log.Println("MongoDB does not support transactions, committing blocks with a write-ahead marker")
+		}
+	})
+	return m.txns
+}
+
+// txnMaxWrites and txnMaxBytes bound the blocks committed in a transaction,
+// well within MongoDB's transaction time and 16MB oplog entry limits
+const (
+	txnMaxWrites = 1000
+	txnMaxBytes  = 8 << 20
+)
+
+// fitsTransaction reports whether the writes of a block are few and small
+// enough to commit in one transaction
+func fitsTransaction(writes map[string][]Write) bool {
+	count, size := 0, 0
+	for _, w := range writes {
+		count += len(w)
+		if count > txnMaxWrites {
+			return false
+		}
+		for _, write := range w {
+			for _, doc := range []Doc{write.Doc, write.Defaults} {
+				raw, err := bson.Marshal(doc)
+				if err != nil {
+					return false
+				}
+				if size += len(raw); size > txnMaxBytes {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// CommitBlock writes the block in a transaction when the server supports
+// them and the block fits in one. Otherwise the state document gets a
+// "pending" marker first, which is cleared with the progress update once
+// every write is done. Until then LoadProgress resumes from the block,
+// replaying it.
+func (m *Mongo) CommitBlock(ctx context.Context, height uint32, writes map[string][]Write) error {
+	if !m.supportsTransactions(ctx) || !fitsTransaction(writes) {
+		if err := m.updateState(ctx, bson.M{"$set": bson.M{"pending": height}}); err != nil {
+			return err
+		}
+		return m.commit(ctx, height, writes)
+	}
+
+	session, err := m.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, m.commit(sc, height, writes)
+	})
+	return err
+}
+
+func (m *Mongo) commit(ctx context.Context, height uint32, writes map[string][]Write) error {
+	for collection, w := range writes {
+		if err := m.UpsertTxs(ctx, collection, w); err != nil {
+			return err
+		}
+	}
+	return m.updateState(ctx, bson.M{
+		"$max":   bson.M{"height": height},
+		"$unset": bson.M{"pending": ""},
+	})
+}
+
+func (m *Mongo) updateState(ctx context.Context, update bson.M) error {
+	_, err := m.collection(StateCollection).UpdateOne(ctx, bson.M{"_id": StateCollection}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (m *Mongo) SaveProgress(ctx context.Context, height uint32) error {
+	return m.updateState(ctx, bson.M{
+		"$max":   bson.M{"height": height},
+		"$unset": bson.M{"pending": ""},
+	})
+}
+
+func (m *Mongo) RewindProgress(ctx context.Context, height uint32) error {
+	return m.updateState(ctx, bson.M{
+		"$set":   bson.M{"height": height},
+		"$unset": bson.M{"pending": ""},
+	})
+}
+
+func (m *Mongo) LoadProgress(ctx context.Context) (uint32, bool, error) {
+	doc, err := m.GetTx(ctx, StateCollection, StateCollection)
+	if err == ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	height, ok := progress(doc)
+	return height, ok, nil
+}
+
+func (m *Mongo) DropCollection(ctx context.Context, collection string) error {
+	return m.collection(collection).Drop(ctx)
+}
+
+func (m *Mongo) EnsureIndex(ctx context.Context, collection string, fields ...string) error {
+	keys := bson.D{}
+	for _, field := range fields {
+		if name, desc := strings.CutPrefix(field, "-"); desc {
+			keys = append(keys, bson.E{Key: name, Value: -1})
+		} else {
+			keys = append(keys, bson.E{Key: field, Value: 1})
+		}
+	}
+	_, err := m.collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys})
+	return err
+}
+
+func (m *Mongo) EnsureTextIndex(ctx context.Context, collection string, fields ...string) error {
+	keys := bson.D{}
+	for _, field := range fields {
+		keys = append(keys, bson.E{Key: field, Value: "text"})
+	}
+	// a collection can only have one text index, so it is named after its
+	// purpose rather than its fields
+	opts := options.Index().SetName("text").SetDefaultLanguage("none").SetLanguageOverride("_text_language")
+	_, err := m.collection(collection).Indexes().CreateOne(ctx, mongo.IndexModel{Keys: keys, Options: opts})
+	return err
+}
+
+func (m *Mongo) SearchText(ctx context.Context, collection string, text string, f Filter, limit int64) ([]Doc, error) {
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "_id", Value: 1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := m.collection(collection).Find(ctx, textFilter(text, f), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var docs []Doc
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, cur.Err()
+}
+
+func (m *Mongo) CountText(ctx context.Context, collection string, text string, f Filter) (int64, error) {
+	return m.collection(collection).CountDocuments(ctx, textFilter(text, f))
+}
+
+func textFilter(text string, f Filter) bson.M {
+	tf := bson.M{"$text": bson.M{"$search": text}}
+	for k, v := range f {
+		tf[k] = v
+	}
+	return tf
+}
+
+func (m *Mongo) Close(ctx context.Context) error {
+	return database.Disconnect(ctx)
+}
+
+func filter(f Filter) bson.M {
+	if f == nil {
+		return bson.M{}
+	}
+	return bson.M(f)
+}
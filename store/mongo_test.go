@@ -0,0 +1,65 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestFitsTransaction(t *testing.T) {
+	writes := func(n int, size int) []Write {
+		w := make([]Write, n)
+		for i := range w {
+			w[i] = Write{Doc: Doc{"_id": fmt.Sprint(i), "data": strings.Repeat("x", size)}}
+		}
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		writes map[string][]Write
+		want   bool
+	}{
+		{"empty", nil, true},
+		{"small", map[string][]Write{"post": writes(10, 100)}, true},
+		{"at the write limit", map[string][]Write{"post": writes(txnMaxWrites/2, 10), "like": writes(txnMaxWrites/2, 10)}, true},
+		{"too many writes", map[string][]Write{"post": writes(txnMaxWrites/2, 10), "like": writes(txnMaxWrites/2+1, 10)}, false},
+		{"too large", map[string][]Write{"post": writes(3, txnMaxBytes/2)}, false},
+		{"defaults count", map[string][]Write{"post": {{Doc: Doc{"_id": "a"}, Defaults: Doc{"data": strings.Repeat("x", txnMaxBytes)}}}}, false},
+	}
+	for _, tt := range tests {
+		if got := fitsTransaction(tt.writes); got != tt.want {
+			t.Errorf("%s: fitsTransaction = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpsertUpdate(t *testing.T) {
+	if got := upsertUpdate(Write{Doc: Doc{"_id": "a", "n": 1}}); !reflect.DeepEqual(got, bson.M{"$set": bson.M{"_id": "a", "n": 1}}) {
+		t.Errorf("update without defaults = %v", got)
+	}
+
+	got := upsertUpdate(Write{Doc: Doc{"_id": "a", "path": "$n", "zero": 0}, Defaults: Doc{"n": 1, "zero": 2}})
+	pipeline, ok := got.(mongo.Pipeline)
+	if !ok || len(pipeline) != 1 || pipeline[0][0].Key != "$set" {
+		t.Fatalf("update with defaults = %v, want a single $set stage", got)
+	}
+	set := pipeline[0][0].Value.(bson.M)
+	want := bson.M{
+		"_id":  bson.M{"$literal": "a"},
+		"path": bson.M{"$literal": "$n"},
+		"zero": bson.M{"$literal": 2},
+		"n": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{bson.M{"$ifNull": bson.A{"$n", 0}}, 0}},
+			bson.M{"$literal": 1},
+			"$n",
+		}},
+	}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("$set = %v, want %v", set, want)
+	}
+}
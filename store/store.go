@@ -0,0 +1,219 @@
+// Package store abstracts the database the indexer writes to, so the crawler
+// is not tied to MongoDB
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/database"
+)
+
+// Doc is an indexed document. Every document is keyed by its "_id" field.
+type Doc = map[string]interface{}
+
+// Filter selects documents. Keys are (dotted) field paths matched for
+// equality, or one of the supported operators: $eq, $ne, $gt, $gte, $lt,
+// $lte, $in, $nin, $exists, $and and $or.
+type Filter = map[string]interface{}
+
+// Query describes a filtered, sorted and paged read of a collection
+type Query struct {
+	Filter   Filter
+	SortBy   string // field to sort by, empty for natural order. Ties are broken by _id.
+	SortDesc bool
+	Skip     int64
+	Limit    int64 // 0 for no limit
+}
+
+// Write is one upsert of a bulk write. Doc is keyed by its _id like UpsertTx.
+// Defaults are only set where the stored document has no value for the
+// field, or the value is null or 0.
+type Write struct {
+	Doc      Doc
+	Defaults Doc
+}
+
+// ErrNotFound is returned by GetTx when no document has the given id
+var ErrNotFound = errors.New("document not found")
+
+// Store persists indexed documents and sync progress
+type Store interface {
+	// UpsertTx inserts doc, or sets its fields on the existing document
+	// with the same _id
+	UpsertTx(ctx context.Context, collection string, doc Doc) error
+	// UpsertTxs applies writes to collection in bulk. The writes are
+	// unordered, so they must not depend on each other.
+	UpsertTxs(ctx context.Context, collection string, writes []Write) error
+	// UpdateMany sets fields, which may be dotted paths, on every document
+	// matching filter and returns how many matched
+	UpdateMany(ctx context.Context, collection string, filter Filter, fields Doc) (int64, error)
+	// GetTx returns the document with the given id
+	GetTx(ctx context.Context, collection string, id interface{}) (Doc, error)
+	// DeleteTx removes the document with the given id if it exists
+	DeleteTx(ctx context.Context, collection string, id interface{}) error
+	Query(ctx context.Context, collection string, q Query) ([]Doc, error)
+	Count(ctx context.Context, collection string, filter Filter) (int64, error)
+	// CommitBlock writes every document of the block at height, grouped by
+	// collection, and advances the saved progress to height. The block is
+	// written atomically, or, when the store cannot, replayed from
+	// LoadProgress if the commit is interrupted. The progress never moves
+	// backwards, so older blocks can be committed again.
+	CommitBlock(ctx context.Context, height uint32, writes map[string][]Write) error
+	// SaveProgress records the last block height that was fully ingested.
+	// Like CommitBlock, it never moves the progress backwards.
+	SaveProgress(ctx context.Context, height uint32) error
+	// RewindProgress moves the progress back to height, for a reorg
+	RewindProgress(ctx context.Context, height uint32) error
+	// LoadProgress returns the height to resume from, or ok false if there
+	// is none. This is the saved height, unless a block commit was
+	// interrupted before it, in which case it is that block's height.
+	LoadProgress(ctx context.Context) (height uint32, ok bool, err error)
+	DropCollection(ctx context.Context, collection string) error
+	Close(ctx context.Context) error
+}
+
+// Indexer is implemented by stores that keep secondary indexes
+type Indexer interface {
+	// EnsureIndex creates an index on fields, in order, if it does not
+	// exist. A field prefixed with "-" is indexed descending.
+	EnsureIndex(ctx context.Context, collection string, fields ...string) error
+}
+
+// TextSearcher is implemented by stores with a native full-text search
+type TextSearcher interface {
+	// EnsureTextIndex creates the text index of collection over fields, if
+	// it does not exist. Text is matched without language specific
+	// stemming or stop words.
+	EnsureTextIndex(ctx context.Context, collection string, fields ...string) error
+	// SearchText returns the documents matching text and filter, the most
+	// relevant first, with their relevance in a "score" field
+	SearchText(ctx context.Context, collection string, text string, filter Filter, limit int64) ([]Doc, error)
+	// CountText counts the documents SearchText can return
+	CountText(ctx context.Context, collection string, text string, filter Filter) (int64, error)
+}
+
+// EnsureIndex creates an index on s if it keeps indexes. Stores that scan
+// their collections need none.
+func EnsureIndex(ctx context.Context, s Store, collection string, fields ...string) error {
+	if indexer, ok := s.(Indexer); ok {
+		return indexer.EnsureIndex(ctx, collection, fields...)
+	}
+	return nil
+}
+
+// StateCollection holds the sync progress
+const StateCollection = "_state"
+
+// progress reads the resume height from the state document. A "pending"
+// field is the write-ahead marker of a block commit that did not finish.
+func progress(doc Doc) (uint32, bool) {
+	height, ok := ToFloat(doc["height"])
+	if pending, isPending := ToFloat(doc["pending"]); isPending && (!ok || pending < height) {
+		log.Printf("[REPLAY]: block %.0f was not fully committed, resuming from it", pending)
+		return uint32(pending), true
+	}
+	return uint32(height), ok
+}
+
+// Open opens the store selected by cfg.Store
+func Open(cfg *config.Config) (Store, error) {
+	switch cfg.Store {
+	case "mongo":
+		if err := database.Connect(cfg); err != nil {
+			return nil, err
+		}
+		return &Mongo{Connection: database.GetConnection()}, nil
+	case "bolt":
+		b, err := OpenBolt(cfg.StorePath)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// Each pages through every document matching q, calling fn for each until
+// fn returns an error. A query without a sort field is read in _id order.
+// Each page starts after the last document of the one before, by its sort
+// field and _id, rather than skipping over every document already read.
+func Each(ctx context.Context, s Store, collection string, q Query, fn func(doc Doc) error) error {
+	const pageSize = 1000
+	if q.SortBy == "" {
+		q.SortBy = "_id"
+	}
+	limit := q.Limit
+	var last Doc
+	for {
+		page := q
+		page.Limit = pageSize
+		if limit > 0 && limit < pageSize {
+			page.Limit = limit
+		}
+		if last != nil {
+			page.Filter = after(q, last)
+			page.Skip = 0
+		}
+		docs, err := s.Query(ctx, collection, page)
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err = fn(doc); err != nil {
+				return err
+			}
+		}
+		if int64(len(docs)) < page.Limit {
+			return nil
+		}
+		last = docs[len(docs)-1]
+		if limit > 0 {
+			if limit -= int64(len(docs)); limit == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// after narrows the filter of q to the documents sorted after doc. Missing
+// values sort below any other, as they do in MongoDB.
+func after(q Query, doc Doc) Filter {
+	gt := "$gt"
+	if q.SortDesc {
+		gt = "$lt"
+	}
+	cursor := Filter{"_id": Filter{gt: doc["_id"]}}
+	if q.SortBy != "_id" {
+		v, _ := Lookup(doc, q.SortBy)
+		tie := Filter{q.SortBy: v, "_id": Filter{gt: doc["_id"]}}
+		switch {
+		case v == nil && q.SortDesc:
+			cursor = tie
+		case v == nil:
+			cursor = Filter{"$or": []Filter{{q.SortBy: Filter{"$ne": nil}}, tie}}
+		case q.SortDesc:
+			cursor = Filter{"$or": []Filter{{q.SortBy: Filter{gt: v}}, {q.SortBy: nil}, tie}}
+		default:
+			cursor = Filter{"$or": []Filter{{q.SortBy: Filter{gt: v}}, tie}}
+		}
+	}
+
+	if len(q.Filter) == 0 {
+		return cursor
+	}
+	if _, ok := q.Filter["_id"]; ok || q.SortBy != "_id" {
+		return Filter{"$and": []Filter{q.Filter, cursor}}
+	}
+	// the _id condition is kept at the top, where the bolt store seeks by it
+	f := make(Filter, len(q.Filter)+1)
+	for k, v := range q.Filter {
+		f[k] = v
+	}
+	f["_id"] = cursor["_id"]
+	return f
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  Doc
+		want uint32
+		ok   bool
+	}{
+		{"none", Doc{}, 0, false},
+		{"height", Doc{"height": int64(10)}, 10, true},
+		{"pending after the height", Doc{"height": int64(10), "pending": int64(11)}, 10, true},
+		{"pending before the height", Doc{"height": int64(10), "pending": int64(7)}, 7, true},
+		{"pending only", Doc{"pending": int32(3)}, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := progress(tt.doc)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("progress(%v) = %d, %v, want %d, %v", tt.doc, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEach(t *testing.T) {
+	s := openTestBolt(t)
+	ctx := context.Background()
+	var writes []Write
+	for i := 0; i < 2500; i++ {
+		doc := Doc{"_id": i, "n": i}
+		// a field with ties, missing from some documents
+		if i%10 != 0 {
+			doc["g"] = i % 3
+		}
+		writes = append(writes, Write{Doc: doc})
+	}
+	if err := s.UpsertTxs(ctx, "docs", writes); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want int
+	}{
+		{"every page", Query{SortBy: "n"}, 2500},
+		{"limit within a page", Query{SortBy: "n", Limit: 10}, 10},
+		{"limit across pages", Query{SortBy: "n", Limit: 1500}, 1500},
+		{"skip", Query{SortBy: "n", Skip: 2000}, 500},
+		{"filter", Query{Filter: Filter{"n": Filter{"$lt": 1200}}, SortBy: "n"}, 1200},
+		{"_id order", Query{}, 2500},
+		{"descending", Query{SortBy: "n", SortDesc: true}, 2500},
+		{"descending _ids with a limit", Query{SortBy: "_id", SortDesc: true, Limit: 1200}, 1200},
+		{"filter on _id", Query{Filter: Filter{"_id": Filter{"$gte": 100}}, SortBy: "_id", Skip: 50}, 2350},
+		{"ties and missing values", Query{SortBy: "g"}, 2500},
+		{"ties and missing values descending", Query{SortBy: "g", SortDesc: true, Skip: 10}, 2490},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each reads the documents of a single query, page by page
+			sorted := tt.q
+			if sorted.SortBy == "" {
+				sorted.SortBy = "_id"
+			}
+			want, err := s.Query(ctx, "docs", Query{Filter: sorted.Filter, SortBy: sorted.SortBy, SortDesc: sorted.SortDesc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = want[tt.q.Skip:]
+
+			var got int
+			err = Each(ctx, s, "docs", tt.q, func(doc Doc) error {
+				if got >= len(want) || doc["_id"] != want[got]["_id"] {
+					t.Fatalf("doc %d is %v", got, doc["_id"])
+				}
+				got++
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Each read %d docs, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+// Package storetest opens a throwaway bolt store for the tests of the
+// packages that read and write through a store
+package storetest
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/config"
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Open opens a bolt store in a temporary directory and closes it when the
+// test ends. It returns the store and the config it was opened with, for the
+// test to adjust.
+func Open(t testing.TB) (store.Store, *config.Config) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Store = "bolt"
+	cfg.StorePath = filepath.Join(t.TempDir(), "store.db")
+	cfg.SearchPath = ""
+	s, err := store.Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close(context.Background()) })
+	return s, cfg
+}
@@ -0,0 +1,275 @@
+// Package thread links posts that reply to other posts, with MAP context=tx
+// and tx=<txid>, into threads. Every post gets its parent, the root of its
+// thread, its depth and its number of direct replies, whatever order the
+// posts are ingested in.
+package thread
+
+import (
+	"context"
+	"slices"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Collection holds a node for every post, keyed by txid
+const Collection = "_threads"
+
+// Node is the place of a post in its thread
+type Node struct {
+	Txid        string   `bson:"_id"`
+	Parent      string   `bson:"parent,omitempty"`
+	Root        string   `bson:"root"`
+	Depth       int      `bson:"depth"`
+	Height      uint32   `bson:"height,omitempty"` // block the post was mined in, 0 in the mempool
+	Collections []string `bson:"collections"`      // collections the post is written to
+}
+
+// Batch collects the posts written with a block file, to index once they
+// are stored
+type Batch struct {
+	s     store.Store
+	nodes []*Node
+	byId  map[string]*Node
+}
+
+// NewBatch returns an empty batch that indexes into s
+func NewBatch(s store.Store) *Batch {
+	return &Batch{s: s, byId: map[string]*Node{}}
+}
+
+// Add notes a write to collection, if it is a post
+func (b *Batch) Add(collection string, w store.Write) {
+	txid, _ := w.Doc["_id"].(string)
+	parent, ok := replyTo(w.Doc)
+	if !ok || txid == "" {
+		return
+	}
+	if parent == txid {
+		parent = ""
+	}
+	if n, seen := b.byId[txid]; seen {
+		if !slices.Contains(n.Collections, collection) {
+			n.Collections = append(n.Collections, collection)
+		}
+		return
+	}
+	blk, _ := store.Lookup(w.Doc, "blk.i")
+	n := &Node{Txid: txid, Parent: parent, Height: uint32(store.ToInt(blk)), Collections: []string{collection}}
+	b.nodes = append(b.nodes, n)
+	b.byId[txid] = n
+}
+
+// Index links the posts of the batch into their threads, in the order they
+// were added
+func (b *Batch) Index(ctx context.Context) error {
+	for _, n := range b.nodes {
+		if err := index(ctx, b.s, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback takes the posts of the blocks from height up out of their
+// threads. Their replies stay, as replies to a post that has not been seen.
+func Rollback(ctx context.Context, s store.Store, height uint32) error {
+	var orphaned []*Node
+	q := store.Query{Filter: store.Filter{"height": store.Filter{"$gte": height}}}
+	err := store.Each(ctx, s, Collection, q, func(doc store.Doc) error {
+		n := &Node{}
+		if err := store.FromDoc(doc, n); err != nil {
+			return err
+		}
+		orphaned = append(orphaned, n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range orphaned {
+		if err = s.DeleteTx(ctx, Collection, n.Txid); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range orphaned {
+		if n.Parent != "" {
+			parent, err := get(ctx, s, n.Parent)
+			if err == nil {
+				err = countReplies(ctx, s, parent)
+			}
+			if err != nil && err != store.ErrNotFound {
+				return err
+			}
+		}
+		children, err := replies(ctx, s, n.Txid)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			child.Root, child.Depth = n.Txid, 1
+			if err = save(ctx, s, child); err != nil {
+				return err
+			}
+			if err = relink(ctx, s, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replyTo returns the txid a post replies to, or "" for a post that starts a
+// thread. ok is false if doc is not a post.
+func replyTo(doc store.Doc) (parent string, ok bool) {
+	for _, m := range store.Entries(doc["MAP"]) {
+		if mapType, _ := m["type"].(string); mapType != "post" {
+			continue
+		}
+		ok = true
+		if context, _ := m["context"].(string); context == "tx" {
+			parent, _ = m["tx"].(string)
+		}
+	}
+	return parent, ok
+}
+
+// index places a post in its thread. A reply whose parent has not been seen
+// yet is the start of a thread rooted at the parent txid, and is moved under
+// the parent when the parent arrives.
+func index(ctx context.Context, s store.Store, n *Node) error {
+	if existing, err := get(ctx, s, n.Txid); err == nil {
+		for _, collection := range existing.Collections {
+			if !slices.Contains(n.Collections, collection) {
+				n.Collections = append(n.Collections, collection)
+			}
+		}
+	} else if err != store.ErrNotFound {
+		return err
+	}
+
+	n.Root, n.Depth = n.Txid, 0
+	var parent *Node
+	if n.Parent != "" {
+		p, err := get(ctx, s, n.Parent)
+		switch {
+		case err == nil:
+			parent = p
+			n.Root, n.Depth = p.Root, p.Depth+1
+		case err == store.ErrNotFound:
+			n.Root, n.Depth = n.Parent, 1
+		default:
+			return err
+		}
+	}
+	if err := save(ctx, s, n); err != nil {
+		return err
+	}
+	if parent != nil {
+		if err := countReplies(ctx, s, parent); err != nil {
+			return err
+		}
+	}
+	// replies seen before this post join its thread
+	return relink(ctx, s, n)
+}
+
+// relink moves the replies under n, and theirs in turn, to n's thread
+func relink(ctx context.Context, s store.Store, n *Node) error {
+	visited := map[string]bool{n.Txid: true}
+	queue := []*Node{n}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		children, err := replies(ctx, s, parent.Txid)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			// a reply loop is cut where it closes
+			if visited[child.Txid] {
+				continue
+			}
+			visited[child.Txid] = true
+			if child.Root != parent.Root || child.Depth != parent.Depth+1 {
+				child.Root, child.Depth = parent.Root, parent.Depth+1
+				if err = save(ctx, s, child); err != nil {
+					return err
+				}
+			}
+			queue = append(queue, child)
+		}
+	}
+	return nil
+}
+
+// save stores the node and sets the thread fields of the post
+func save(ctx context.Context, s store.Store, n *Node) error {
+	doc, err := store.ToDoc(n)
+	if err != nil {
+		return err
+	}
+	if err = s.UpsertTx(ctx, Collection, doc); err != nil {
+		return err
+	}
+	count, err := s.Count(ctx, Collection, store.Filter{"parent": n.Txid})
+	if err != nil {
+		return err
+	}
+	fields := store.Doc{"root": n.Root, "depth": n.Depth, "reply_count": count}
+	if n.Parent != "" {
+		fields["parent"] = n.Parent
+	}
+	return setFields(ctx, s, n, fields)
+}
+
+// countReplies sets the reply count of a post from its replies
+func countReplies(ctx context.Context, s store.Store, n *Node) error {
+	count, err := s.Count(ctx, Collection, store.Filter{"parent": n.Txid})
+	if err != nil {
+		return err
+	}
+	return setFields(ctx, s, n, store.Doc{"reply_count": count})
+}
+
+func setFields(ctx context.Context, s store.Store, n *Node, fields store.Doc) error {
+	for _, collection := range n.Collections {
+		if _, err := s.UpdateMany(ctx, collection, store.Filter{"_id": n.Txid}, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func get(ctx context.Context, s store.Store, txid string) (*Node, error) {
+	doc, err := s.GetTx(ctx, Collection, txid)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{}
+	return n, store.FromDoc(doc, n)
+}
+
+func replies(ctx context.Context, s store.Store, txid string) (children []*Node, err error) {
+	q := store.Query{Filter: store.Filter{"parent": txid}}
+	err = store.Each(ctx, s, Collection, q, func(doc store.Doc) error {
+		n := &Node{}
+		if err := store.FromDoc(doc, n); err != nil {
+			return err
+		}
+		children = append(children, n)
+		return nil
+	})
+	return children, err
+}
+
+// EnsureIndexes creates the indexes replies and threads are read by
+func EnsureIndexes(ctx context.Context, s store.Store) error {
+	if err := store.EnsureIndex(ctx, s, Collection, "parent"); err != nil {
+		return err
+	}
+	if err := store.EnsureIndex(ctx, s, Collection, "root", "depth"); err != nil {
+		return err
+	}
+	return store.EnsureIndex(ctx, s, Collection, "height")
+}
@@ -0,0 +1,182 @@
+package thread
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+	"github.com/rohenaz/go-bmap-indexer/store/storetest"
+)
+
+// post returns the write of a post, a reply to parent unless it is ""
+func post(txid string, parent string, height int, timestamp int64) store.Write {
+	entry := map[string]interface{}{"type": "post"}
+	if parent != "" {
+		entry["context"], entry["tx"] = "tx", parent
+	}
+	doc := store.Doc{"_id": txid, "timestamp": timestamp, "MAP": []interface{}{entry}}
+	if height > 0 {
+		doc["blk"] = map[string]interface{}{"i": height}
+	}
+	return store.Write{Doc: doc}
+}
+
+// ingest writes the posts to the post collection and indexes them as one
+// block file
+func ingest(t *testing.T, s store.Store, writes ...store.Write) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.UpsertTxs(ctx, "post", writes); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBatch(s)
+	for _, w := range writes {
+		b.Add("post", w)
+	}
+	if err := b.Index(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// placed checks the thread fields of a stored post
+func placed(t *testing.T, s store.Store, txid string, root string, depth int, replies int) {
+	t.Helper()
+	doc, err := s.GetTx(context.Background(), "post", txid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["root"] != root || store.ToInt(doc["depth"]) != int64(depth) || store.ToInt(doc["reply_count"]) != int64(replies) {
+		t.Errorf("%s: root %v, depth %v, %v replies, want %s, %d, %d",
+			txid, doc["root"], doc["depth"], doc["reply_count"], root, depth, replies)
+	}
+}
+
+func TestReplyTo(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    store.Doc
+		parent string
+		ok     bool
+	}{
+		{"post", post("a", "", 0, 0).Doc, "", true},
+		{"reply", post("b", "a", 0, 0).Doc, "a", true},
+		{"like", store.Doc{"MAP": []interface{}{map[string]interface{}{"type": "like", "context": "tx", "tx": "a"}}}, "", false},
+		{"no MAP", store.Doc{}, "", false},
+	}
+	for _, tt := range tests {
+		parent, ok := replyTo(tt.doc)
+		if parent != tt.parent || ok != tt.ok {
+			t.Errorf("%s: replyTo = %q, %v, want %q, %v", tt.name, parent, ok, tt.parent, tt.ok)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	s, _ := storetest.Open(t)
+
+	ingest(t, s, post("root", "", 1, 1), post("a", "root", 1, 2))
+	placed(t, s, "root", "root", 0, 1)
+	placed(t, s, "a", "root", 1, 0)
+
+	// a reply to a post not seen yet starts a thread at the missing post,
+	// and joins the thread once it arrives
+	ingest(t, s, post("c", "b", 2, 4))
+	placed(t, s, "c", "b", 1, 0)
+	ingest(t, s, post("b", "a", 3, 3))
+	placed(t, s, "b", "root", 2, 1)
+	placed(t, s, "c", "root", 3, 0)
+	placed(t, s, "a", "root", 1, 1)
+
+	// indexing a post again changes nothing
+	ingest(t, s, post("b", "a", 3, 3))
+	placed(t, s, "b", "root", 2, 1)
+	placed(t, s, "a", "root", 1, 1)
+
+	// a reply loop is cut where it closes
+	ingest(t, s, post("x", "y", 4, 5), post("y", "x", 4, 6))
+	if _, err := get(context.Background(), s, "y"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s, _ := storetest.Open(t)
+	ctx := context.Background()
+	ingest(t, s,
+		post("root", "", 1, 1),
+		post("late", "root", 1, 9),
+		post("early", "root", 1, 2),
+		post("deep", "early", 1, 3),
+	)
+
+	tree, err := Get(ctx, s, "deep", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Txid != "deep" || tree.Doc == nil {
+		t.Fatalf("Get(deep) = %+v", tree)
+	}
+	if tree, err = Get(ctx, s, "root", 10); err != nil {
+		t.Fatal(err)
+	}
+	// replies are oldest first
+	if len(tree.Replies) != 2 || tree.Replies[0].Txid != "early" || tree.Replies[1].Txid != "late" {
+		t.Fatalf("replies = %+v", tree.Replies)
+	}
+	if len(tree.Replies[0].Replies) != 1 || tree.Replies[0].Replies[0].Txid != "deep" {
+		t.Errorf("replies of early = %+v", tree.Replies[0].Replies)
+	}
+
+	// the shallowest posts are kept under the limit
+	if tree, err = Get(ctx, s, "root", 3); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Replies) != 2 || len(tree.Replies[0].Replies) != 0 {
+		t.Errorf("limited thread = %+v", tree)
+	}
+
+	// a post that was not seen but has replies is the root of a thread
+	ingest(t, s, post("orphan", "missing", 2, 4))
+	if tree, err = Get(ctx, s, "missing", 10); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Doc != nil || len(tree.Replies) != 1 {
+		t.Errorf("Get(missing) = %+v", tree)
+	}
+	if _, err = Get(ctx, s, "nothing", 10); err == nil {
+		t.Error("Get of an unknown post did not fail")
+	}
+}
+
+func TestRollback(t *testing.T) {
+	s, _ := storetest.Open(t)
+	ctx := context.Background()
+	ingest(t, s, post("root", "", 1, 1), post("a", "root", 1, 2))
+	ingest(t, s, post("b", "a", 2, 3), post("c", "root", 2, 4))
+	// a mempool reply to a post of the rolled back block
+	ingest(t, s, post("d", "b", 0, 5))
+	placed(t, s, "root", "root", 0, 2)
+
+	if err := Rollback(ctx, s, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, txid := range []string{"b", "c"} {
+		if _, err := get(ctx, s, txid); err != store.ErrNotFound {
+			t.Errorf("node %s after rollback = %v, want ErrNotFound", txid, err)
+		}
+	}
+	placed(t, s, "root", "root", 0, 1)
+	// d stays as a reply to a post that has not been seen
+	placed(t, s, "d", "b", 1, 0)
+	n, err := get(ctx, s, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Root != "b" || n.Depth != 1 {
+		t.Errorf("node d = %+v", n)
+	}
+
+	// the rolled back block is mined again
+	ingest(t, s, post("b", "a", 3, 3))
+	placed(t, s, "d", "root", 3, 0)
+}
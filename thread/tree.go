@@ -0,0 +1,85 @@
+package thread
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/rohenaz/go-bmap-indexer/store"
+)
+
+// Tree is a post and the replies to it
+type Tree struct {
+	Txid    string    `json:"txid"`
+	Doc     store.Doc `json:"doc"` // null for a post that has not been seen
+	Replies []*Tree   `json:"replies"`
+}
+
+// Get returns the thread under the post with the given txid, with at most
+// limit posts, the shallowest first. It returns store.ErrNotFound if the
+// post neither was seen nor has replies.
+func Get(ctx context.Context, s store.Store, txid string, limit int64) (*Tree, error) {
+	root := txid
+	if n, err := get(ctx, s, txid); err == nil {
+		root = n.Root
+	} else if err != store.ErrNotFound {
+		return nil, err
+	}
+
+	q := store.Query{Filter: store.Filter{"root": root}, SortBy: "depth", Limit: limit}
+	nodes, err := s.Query(ctx, Collection, q)
+	if err != nil {
+		return nil, err
+	}
+
+	// a root that has not been seen has no node of its own
+	trees := map[string]*Tree{root: {Txid: root, Replies: []*Tree{}}}
+	parents := map[string]string{}
+	var order []string
+	for _, doc := range nodes {
+		n := &Node{}
+		if err = store.FromDoc(doc, n); err != nil {
+			return nil, err
+		}
+		t := trees[n.Txid]
+		if t == nil {
+			t = &Tree{Txid: n.Txid, Replies: []*Tree{}}
+			trees[n.Txid] = t
+		}
+		if len(n.Collections) > 0 {
+			if t.Doc, err = s.GetTx(ctx, n.Collections[0], n.Txid); err != nil && err != store.ErrNotFound {
+				return nil, err
+			}
+		}
+		if n.Parent != "" {
+			parents[n.Txid] = n.Parent
+			order = append(order, n.Txid)
+		}
+	}
+	for _, id := range order {
+		// replies past the limit are left out with their parents
+		if parent, ok := trees[parents[id]]; ok {
+			parent.Replies = append(parent.Replies, trees[id])
+		}
+	}
+	for _, t := range trees {
+		sort.SliceStable(t.Replies, func(i, j int) bool {
+			a, b := timestamp(t.Replies[i].Doc), timestamp(t.Replies[j].Doc)
+			if a != b {
+				return a < b
+			}
+			return t.Replies[i].Txid < t.Replies[j].Txid
+		})
+	}
+
+	t, ok := trees[txid]
+	if !ok || (t.Doc == nil && len(t.Replies) == 0) {
+		return nil, fmt.Errorf("thread %s: %w", txid, store.ErrNotFound)
+	}
+	return t, nil
+}
+
+func timestamp(doc store.Doc) float64 {
+	t, _ := store.ToFloat(doc["timestamp"])
+	return t
+}